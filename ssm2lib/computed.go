@@ -0,0 +1,70 @@
+package ssm2lib
+
+import (
+	"fmt"
+
+	"github.com/Knetic/govaluate"
+)
+
+// ComputedChannel is a user-defined output channel calculated from other
+// channels of the same sample, e.g. "(map_kpa - baro_kpa) * 0.145". It uses
+// the same expression engine as the definition conversions.
+type ComputedChannel struct {
+	Name   string
+	Units  string
+	Expr   string
+	Format string
+	expr   *govaluate.EvaluableExpression
+	format decimalFormat
+}
+
+func CompileComputedChannel(name string, units string, expr string, format string) (*ComputedChannel, error) {
+	if name == "" {
+		return nil, fmt.Errorf("Computed channel with expression %q has no name", expr)
+	}
+	compiled, err := govaluate.NewEvaluableExpression(expr)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to compile computed channel %s expression %q: %s", name, expr, err)
+	}
+	return &ComputedChannel{
+		Name:   name,
+		Units:  units,
+		Expr:   expr,
+		Format: format,
+		expr:   compiled,
+		format: parseDecimalFormat(format),
+	}, nil
+}
+
+// Variables lists the channel keys the expression references.
+func (c *ComputedChannel) Variables() []string {
+	return c.expr.Vars()
+}
+
+func (c *ComputedChannel) Evaluate(values map[string]interface{}) (float64, error) {
+	result, err := c.expr.Evaluate(values)
+	if err != nil {
+		return 0, err
+	}
+	converted, ok := result.(float64)
+	if !ok {
+		return 0, fmt.Errorf("Computed channel %s did not evaluate to a number, got %v", c.Name, result)
+	}
+	return converted, nil
+}
+
+func (c *ComputedChannel) FormatValue(value float64) string {
+	return c.format.Format(value)
+}
+
+func (c *ComputedChannel) JavaFormatValue(value float64) string {
+	return c.format.JavaFormat(value)
+}
+
+func (c *ComputedChannel) Decimals() int {
+	return c.format.Decimals()
+}
+
+func (c *ComputedChannel) RoundValue(value float64) float64 {
+	return c.format.Round(value)
+}
@@ -0,0 +1,220 @@
+package ssm2lib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/Knetic/govaluate"
+)
+
+// CompiledConversion is a parameter conversion with its expression already
+// parsed, so it can be evaluated for every sample without hitting the
+// govaluate lexer/parser again.
+type CompiledConversion struct {
+	Conversion Ssm2ParameterConversion
+	expr       *govaluate.EvaluableExpression
+	format     decimalFormat
+}
+
+// conversionParameters feeds the raw value to govaluate as "x" without
+// allocating a map per evaluation.
+type conversionParameters struct {
+	x float64
+}
+
+func (p conversionParameters) Get(name string) (interface{}, error) {
+	if name == "x" {
+		return p.x, nil
+	}
+	return nil, fmt.Errorf("No parameter '%s' found.", name)
+}
+
+// CompileConversion parses the conversion expression. An empty expression is
+// treated as "x", passing the raw value through unchanged.
+func CompileConversion(conversion Ssm2ParameterConversion) (*CompiledConversion, error) {
+	exprString := conversion.Expr
+	if exprString == "" {
+		exprString = "x"
+	}
+	expr, err := govaluate.NewEvaluableExpression(exprString)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to compile conversion expression %q (%s): %s", conversion.Expr, conversion.Units, err)
+	}
+	return &CompiledConversion{Conversion: conversion, expr: expr, format: parseDecimalFormat(conversion.Format)}, nil
+}
+
+func (c *CompiledConversion) Evaluate(value []byte) (float64, error) {
+	result, err := c.expr.Eval(conversionParameters{x: rawValue(value, c.Conversion.StorageType)})
+	if err != nil {
+		return 0, err
+	}
+	converted, ok := result.(float64)
+	if !ok {
+		return 0, fmt.Errorf("Conversion expression %q did not evaluate to a number, got %v", c.Conversion.Expr, result)
+	}
+	return converted, nil
+}
+
+// FormatValue renders a converted value using the conversion's format
+// string, falling back to "%f" when the definition doesn't provide one.
+func (c *CompiledConversion) FormatValue(value float64) string {
+	return c.format.Format(value)
+}
+
+// JavaFormatValue renders a converted value the way RomRaider's logger does,
+// which can differ from FormatValue in the last digit and the leading zero.
+func (c *CompiledConversion) JavaFormatValue(value float64) string {
+	return c.format.JavaFormat(value)
+}
+
+// Decimals is the most decimals FormatValue writes, or -1 when the
+// conversion has no format.
+func (c *CompiledConversion) Decimals() int {
+	return c.format.Decimals()
+}
+
+// RoundValue rounds a converted value to the number of decimals the format
+// string allows, for outputs that keep values numeric.
+func (c *CompiledConversion) RoundValue(value float64) float64 {
+	return c.format.Round(value)
+}
+
+// InGaugeRange reports whether value lies within the gauge limits, widened
+// on both sides by margin times the gauge span. Conversions without a usable
+// gauge range accept everything.
+func (c *CompiledConversion) InGaugeRange(value float64, margin float64) bool {
+	return c.Conversion.InGaugeRange(value, margin)
+}
+
+// rawValue decodes the big-endian bytes the ECU returned for a parameter
+// according to the conversion's storage type. Without a storage type the
+// bytes are read as an unsigned integer.
+// TODO: I'm making several assumptions here. I've only tested with 1 byte
+// responses so far, and I'm not 100% sure what the 2+ byte responses are or
+// how they work.
+func rawValue(value []byte, storageType string) float64 {
+	switch {
+	case storageType == "float" && len(value) == 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(value)))
+	case storageType == "int8" && len(value) == 1:
+		return float64(int8(value[0]))
+	case storageType == "int16" && len(value) == 2:
+		return float64(int16(binary.BigEndian.Uint16(value)))
+	case storageType == "int32" && len(value) == 4:
+		return float64(int32(binary.BigEndian.Uint32(value)))
+	}
+
+	switch len(value) {
+	case 4:
+		return float64(binary.BigEndian.Uint32(value))
+	case 2:
+		return float64(binary.BigEndian.Uint16(value))
+	case 1:
+		return float64(value[0])
+	default:
+		return 0
+	}
+}
+
+// decimalFormat is the subset of Java's DecimalFormat patterns ("0", "0.00",
+// "0.0#", "#.##") used by RomRaider definitions.
+type decimalFormat struct {
+	valid            bool
+	minIntegerDigits int
+	minDecimals      int
+	maxDecimals      int
+}
+
+func parseDecimalFormat(format string) decimalFormat {
+	pattern := strings.TrimSpace(strings.SplitN(format, ";", 2)[0])
+	if pattern == "" || strings.ContainsAny(pattern, "E%") {
+		return decimalFormat{}
+	}
+	retval := decimalFormat{valid: true}
+	integer, fraction := pattern, ""
+	if dot := strings.Index(pattern, "."); dot >= 0 {
+		integer, fraction = pattern[:dot], pattern[dot+1:]
+	}
+	retval.minIntegerDigits = strings.Count(integer, "0")
+	for _, r := range fraction {
+		if r == '0' {
+			retval.minDecimals++
+			retval.maxDecimals++
+		} else if r == '#' {
+			retval.maxDecimals++
+		} else {
+			break
+		}
+	}
+	return retval
+}
+
+func (f decimalFormat) Format(value float64) string {
+	if !f.valid {
+		return fmt.Sprintf("%f", value)
+	}
+	formatted := f.trim(strconv.FormatFloat(f.Round(value), 'f', f.maxDecimals, 64))
+	if strings.Trim(formatted, "-0.") == "" {
+		// Avoid printing "-0" for small negative values
+		formatted = strings.TrimPrefix(formatted, "-")
+	}
+	return formatted
+}
+
+// JavaFormat formats a value exactly as Java's DecimalFormat does, for
+// outputs that have to match RomRaider's: it rounds half to even on the
+// exact binary value rather than half away from zero, and leaves out a zero
+// integer part when the pattern has no 0 before the dot, so "#.##" formats
+// 0.5 as ".5". Like Java, it keeps the sign of a negative value that rounds
+// to zero, so "0.0" formats -0.01 as "-0.0".
+func (f decimalFormat) JavaFormat(value float64) string {
+	if !f.valid {
+		return fmt.Sprintf("%f", value)
+	}
+	// FormatFloat rounds the exact value half to even
+	formatted := f.trim(strconv.FormatFloat(value, 'f', f.maxDecimals, 64))
+	if f.minIntegerDigits == 0 {
+		if strings.HasPrefix(formatted, "0.") {
+			formatted = formatted[1:]
+		} else if strings.HasPrefix(formatted, "-0.") {
+			formatted = "-" + formatted[2:]
+		}
+	}
+	return formatted
+}
+
+// trim drops the optional decimals that are zero.
+func (f decimalFormat) trim(formatted string) string {
+	if f.maxDecimals > f.minDecimals {
+		trim := f.maxDecimals - f.minDecimals
+		for trim > 0 && strings.HasSuffix(formatted, "0") {
+			formatted = formatted[:len(formatted)-1]
+			trim--
+		}
+		formatted = strings.TrimSuffix(formatted, ".")
+	}
+	return formatted
+}
+
+func (f decimalFormat) Decimals() int {
+	if !f.valid {
+		return -1
+	}
+	return f.maxDecimals
+}
+
+func (f decimalFormat) Round(value float64) float64 {
+	if !f.valid {
+		return value
+	}
+	scale := math.Pow10(f.maxDecimals)
+	rounded := math.Round(value*scale) / scale
+	if rounded == 0 {
+		// -0 would be written as such by numeric outputs
+		rounded = 0
+	}
+	return rounded
+}
@@ -0,0 +1,83 @@
+package ssm2lib_test
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/nanoadmin/go-ssm2logger/ssm2lib"
+)
+
+// benchmarkExprs are representative RomRaider conversions.
+var benchmarkExprs = []string{
+	"x/4",
+	"x-40",
+	"(x-128)/2",
+	"x*100/255",
+	"(x*37.0)/255",
+	"x*0.08",
+	"x*25/64",
+	"(x-128)*0.0078125",
+	"x",
+}
+
+// benchmarkRequest builds a 45 address request: 5 two-byte parameters and
+// 35 single-byte ones.
+func benchmarkRequest(b *testing.B) ([]ParameterMapping, []byte) {
+	params := []Ssm2Parameter{}
+	for i := 0; i < 40; i++ {
+		length := 1
+		if i < 5 {
+			length = 2
+		}
+		params = append(params, Ssm2Parameter{
+			Id:   fmt.Sprintf("P%d", i),
+			Name: fmt.Sprintf("Param %d", i),
+			Address: Ssm2ParameterAddress{
+				Address: fmt.Sprintf("0x%06x", 0x100+i*4),
+				Length:  length,
+			},
+			Conversions: []Ssm2ParameterConversion{{Units: "u", Expr: benchmarkExprs[i%len(benchmarkExprs)]}},
+		})
+	}
+
+	addresses, mappings, err := BuildParameterAddressRequest(params)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if len(addresses) != 45 {
+		b.Fatalf("expected 45 addresses, got %d", len(addresses))
+	}
+
+	payload := make([]byte, len(addresses))
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	return mappings, payload
+}
+
+func BenchmarkDecodeSamplePrecompiled(b *testing.B) {
+	mappings, payload := benchmarkRequest(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, mapping := range mappings {
+			if _, err := mapping.Convert(payload); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkDecodeSampleParseEachTime(b *testing.B) {
+	mappings, payload := benchmarkRequest(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, mapping := range mappings {
+			value := payload[mapping.Start : mapping.Start+mapping.Length]
+			if _, err := mapping.Param.Convert(mapping.Units, value); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package ssm2lib
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// definitionCacheVersion is bumped whenever CachedDefinitions,
+// CachedDefinitionFiles or Ssm2Parameter change shape, so stale cache files
+// are ignored.
+const definitionCacheVersion = 2
+
+// CachedDefinitions is what a definition cache entry holds for one ROM: the
+// parameters the ECU supports, ready for selection, and the rest reduced to
+// their ID and name so unsupported parameters can still be reported.
+type CachedDefinitions struct {
+	Version     int
+	Supported   []Ssm2Parameter
+	Unsupported []Ssm2Parameter
+}
+
+// All returns the supported and unsupported parameters together.
+func (d *CachedDefinitions) All() []Ssm2Parameter {
+	return append(append([]Ssm2Parameter{}, d.Supported...), d.Unsupported...)
+}
+
+// CachedDefinitionFiles is what a definition cache entry holds about the
+// definition files themselves, so that a hit doesn't need to read them.
+type CachedDefinitionFiles struct {
+	Version int
+	// Hash is the DefinitionsHash of the files.
+	Hash string
+	// DefinitionsVersion is the version attribute of the definitions.
+	DefinitionsVersion string
+	// Protocol is the protocol element the entry was saved for, without its
+	// parameters and DTCs.
+	Protocol Ssm2Protocol
+}
+
+// NewCachedDefinitions builds a cache entry from the full parameter list and
+// the supported subset. Every supported conversion is compiled first so that
+// only definitions known to compile are cached. The entry holds the
+// parameters rather than compiled conversions, which can't be serialized;
+// only the selected parameters get compiled when logging starts.
+func NewCachedDefinitions(all []Ssm2Parameter, supported []Ssm2Parameter) (*CachedDefinitions, error) {
+	defs := &CachedDefinitions{Version: definitionCacheVersion, Supported: supported}
+	ids := map[string]bool{}
+	for _, param := range supported {
+		ids[param.Id] = true
+		for _, conversion := range param.Conversions {
+			if _, err := CompileConversion(conversion); err != nil {
+				return nil, fmt.Errorf("%s: %s", param.Name, err)
+			}
+		}
+	}
+	for _, param := range all {
+		if !ids[param.Id] {
+			defs.Unsupported = append(defs.Unsupported, Ssm2Parameter{Id: param.Id, Name: param.Name})
+		}
+	}
+	return defs, nil
+}
+
+// DefinitionCache stores resolved parameter sets in Dir as gob files keyed
+// by the DefinitionsKey of the definition files and the ROM ID, next to what
+// it knows about the files themselves.
+type DefinitionCache struct {
+	Dir string
+}
+
+// DefinitionsKey identifies the definitions XML and any overlays, in order,
+// by their path, size and modification time, so the cache can be looked up
+// without reading them. Like make, it misses an edit that keeps both the
+// size and the modification time.
+func DefinitionsKey(paths ...string) (string, error) {
+	hash := sha256.New()
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return "", err
+		}
+		info, err := os.Stat(abs)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "%s\x00%d\x00%d\x00", abs, info.Size(), info.ModTime().UnixNano())
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// DefinitionsHash hashes the contents of the definitions XML and any
+// overlays, in order, into a cache key.
+func DefinitionsHash(paths ...string) (string, error) {
+	hash := sha256.New()
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(hash, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+		// Separate files so moving bytes between them changes the hash
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (c DefinitionCache) path(defsKey string, romId []byte) string {
+	return filepath.Join(c.Dir, fmt.Sprintf("%s-%s.gob", defsKey[:16], hex.EncodeToString(romId)))
+}
+
+func (c DefinitionCache) filesPath(defsKey string, protocolId string) string {
+	return filepath.Join(c.Dir, fmt.Sprintf("%s-%s.files.gob", defsKey[:16], strings.ToLower(protocolId)))
+}
+
+// Load returns the cached definitions for defsKey and romId, or nil if
+// there is no usable entry.
+func (c DefinitionCache) Load(defsKey string, romId []byte) (*CachedDefinitions, error) {
+	defs := &CachedDefinitions{}
+	found, err := c.load(c.path(defsKey, romId), defs)
+	if !found || defs.Version != definitionCacheVersion {
+		return nil, err
+	}
+	return defs, nil
+}
+
+// Save writes a cache entry for defsKey and romId.
+func (c DefinitionCache) Save(defsKey string, romId []byte, defs *CachedDefinitions) error {
+	return c.save(c.path(defsKey, romId), defs)
+}
+
+// LoadFiles returns what's cached about the definition files for defsKey
+// and protocolId, or nil if there is no usable entry.
+func (c DefinitionCache) LoadFiles(defsKey string, protocolId string) (*CachedDefinitionFiles, error) {
+	files := &CachedDefinitionFiles{}
+	found, err := c.load(c.filesPath(defsKey, protocolId), files)
+	if !found || files.Version != definitionCacheVersion {
+		return nil, err
+	}
+	return files, nil
+}
+
+// SaveFiles writes what's known about the definition files for defsKey and
+// protocolId.
+func (c DefinitionCache) SaveFiles(defsKey string, protocolId string, files *CachedDefinitionFiles) error {
+	files.Version = definitionCacheVersion
+	return c.save(c.filesPath(defsKey, protocolId), files)
+}
+
+// load decodes the cache file at path into value, reporting whether there
+// was one.
+func (c DefinitionCache) load(path string, value interface{}) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	if err := gob.NewDecoder(f).Decode(value); err != nil {
+		return false, fmt.Errorf("Unable to read definition cache %s: %s", f.Name(), err)
+	}
+	return true, nil
+}
+
+// save writes value to path. The file is written to a temporary name and
+// renamed into place so a concurrent or interrupted run never sees half of it.
+func (c DefinitionCache) save(path string, value interface{}) error {
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(c.Dir, ".defs-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := gob.NewEncoder(tmp).Encode(value); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,310 @@
+package ssm2lib
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tarm/serial"
+)
+
+// DefaultObdSerialSettings suit most ELM327 adapters. The baud rate in the
+// OBD protocol definition is the vehicle bus speed, not the adapter's serial
+// link, so it isn't used.
+var DefaultObdSerialSettings = SerialSettings{
+	Baud:           38400,
+	DataBits:       8,
+	StopBits:       1,
+	Parity:         0,
+	ConnectTimeout: 10 * time.Second,
+	SendTimeout:    1 * time.Second,
+}
+
+// elmInitCommands reset the adapter, turn off echo, linefeeds, spaces and
+// headers, and let it detect the vehicle's OBD protocol.
+var elmInitCommands = []string{"ATZ", "ATE0", "ATL0", "ATS0", "ATH0", "ATSP0"}
+
+// elmErrors are adapter responses meaning the request got no usable answer.
+var elmErrors = []string{"NO DATA", "?", "UNABLE TO CONNECT", "CAN ERROR", "BUS ERROR", "BUS BUSY", "STOPPED", "ERROR"}
+
+// ObdAdapterError is an error reported by the adapter for a single request,
+// like NO DATA, as opposed to the adapter not answering at all.
+type ObdAdapterError struct {
+	Request  string
+	Response string
+}
+
+func (e *ObdAdapterError) Error() string {
+	return fmt.Sprintf("adapter answered %s to %s", e.Response, e.Request)
+}
+
+// ObdSession logs generic OBD-II mode 01 PIDs through an ELM327 compatible
+// adapter. OBD has no continuous mode, so every sample polls each selected
+// PID in turn.
+type ObdSession struct {
+	port     io.ReadWriteCloser
+	settings SerialSettings
+	logger   *log.Logger
+	pids     []byte
+	lengths  []int
+}
+
+// NewObdSession returns a session talking to an already open adapter.
+func NewObdSession(port io.ReadWriteCloser, settings SerialSettings, logger *log.Logger) *ObdSession {
+	return &ObdSession{port: port, settings: settings, logger: logger}
+}
+
+func (s *ObdSession) SerialSettings(protocol Ssm2Protocol) SerialSettings {
+	settings := DefaultObdSerialSettings
+	if protocol.ConnectTimeout > 0 {
+		settings.ConnectTimeout = time.Duration(protocol.ConnectTimeout) * time.Millisecond
+	}
+	if protocol.SendTimeout > 0 {
+		settings.SendTimeout = time.Duration(protocol.SendTimeout) * time.Millisecond
+	}
+	return settings
+}
+
+func (s *ObdSession) Open(port string, settings SerialSettings) error {
+	if err := settings.Validate(); err != nil {
+		return fmt.Errorf("Invalid serial settings: %s", err)
+	}
+	serialPort, err := serial.OpenPort(settings.serialConfig(port))
+	if err != nil {
+		return fmt.Errorf("Error opening serial port: %s", err)
+	}
+	s.port = serialPort
+	s.settings = settings
+	return nil
+}
+
+func (s *ObdSession) Close() {
+	s.port.Close()
+}
+
+func (s *ObdSession) Init() (*EcuInfo, error) {
+	for _, command := range elmInitCommands {
+		if _, err := s.command(command, s.settings.ConnectTimeout); err != nil {
+			return nil, fmt.Errorf("Unable to initialise the OBD adapter: %s", err)
+		}
+	}
+
+	// Mode 01 PID 00 reports support for PIDs 01-20, PID 20 for 21-40 and so
+	// on, each with the last bit saying whether the next range exists. The
+	// first request also waits for the adapter's protocol search.
+	info := &EcuInfo{Protocol: ProtocolObd}
+	for base := 0; base < 0x100; base += 0x20 {
+		data, err := s.query(0x01, byte(base), s.settings.ConnectTimeout)
+		if err != nil {
+			if base == 0 {
+				return nil, fmt.Errorf("Vehicle didn't answer the supported PIDs request: %s", err)
+			}
+			break
+		}
+		if len(data) < 4 {
+			return nil, fmt.Errorf("Supported PIDs response for 0x%02x is %d bytes, expected 4", base, len(data))
+		}
+		info.Capabilities = append(info.Capabilities, data[:4]...)
+		if data[3]&1 == 0 {
+			break
+		}
+	}
+
+	if vin, err := s.readVin(); err == nil {
+		info.RomId = vin
+	} else if s.logger != nil {
+		s.logger.WithFields(log.Fields{"error": err}).Debug("Vehicle didn't report a VIN")
+	}
+	return info, nil
+}
+
+// readVin reads mode 09 PID 02. CAN vehicles answer with numbered frames
+// ("0:490201...", "1:..."), older ones with a "4902nn" header on every line.
+func (s *ObdSession) readVin() ([]byte, error) {
+	lines, err := s.command("0902", s.settings.SendTimeout)
+	if err != nil {
+		return nil, err
+	}
+	vin := []byte{}
+	for _, line := range lines {
+		if idx := strings.Index(line, ":"); idx >= 0 {
+			line = line[idx+1:]
+		} else if len(line) < 6 {
+			// CAN byte count line
+			continue
+		}
+		data, err := hex.DecodeString(line)
+		if err != nil {
+			continue
+		}
+		if len(data) >= 3 && data[0] == 0x49 && data[1] == 0x02 {
+			data = data[3:]
+		}
+		vin = append(vin, bytes.Trim(data, "\x00")...)
+	}
+	if len(vin) < 17 {
+		return nil, fmt.Errorf("VIN response too short: %q", vin)
+	}
+	return vin[len(vin)-17:], nil
+}
+
+// obdPid returns the mode 01 PID of a parameter. OBD definitions give it as
+// the address, either as the PID alone or with the mode in front.
+func obdPid(param Ssm2Parameter) (byte, bool) {
+	address, err := param.Address.GetAddressBytes()
+	if err != nil {
+		return 0, false
+	}
+	switch {
+	case len(address) == 1:
+		return address[0], true
+	case len(address) == 2 && address[0] == 0x01:
+		return address[1], true
+	}
+	return 0, false
+}
+
+func (s *ObdSession) SupportedParameters(all []Ssm2Parameter, info *EcuInfo) []Ssm2Parameter {
+	supported := []Ssm2Parameter{}
+	for _, param := range all {
+		pid, ok := obdPid(param)
+		if !ok || param.IsDerived() {
+			continue
+		}
+		if pid == 0 {
+			supported = append(supported, param)
+			continue
+		}
+		idx := int(pid-1) / 8
+		if idx < len(info.Capabilities) && info.Capabilities[idx]&(0x80>>uint((pid-1)%8)) > 0 {
+			supported = append(supported, param)
+		}
+	}
+	return supported
+}
+
+func (s *ObdSession) StartLogging(selections []ParameterSelection) ([]ParameterMapping, error) {
+	s.pids = nil
+	s.lengths = nil
+	mappings := []ParameterMapping{}
+	offset := 0
+	for _, selection := range selections {
+		pid, ok := obdPid(selection.Param)
+		if !ok {
+			return nil, fmt.Errorf("%s: address %s is not an OBD mode 01 PID", selection.Param.Name, selection.Param.Address.Address)
+		}
+		selectionMappings, err := mapSelection(selection, offset)
+		if err != nil {
+			return nil, err
+		}
+		mappings = append(mappings, selectionMappings...)
+		length := ParameterLength(selection.Param)
+		s.pids = append(s.pids, pid)
+		s.lengths = append(s.lengths, length)
+		offset += length
+	}
+	return mappings, nil
+}
+
+// NextPayload polls every selected PID. A PID the vehicle doesn't answer
+// leaves the payload short, so the sample is skipped rather than logging a
+// made up value; only the adapter going quiet is an error.
+func (s *ObdSession) NextPayload() ([]byte, error) {
+	payload := []byte{}
+	for idx, pid := range s.pids {
+		data, err := s.query(0x01, pid, s.settings.SendTimeout)
+		if err != nil {
+			if _, ok := err.(*ObdAdapterError); ok {
+				if s.logger != nil {
+					s.logger.WithFields(log.Fields{"pid": fmt.Sprintf("0x%02x", pid), "error": err}).Debug("PID request failed")
+				}
+				return payload, nil
+			}
+			return nil, err
+		}
+		if len(data) < s.lengths[idx] {
+			return payload, nil
+		}
+		payload = append(payload, data[:s.lengths[idx]]...)
+	}
+	return payload, nil
+}
+
+// query sends a request and returns the data bytes of the first matching
+// response line.
+func (s *ObdSession) query(mode byte, pid byte, timeout time.Duration) ([]byte, error) {
+	request := fmt.Sprintf("%02X%02X", mode, pid)
+	lines, err := s.command(request, timeout)
+	if err != nil {
+		return nil, err
+	}
+	prefix := fmt.Sprintf("%02X%02X", mode+0x40, pid)
+	for _, line := range lines {
+		if strings.HasPrefix(line, prefix) {
+			data, err := hex.DecodeString(line[len(prefix):])
+			if err != nil {
+				return nil, fmt.Errorf("Unable to decode response %q to %s: %s", line, request, err)
+			}
+			return data, nil
+		}
+	}
+	return nil, &ObdAdapterError{Request: request, Response: strings.Join(lines, " ")}
+}
+
+// command sends one line to the adapter and returns the response lines, with
+// spaces, the echo and progress messages removed.
+func (s *ObdSession) command(command string, timeout time.Duration) ([]string, error) {
+	if s.logger != nil {
+		s.logger.WithFields(log.Fields{"command": command}).Debug("Sending OBD adapter command")
+	}
+	if _, err := s.port.Write([]byte(command + "\r")); err != nil {
+		return nil, fmt.Errorf("Failed to send serial: %s", err)
+	}
+	response, err := s.readUntilPrompt(timeout)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", command, err)
+	}
+
+	lines := []string{}
+	for _, line := range strings.FieldsFunc(response, func(r rune) bool { return r == '\r' || r == '\n' }) {
+		line = strings.ToUpper(strings.Replace(strings.TrimSpace(line), " ", "", -1))
+		if line == "" || line == command || strings.HasPrefix(line, "SEARCHING") || strings.HasPrefix(line, "BUSINIT") {
+			continue
+		}
+		for _, elmError := range elmErrors {
+			if line == strings.Replace(elmError, " ", "", -1) {
+				return nil, &ObdAdapterError{Request: command, Response: elmError}
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// readUntilPrompt reads until the adapter's ">" prompt, which it prints when
+// it's ready for the next command.
+func (s *ObdSession) readUntilPrompt(timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	response := []byte{}
+	buf := make([]byte, 64)
+	for {
+		n, err := s.port.Read(buf)
+		response = append(response, buf[:n]...)
+		if idx := bytes.IndexByte(response, '>'); idx >= 0 {
+			return string(response[:idx]), nil
+		}
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("no prompt from the adapter within %s, got %q", timeout, response)
+		}
+		if n == 0 {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
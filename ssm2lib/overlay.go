@@ -0,0 +1,174 @@
+package ssm2lib
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// OverlayParameter is a user-defined parameter merged on top of the
+// RomRaider definitions. The capability bit is optional: without one the
+// parameter is ungated and always requested.
+type OverlayParameter struct {
+	Id           string `xml:"id,attr" yaml:"id"`
+	Name         string `xml:"name,attr" yaml:"name"`
+	Description  string `xml:"desc,attr" yaml:"desc"`
+	EcuByteIndex *uint  `xml:"ecubyteindex,attr" yaml:"ecubyteindex"`
+	EcuBit       *uint  `xml:"ecubit,attr" yaml:"ecubit"`
+	Target       uint   `xml:"target,attr" yaml:"target"`
+	Address      string `xml:"-" yaml:"address"`
+	Length       int    `xml:"-" yaml:"length"`
+	// XmlAddress is the RomRaider style <address length="2">0x...</address>
+	// element, copied into Address and Length when loading XML overlays.
+	XmlAddress  Ssm2ParameterAddress      `xml:"address" yaml:"-"`
+	Conversions []Ssm2ParameterConversion `xml:"conversions>conversion" yaml:"conversions"`
+	// Override replaces an official parameter with the same name or ID
+	// instead of reporting a conflict.
+	Override bool `xml:"override,attr" yaml:"override"`
+	// Source is the overlay file the parameter was loaded from.
+	Source string `xml:"-" yaml:"-"`
+}
+
+type overlayFile struct {
+	Parameters []OverlayParameter `xml:"parameter" yaml:"parameters"`
+}
+
+// LoadOverlay reads an overlay file. Files ending in .yaml or .yml are read
+// as YAML, everything else as XML with a <parameters> root holding
+// RomRaider style <parameter> elements.
+func LoadOverlay(path string) ([]OverlayParameter, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	overlay := overlayFile{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, &overlay)
+	default:
+		err = xml.Unmarshal(data, &overlay)
+		for idx := range overlay.Parameters {
+			overlay.Parameters[idx].Address = strings.TrimSpace(overlay.Parameters[idx].XmlAddress.Address)
+			overlay.Parameters[idx].Length = overlay.Parameters[idx].XmlAddress.Length
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse overlay %s: %s", path, err)
+	}
+
+	for idx := range overlay.Parameters {
+		overlay.Parameters[idx].Source = path
+		if err := overlay.Parameters[idx].validate(); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	return overlay.Parameters, nil
+}
+
+func (o OverlayParameter) validate() error {
+	if o.Id == "" || o.Name == "" {
+		return fmt.Errorf("overlay parameter %q needs both an id and a name", o.Name+o.Id)
+	}
+	if (o.EcuByteIndex == nil) != (o.EcuBit == nil) {
+		return fmt.Errorf("overlay parameter %s must set both ecubyteindex and ecubit, or neither", o.Name)
+	}
+	if o.EcuBit != nil && *o.EcuBit > 7 {
+		return fmt.Errorf("overlay parameter %s has ecubit %d, expected 0-7", o.Name, *o.EcuBit)
+	}
+	if len(o.Conversions) == 0 {
+		return fmt.Errorf("overlay parameter %s has no conversions", o.Name)
+	}
+	param := o.ToParameter()
+	address, err := param.Address.GetAddressBytes()
+	if err != nil {
+		return err
+	}
+	if len(address) != 3 {
+		return fmt.Errorf("overlay parameter %s address %s must be 3 bytes", o.Name, o.Address)
+	}
+	for _, conversion := range o.Conversions {
+		if _, err := CompileConversion(conversion); err != nil {
+			return fmt.Errorf("overlay parameter %s: %s", o.Name, err)
+		}
+	}
+	return nil
+}
+
+func (o OverlayParameter) ToParameter() Ssm2Parameter {
+	param := Ssm2Parameter{
+		Id:          o.Id,
+		Name:        o.Name,
+		Description: o.Description,
+		Target:      o.Target,
+		Address:     Ssm2ParameterAddress{Address: o.Address, Length: o.Length},
+		Conversions: o.Conversions,
+		Ungated:     o.EcuByteIndex == nil,
+	}
+	if !param.Ungated {
+		param.EcuByteIndex = *o.EcuByteIndex
+		param.EcuBit = *o.EcuBit
+	}
+	return param
+}
+
+// MergeOverlay appends the overlay parameters to the official ones. An
+// overlay parameter whose name (case-insensitive) or ID matches an official
+// parameter, or another overlay parameter, is a conflict unless it is marked
+// as an override, in which case it replaces the official parameter. Every
+// conflict is reported in the returned error.
+func MergeOverlay(official []Ssm2Parameter, overlay []OverlayParameter) ([]Ssm2Parameter, error) {
+	merged := append([]Ssm2Parameter{}, official...)
+	byName := map[string]int{}
+	byId := map[string]int{}
+	for idx, param := range merged {
+		byName[strings.ToLower(param.Name)] = idx
+		byId[param.Id] = idx
+	}
+
+	conflicts := []string{}
+	overlaid := map[int]string{}
+	for _, o := range overlay {
+		nameIdx, nameTaken := byName[strings.ToLower(o.Name)]
+		idIdx, idTaken := byId[o.Id]
+		if !nameTaken && !idTaken {
+			merged = append(merged, o.ToParameter())
+			byName[strings.ToLower(o.Name)] = len(merged) - 1
+			byId[o.Id] = len(merged) - 1
+			overlaid[len(merged)-1] = o.Source
+			continue
+		}
+
+		target := nameIdx
+		if !nameTaken {
+			target = idIdx
+		}
+		if source, ok := overlaid[target]; ok {
+			conflicts = append(conflicts, fmt.Sprintf("%s (%s) in %s is also defined in %s", o.Name, o.Id, o.Source, source))
+			continue
+		}
+		if nameTaken && idTaken && nameIdx != idIdx {
+			conflicts = append(conflicts, fmt.Sprintf("%s (%s) in %s matches the name of %s and the ID of %s", o.Name, o.Id, o.Source, merged[nameIdx].Id, merged[idIdx].Name))
+			continue
+		}
+		if !o.Override {
+			conflicts = append(conflicts, fmt.Sprintf("%s (%s) in %s collides with definition %s (%s); set override to replace it", o.Name, o.Id, o.Source, merged[target].Name, merged[target].Id))
+			continue
+		}
+		delete(byName, strings.ToLower(merged[target].Name))
+		delete(byId, merged[target].Id)
+		merged[target] = o.ToParameter()
+		byName[strings.ToLower(o.Name)] = target
+		byId[o.Id] = target
+		overlaid[target] = o.Source
+	}
+
+	if len(conflicts) > 0 {
+		return nil, fmt.Errorf("overlay conflicts with definitions:\n  %s", strings.Join(conflicts, "\n  "))
+	}
+	return merged, nil
+}
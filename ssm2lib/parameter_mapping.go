@@ -3,11 +3,25 @@ package ssm2lib
 import "fmt"
 
 type ParameterMapping struct {
-	Param  Ssm2Parameter
-	Name   string
-	Units  string
-	Start  int
-	Length int
+	Param      Ssm2Parameter
+	Name       string
+	Units      string
+	Start      int
+	Length     int
+	Conversion *CompiledConversion
+}
+
+// Convert slices this parameter's bytes out of a continuous-mode payload and
+// runs them through the precompiled conversion.
+func (m ParameterMapping) Convert(payload []byte) (float64, error) {
+	if m.Conversion == nil {
+		return 0, fmt.Errorf("Unable to find a converstion with unit (%s)", m.Units)
+	}
+	end := m.Start + m.Length
+	if end > len(payload) {
+		return 0, fmt.Errorf("payload too short for %s: need %d bytes, got %d", m.Name, end, len(payload))
+	}
+	return m.Conversion.Evaluate(payload[m.Start:end])
 }
 
 func ParameterLength(param Ssm2Parameter) int {
@@ -34,12 +48,35 @@ func ExpandAddress(base []byte, offset int) ([]byte, error) {
 	return []byte{byte(value >> 16), byte((value >> 8) & 0xFF), byte(value & 0xFF)}, nil
 }
 
+// ParameterSelection is a parameter to request along with the units its
+// value should be converted to. Each unit becomes its own ParameterMapping
+// decoded from the same raw bytes, so the address is only requested once.
+type ParameterSelection struct {
+	Param Ssm2Parameter
+	Units []string
+}
+
+// BuildParameterAddressRequest requests params using the first conversion
+// listed for each of them.
 func BuildParameterAddressRequest(params []Ssm2Parameter) ([][]byte, []ParameterMapping, error) {
+	selections := []ParameterSelection{}
+	for _, param := range params {
+		selections = append(selections, ParameterSelection{Param: param, Units: []string{DefaultUnits(param)}})
+	}
+	return BuildSelectionAddressRequest(selections)
+}
+
+// BuildSelectionAddressRequest expands every selected parameter into the
+// addresses to request and compiles the conversion for its unit, so a bad
+// expression in the definitions is reported here instead of in the middle of
+// a logging session.
+func BuildSelectionAddressRequest(selections []ParameterSelection) ([][]byte, []ParameterMapping, error) {
 	addresses := [][]byte{}
 	mappings := []ParameterMapping{}
 	offset := 0
 
-	for _, param := range params {
+	for _, selection := range selections {
+		param := selection.Param
 		base, err := param.Address.GetAddressBytes()
 		if err != nil {
 			return nil, nil, err
@@ -53,19 +90,57 @@ func BuildParameterAddressRequest(params []Ssm2Parameter) ([][]byte, []Parameter
 			addresses = append(addresses, addr)
 		}
 
-		unit := ""
+		selectionMappings, err := mapSelection(selection, offset)
+		if err != nil {
+			return nil, nil, err
+		}
+		mappings = append(mappings, selectionMappings...)
+		offset += length
+	}
+
+	return addresses, mappings, nil
+}
+
+// mapSelection builds one mapping per selected unit for a parameter whose
+// bytes start at offset in the payload.
+func mapSelection(selection ParameterSelection, offset int) ([]ParameterMapping, error) {
+	param := selection.Param
+	units := selection.Units
+	if len(units) == 0 {
+		units = []string{DefaultUnits(param)}
+	}
+	mappings := []ParameterMapping{}
+	for _, unit := range units {
+		var compiled *CompiledConversion
 		if len(param.Conversions) > 0 {
-			unit = param.Conversions[0].Units
+			conversion, err := param.GetConversion(unit)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", param.Name, err)
+			}
+			compiled, err = CompileConversion(conversion)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", param.Name, err)
+			}
 		}
 		mappings = append(mappings, ParameterMapping{
-			Param:  param,
-			Name:   param.Name,
-			Units:  unit,
-			Start:  offset,
-			Length: length,
+			Param:      param,
+			Name:       param.Name,
+			Units:      unit,
+			Start:      offset,
+			Length:     ParameterLength(param),
+			Conversion: compiled,
 		})
-		offset += length
 	}
+	return mappings, nil
+}
 
-	return addresses, mappings, nil
+// PayloadLength is the number of payload bytes the mappings cover.
+func PayloadLength(mappings []ParameterMapping) int {
+	length := 0
+	for _, mapping := range mappings {
+		if end := mapping.Start + mapping.Length; end > length {
+			length = end
+		}
+	}
+	return length
 }
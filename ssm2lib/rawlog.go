@@ -0,0 +1,221 @@
+package ssm2lib
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// rawLogMagic starts every raw log; its last byte is the format version.
+// Version 1 logs had no frame flags and are still read.
+const rawLogMagic = "SSM2RAW\x02"
+
+const rawLogVersionNoFlags = 1
+
+// rawFrameCorrupt flags a frame whose checksum didn't match.
+const rawFrameCorrupt = 1 << 0
+
+// rawLogMaxPayload bounds a frame's length so a corrupt length can't ask
+// for gigabytes.
+const rawLogMaxPayload = 1 << 16
+
+// RawLogHeader describes the session a raw log was recorded in, with enough
+// to decode its payloads again later against any definitions.
+type RawLogHeader struct {
+	Started            time.Time       `json:"started"`
+	Info               EcuInfo         `json:"info"`
+	DefinitionsVersion string          `json:"definitions_version"`
+	DefinitionsHash    string          `json:"definitions_hash"`
+	Mappings           []RawLogMapping `json:"mappings"`
+}
+
+// RawLogMapping is where a parameter's bytes sit in the payloads and which
+// of its units was logged.
+type RawLogMapping struct {
+	Id     string `json:"id"`
+	Name   string `json:"name"`
+	Units  string `json:"units"`
+	Start  int    `json:"start"`
+	Length int    `json:"length"`
+}
+
+func NewRawLogMappings(mappings []ParameterMapping) []RawLogMapping {
+	retval := []RawLogMapping{}
+	for _, mapping := range mappings {
+		retval = append(retval, RawLogMapping{Id: mapping.Param.Id, Name: mapping.Name, Units: mapping.Units, Start: mapping.Start, Length: mapping.Length})
+	}
+	return retval
+}
+
+// Remap rebuilds the mappings from the parameters in all, matched by ID, and
+// compiles each one's conversion for the logged units. A parameter that's
+// missing or whose length changed is an error, since the logged bytes can't
+// be converted with it.
+func (h RawLogHeader) Remap(all []Ssm2Parameter) ([]ParameterMapping, error) {
+	byId := map[string]Ssm2Parameter{}
+	for _, param := range all {
+		byId[param.Id] = param
+	}
+	mappings := []ParameterMapping{}
+	for _, logged := range h.Mappings {
+		param, ok := byId[logged.Id]
+		if !ok {
+			return nil, fmt.Errorf("%s (%s) is not in the definitions", logged.Name, logged.Id)
+		}
+		if ParameterLength(param) != logged.Length {
+			return nil, fmt.Errorf("%s (%s) was logged as %d bytes but the definitions have %d", logged.Name, logged.Id, logged.Length, ParameterLength(param))
+		}
+		selectionMappings, err := mapSelection(ParameterSelection{Param: param, Units: []string{logged.Units}}, logged.Start)
+		if err != nil {
+			return nil, err
+		}
+		mappings = append(mappings, selectionMappings...)
+	}
+	return mappings, nil
+}
+
+// RawFrame is a payload as it was read from the ECU. Corrupt frames failed
+// their checksum and are kept so the log holds everything that was received.
+type RawFrame struct {
+	Time    time.Time
+	Payload []byte
+	Corrupt bool
+}
+
+// RawLogWriter writes a raw log: rawLogMagic, the length prefixed JSON
+// header, then a frame per payload. A frame is the microseconds since the
+// previous frame (or the session start), a flags byte, the payload length
+// and the payload, the numbers as uvarints, so a frame costs little more
+// than its payload.
+type RawLogWriter struct {
+	out  *bufio.Writer
+	last time.Time
+}
+
+func NewRawLogWriter(out io.Writer, header RawLogHeader) (*RawLogWriter, error) {
+	headerJson, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	w := &RawLogWriter{out: bufio.NewWriter(out), last: header.Started}
+	if _, err := w.out.WriteString(rawLogMagic); err != nil {
+		return nil, err
+	}
+	if err := w.writeUvarint(uint64(len(headerJson))); err != nil {
+		return nil, err
+	}
+	if _, err := w.out.Write(headerJson); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *RawLogWriter) writeUvarint(value uint64) error {
+	buf := make([]byte, binary.MaxVarintLen64)
+	_, err := w.out.Write(buf[:binary.PutUvarint(buf, value)])
+	return err
+}
+
+func (w *RawLogWriter) WriteFrame(frame RawFrame) error {
+	if len(frame.Payload) > rawLogMaxPayload {
+		return fmt.Errorf("a %d byte payload is too long for a raw log", len(frame.Payload))
+	}
+	delta := frame.Time.Sub(w.last).Microseconds()
+	if delta < 0 {
+		delta = 0
+	}
+	// Step by whole microseconds so rounding doesn't add up over a session
+	w.last = w.last.Add(time.Duration(delta) * time.Microsecond)
+	if err := w.writeUvarint(uint64(delta)); err != nil {
+		return err
+	}
+	var flags byte
+	if frame.Corrupt {
+		flags |= rawFrameCorrupt
+	}
+	if err := w.out.WriteByte(flags); err != nil {
+		return err
+	}
+	if err := w.writeUvarint(uint64(len(frame.Payload))); err != nil {
+		return err
+	}
+	_, err := w.out.Write(frame.Payload)
+	return err
+}
+
+func (w *RawLogWriter) Flush() error {
+	return w.out.Flush()
+}
+
+// RawLogReader reads the frames of a raw log back.
+type RawLogReader struct {
+	Header  RawLogHeader
+	in      *bufio.Reader
+	version byte
+	last    time.Time
+}
+
+func NewRawLogReader(in io.Reader) (*RawLogReader, error) {
+	r := &RawLogReader{in: bufio.NewReader(in)}
+	magic := make([]byte, len(rawLogMagic))
+	if _, err := io.ReadFull(r.in, magic); err != nil || string(magic[:len(magic)-1]) != rawLogMagic[:len(rawLogMagic)-1] {
+		return nil, fmt.Errorf("not a raw log")
+	}
+	r.version = magic[len(magic)-1]
+	if r.version != rawLogVersionNoFlags && r.version != rawLogMagic[len(rawLogMagic)-1] {
+		return nil, fmt.Errorf("unsupported raw log version %d", r.version)
+	}
+	length, err := binary.ReadUvarint(r.in)
+	if err != nil {
+		return nil, fmt.Errorf("reading the raw log header: %s", err)
+	}
+	headerJson := make([]byte, length)
+	if _, err := io.ReadFull(r.in, headerJson); err != nil {
+		return nil, fmt.Errorf("reading the raw log header: %s", err)
+	}
+	if err := json.Unmarshal(headerJson, &r.Header); err != nil {
+		return nil, fmt.Errorf("reading the raw log header: %s", err)
+	}
+	r.last = r.Header.Started
+	return r, nil
+}
+
+// Next returns the next frame. It returns io.EOF after the last frame, and
+// io.ErrUnexpectedEOF when the log ends partway through a frame, as it does
+// when logging was cut off.
+func (r *RawLogReader) Next() (RawFrame, error) {
+	delta, err := binary.ReadUvarint(r.in)
+	if err != nil {
+		return RawFrame{}, err
+	}
+	var flags byte
+	if r.version != rawLogVersionNoFlags {
+		flags, err = r.in.ReadByte()
+	}
+	var length uint64
+	if err == nil {
+		length, err = binary.ReadUvarint(r.in)
+	}
+	if err == nil && length > rawLogMaxPayload {
+		err = fmt.Errorf("corrupt raw log: %d byte payload", length)
+	}
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return RawFrame{}, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r.in, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return RawFrame{}, err
+	}
+	r.last = r.last.Add(time.Duration(delta) * time.Microsecond)
+	return RawFrame{Time: r.last, Payload: payload, Corrupt: flags&rawFrameCorrupt != 0}, nil
+}
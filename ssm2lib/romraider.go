@@ -0,0 +1,60 @@
+package ssm2lib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RomRaiderColumn is one parameter column of a RomRaider log.
+type RomRaiderColumn struct {
+	Name  string
+	Units string
+}
+
+// Header is the column's header cell, "Name (units)". RomRaider adds the
+// brackets even when the units are empty.
+func (c RomRaiderColumn) Header() string {
+	return fmt.Sprintf("%s (%s)", c.Name, c.Units)
+}
+
+// RomRaiderLogWriter writes logs in the CSV layout of RomRaider's logger,
+// which tools like Datazap, MegaLogViewer and Virtual Dyno expect: a Time
+// column of milliseconds since the start of the log, one column per
+// parameter with values as formatted by its conversion, no quoting and CRLF
+// line endings.
+type RomRaiderLogWriter struct {
+	out     *bufio.Writer
+	started time.Time
+}
+
+func NewRomRaiderLogWriter(out io.Writer, started time.Time) *RomRaiderLogWriter {
+	return &RomRaiderLogWriter{out: bufio.NewWriter(out), started: started}
+}
+
+func (w *RomRaiderLogWriter) WriteHeader(columns []RomRaiderColumn) error {
+	cells := []string{"Time"}
+	for _, column := range columns {
+		cells = append(cells, column.Header())
+	}
+	return w.writeLine(cells)
+}
+
+// WriteRow writes one sample taken at t. Values are written as given, so an
+// empty string leaves the cell empty.
+func (w *RomRaiderLogWriter) WriteRow(t time.Time, values []string) error {
+	cells := []string{strconv.FormatInt(t.Sub(w.started).Milliseconds(), 10)}
+	return w.writeLine(append(cells, values...))
+}
+
+func (w *RomRaiderLogWriter) writeLine(cells []string) error {
+	_, err := w.out.WriteString(strings.Join(cells, ",") + "\r\n")
+	return err
+}
+
+func (w *RomRaiderLogWriter) Flush() error {
+	return w.out.Flush()
+}
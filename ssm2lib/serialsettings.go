@@ -0,0 +1,198 @@
+package ssm2lib
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+// SerialSettings are the serial line settings and timeouts used to talk to
+// the ECU. They normally come from the protocol element of the definitions.
+type SerialSettings struct {
+	Baud     int
+	DataBits int
+	StopBits int
+	// Parity uses the RomRaider (javax.comm) numbering: 0 none, 1 odd,
+	// 2 even, 3 mark, 4 space.
+	Parity int
+	// ConnectTimeout is how long InitEngine keeps retrying the init request.
+	ConnectTimeout time.Duration
+	// SendTimeout is how long a read waits for the ECU to start answering,
+	// and how long InitEngine waits between attempts.
+	SendTimeout time.Duration
+}
+
+// DefaultSerialSettings are the SSM2 settings used when the definitions
+// don't say otherwise: 4800 baud 8N1.
+var DefaultSerialSettings = SerialSettings{
+	Baud:           4800,
+	DataBits:       8,
+	StopBits:       1,
+	Parity:         0,
+	ConnectTimeout: 2 * time.Second,
+	SendTimeout:    1 * time.Second,
+}
+
+var parityNames = []string{"none", "odd", "even", "mark", "space"}
+
+// ParseParity accepts a parity name (none, odd, even, mark, space) or its
+// RomRaider number.
+func ParseParity(value string) (int, error) {
+	for idx, name := range parityNames {
+		if strings.EqualFold(value, name) {
+			return idx, nil
+		}
+	}
+	parity, err := strconv.Atoi(value)
+	if err != nil || parity < 0 || parity >= len(parityNames) {
+		return 0, fmt.Errorf("unknown parity %q; expected none, odd, even, mark or space", value)
+	}
+	return parity, nil
+}
+
+// SerialSettings returns the protocol's settings. Attributes missing from the
+// definitions (zero) keep their DefaultSerialSettings value; timeouts in the
+// XML are in milliseconds.
+func (p Ssm2Protocol) SerialSettings() SerialSettings {
+	settings := DefaultSerialSettings
+	if p.Baud > 0 {
+		settings.Baud = p.Baud
+	}
+	if p.DataBits > 0 {
+		settings.DataBits = p.DataBits
+	}
+	if p.StopBits > 0 {
+		settings.StopBits = p.StopBits
+	}
+	settings.Parity = p.Parity
+	if p.ConnectTimeout > 0 {
+		settings.ConnectTimeout = time.Duration(p.ConnectTimeout) * time.Millisecond
+	}
+	if p.SendTimeout > 0 {
+		settings.SendTimeout = time.Duration(p.SendTimeout) * time.Millisecond
+	}
+	return settings
+}
+
+func (s SerialSettings) Validate() error {
+	if s.Baud <= 0 {
+		return fmt.Errorf("baud rate %d must be positive", s.Baud)
+	}
+	if s.DataBits < 5 || s.DataBits > 8 {
+		return fmt.Errorf("data bits %d out of range 5-8", s.DataBits)
+	}
+	if s.StopBits != 1 && s.StopBits != 2 {
+		return fmt.Errorf("stop bits %d must be 1 or 2", s.StopBits)
+	}
+	if s.Parity < 0 || s.Parity >= len(parityNames) {
+		return fmt.Errorf("parity %d out of range 0-%d", s.Parity, len(parityNames)-1)
+	}
+	if s.ConnectTimeout <= 0 || s.SendTimeout <= 0 {
+		return fmt.Errorf("timeouts must be positive")
+	}
+	return nil
+}
+
+func (s SerialSettings) String() string {
+	return fmt.Sprintf("%d %d%s%d", s.Baud, s.DataBits, strings.ToUpper(parityNames[s.Parity][:1]), s.StopBits)
+}
+
+func (s SerialSettings) serialConfig(port string) *serial.Config {
+	stopBits := serial.Stop1
+	if s.StopBits == 2 {
+		stopBits = serial.Stop2
+	}
+	parity := []serial.Parity{serial.ParityNone, serial.ParityOdd, serial.ParityEven, serial.ParityMark, serial.ParitySpace}[s.Parity]
+	return &serial.Config{
+		Name:        port,
+		Baud:        s.Baud,
+		Size:        byte(s.DataBits),
+		StopBits:    stopBits,
+		Parity:      parity,
+		ReadTimeout: s.ReadTimeout(),
+	}
+}
+
+// minReadTimeout is the serial read timeout used before the send timeout
+// came from the definitions. RomRaider's send_timeout is only tens of
+// milliseconds, short enough that one stall on the line would end a session.
+const minReadTimeout = 1 * time.Second
+
+// ReadTimeout is how long a serial read waits for bytes: the send timeout,
+// but no less than minReadTimeout.
+func (s SerialSettings) ReadTimeout() time.Duration {
+	if s.SendTimeout < minReadTimeout {
+		return minReadTimeout
+	}
+	return s.SendTimeout
+}
+
+// BitsPerByte is the number of bits one byte takes on the wire: the start
+// bit, data bits, parity bit if any and stop bits.
+func (s SerialSettings) BitsPerByte() int {
+	bits := 1 + s.DataBits + s.StopBits
+	if s.Parity != 0 {
+		bits++
+	}
+	return bits
+}
+
+// WireTime is how long count bytes take to transmit.
+func (s SerialSettings) WireTime(count int) time.Duration {
+	return time.Duration(float64(time.Second) / float64(s.Baud) * float64(count*s.BitsPerByte()))
+}
+
+// ReadProtocol finds the protocol element with the given id, compared
+// case-insensitively, and returns it without its parameters or DTCs. It stops reading as soon as the protocol
+// has been found, so it's much cheaper than parsing the whole file.
+func ReadProtocol(r io.Reader, id string) (Ssm2Protocol, error) {
+	decoder := xml.NewDecoder(r)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return Ssm2Protocol{}, fmt.Errorf("no protocol with id %q found", id)
+		}
+		if err != nil {
+			return Ssm2Protocol{}, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "protocol" {
+			continue
+		}
+
+		protocol := Ssm2Protocol{}
+		for _, attr := range start.Attr {
+			var err error
+			switch attr.Name.Local {
+			case "id":
+				protocol.Id = attr.Value
+			case "baud":
+				protocol.Baud, err = strconv.Atoi(attr.Value)
+			case "databits":
+				protocol.DataBits, err = strconv.Atoi(attr.Value)
+			case "stopbits":
+				protocol.StopBits, err = strconv.Atoi(attr.Value)
+			case "parity":
+				protocol.Parity, err = strconv.Atoi(attr.Value)
+			case "connect_timeout":
+				protocol.ConnectTimeout, err = strconv.Atoi(attr.Value)
+			case "send_timeout":
+				protocol.SendTimeout, err = strconv.Atoi(attr.Value)
+			}
+			if err != nil {
+				return Ssm2Protocol{}, fmt.Errorf("protocol %s has an invalid %s attribute %q", protocol.Id, attr.Name.Local, attr.Value)
+			}
+		}
+		if strings.EqualFold(protocol.Id, id) {
+			return protocol, nil
+		}
+		if err := decoder.Skip(); err != nil {
+			return Ssm2Protocol{}, err
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package ssm2lib
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// EcuInfo is what an ECU reports about itself when a session starts.
+type EcuInfo struct {
+	Protocol string
+	// RomId identifies the ECU software: the ROM ID for SSM, the VIN for OBD
+	// when the vehicle reports one.
+	RomId []byte
+	// SsmId is only set for SSM.
+	SsmId []byte
+	// Capabilities are the protocol's supported-parameter bit field: the SSM
+	// init response, or the OBD mode 01 supported-PID bitmaps.
+	Capabilities []byte
+	// InitRetries is how many init requests went unanswered before the ECU
+	// responded.
+	InitRetries int
+	// InitResponse is the init reply packet as received, for SSM.
+	InitResponse []byte
+}
+
+// RomIdString is the RomId as it appears in log file names and samples.
+func (i *EcuInfo) RomIdString() string {
+	if i.Protocol == ProtocolSsm {
+		return hex.EncodeToString(i.RomId)
+	}
+	if len(i.RomId) == 0 {
+		return strings.ToLower(i.Protocol)
+	}
+	return string(i.RomId)
+}
+
+// EcuSession is a connection to an ECU speaking one of the protocols in the
+// logger definitions. Logging works the same way for every protocol: the
+// selected parameters are mapped onto a payload, and each sample is a payload
+// holding every parameter's raw bytes at its mapping's offset.
+type EcuSession interface {
+	// SerialSettings picks the serial settings for this protocol from its
+	// definition.
+	SerialSettings(protocol Ssm2Protocol) SerialSettings
+	Open(port string, settings SerialSettings) error
+	Close()
+	Init() (*EcuInfo, error)
+	SupportedParameters(all []Ssm2Parameter, info *EcuInfo) []Ssm2Parameter
+	// StartLogging requests the selected parameters and returns how they map
+	// onto the payloads returned by NextPayload.
+	StartLogging(selections []ParameterSelection) ([]ParameterMapping, error)
+	// NextPayload returns the next sample's payload. Errors wrapping
+	// ErrChecksum mean a single corrupt frame, returned with its payload as
+	// received, and logging can carry on; any other error means the
+	// connection is gone.
+	NextPayload() ([]byte, error)
+}
+
+const (
+	ProtocolSsm = "SSM"
+	ProtocolObd = "OBD"
+)
+
+// SupportedProtocols lists the protocol ids NewEcuSession accepts.
+var SupportedProtocols = []string{ProtocolSsm, ProtocolObd}
+
+// NewEcuSession returns a session for the protocol with the given id in the
+// logger definitions.
+func NewEcuSession(protocol string, logger *log.Logger) (EcuSession, error) {
+	switch strings.ToUpper(protocol) {
+	case ProtocolSsm:
+		return &SsmSession{logger: logger}, nil
+	case ProtocolObd:
+		return &ObdSession{logger: logger}, nil
+	}
+	return nil, fmt.Errorf("unsupported protocol %q; expected one of %s", protocol, strings.Join(SupportedProtocols, ", "))
+}
+
+// SsmSession logs Subaru SSM2 parameters in continuous mode.
+type SsmSession struct {
+	Conn   *Ssm2Connection
+	logger *log.Logger
+}
+
+func (s *SsmSession) SerialSettings(protocol Ssm2Protocol) SerialSettings {
+	return protocol.SerialSettings()
+}
+
+func (s *SsmSession) Open(port string, settings SerialSettings) error {
+	s.Conn = &Ssm2Connection{}
+	if s.logger != nil {
+		s.Conn.SetLogger(s.logger)
+	}
+	return s.Conn.OpenWithSettings(port, settings)
+}
+
+func (s *SsmSession) Close() {
+	s.Conn.Close()
+}
+
+func (s *SsmSession) Init() (*EcuInfo, error) {
+	initResponse, err := s.Conn.InitEngine()
+	if err != nil {
+		return nil, err
+	}
+	return &EcuInfo{
+		Protocol:     ProtocolSsm,
+		RomId:        initResponse.GetRomId(),
+		SsmId:        initResponse.GetSsmId(),
+		Capabilities: initResponse.GetCapabilityBytes(),
+		InitRetries:  s.Conn.InitRetries(),
+		InitResponse: append([]byte{}, initResponse.Packet...),
+	}, nil
+}
+
+func (s *SsmSession) SupportedParameters(all []Ssm2Parameter, info *EcuInfo) []Ssm2Parameter {
+	return SsmSupportedParameters(all, info.Capabilities)
+}
+
+func (s *SsmSession) StartLogging(selections []ParameterSelection) ([]ParameterMapping, error) {
+	addresses, mappings, err := BuildSelectionAddressRequest(selections)
+	if err != nil {
+		return nil, err
+	}
+	// Cooldown between writes
+	time.Sleep(200 * time.Millisecond)
+	if _, err := s.Conn.ReadAddressesContinous(addresses); err != nil {
+		return nil, err
+	}
+	return mappings, nil
+}
+
+func (s *SsmSession) NextPayload() ([]byte, error) {
+	packet, err := s.Conn.GetNextPacketInStream()
+	if err != nil {
+		return nil, err
+	}
+	if err := packet.VerifyChecksum(); err != nil {
+		if len(packet) < Ssm2PacketMinSize {
+			return nil, err
+		}
+		return packet.GetPayloadBytes(), err
+	}
+	return packet.GetPayloadBytes(), nil
+}
+
+// SsmSupportedParameters filters all down to the parameters the capability
+// bytes report support for. Derived parameters aren't read from an address,
+// so they can't be requested and are never supported.
+func SsmSupportedParameters(all []Ssm2Parameter, capBytes []byte) []Ssm2Parameter {
+	supported := []Ssm2Parameter{}
+	for _, param := range all {
+		if param.IsDerived() {
+			continue
+		}
+		if param.Ungated {
+			supported = append(supported, param)
+			continue
+		}
+		if param.EcuByteIndex < uint(len(capBytes)) {
+			if (capBytes[param.EcuByteIndex] & (1 << param.EcuBit)) > 0 {
+				supported = append(supported, param)
+			}
+		}
+	}
+	return supported
+}
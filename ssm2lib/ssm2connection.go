@@ -20,6 +20,8 @@ type Ssm2Connection struct {
 	buf_serial *bufio.ReadWriter
 	logger     *log.Entry
 	buffer     []byte
+	settings   SerialSettings
+	retries    int
 }
 
 // I wasn't smart enough to figure out the timing myself, I got that answer here
@@ -34,20 +36,30 @@ func MicrosecondsOnTheWireByteCount(count int) int {
 	return int(math.Round(1.0 / 4800.00 * 1000000.0 * float64(count) * 10.0))
 }
 
+// wireTime is how long count bytes take on the wire at the connection's
+// settings; the package functions above assume 4800 8N1.
+func (c *Ssm2Connection) wireTime(count int) time.Duration {
+	return c.settings.WireTime(count)
+}
+
 func (c *Ssm2Connection) SetLogger(logger *log.Logger) {
 	c.logger = logger.WithFields(log.Fields{"logger": "Ssm2Connection"})
 }
 
+// Open connects with DefaultSerialSettings.
 func (c *Ssm2Connection) Open(port string) error {
-	config := &serial.Config{
-		Name:        port,
-		Baud:        4800,
-		StopBits:    serial.Stop1,
-		Parity:      serial.ParityNone,
-		ReadTimeout: 1 * time.Second,
+	return c.OpenWithSettings(port, DefaultSerialSettings)
+}
+
+// OpenWithSettings connects using the given serial settings, normally the
+// ones from the protocol in the definitions file.
+func (c *Ssm2Connection) OpenWithSettings(port string, settings SerialSettings) error {
+	if err := settings.Validate(); err != nil {
+		return fmt.Errorf("Invalid serial settings: %s", err)
 	}
+	c.settings = settings
 
-	serial_port, err := serial.OpenPort(config)
+	serial_port, err := serial.OpenPort(settings.serialConfig(port))
 	if err != nil {
 		return fmt.Errorf("Error opening serial port: %s", err)
 	}
@@ -57,17 +69,48 @@ func (c *Ssm2Connection) Open(port string) error {
 	return nil
 }
 
+// NewSsm2Connection talks SSM2 over an already open port, like a serial
+// port or a test double.
+func NewSsm2Connection(port io.ReadWriteCloser, settings SerialSettings) *Ssm2Connection {
+	return &Ssm2Connection{
+		serial:     port,
+		buf_serial: bufio.NewReadWriter(bufio.NewReader(port), bufio.NewWriter(port)),
+		settings:   settings,
+	}
+}
+
 func (c *Ssm2Connection) Close() {
 	c.serial.Close()
 }
 
+// InitEngine sends the init request, retrying every send timeout until the
+// ECU answers or the connect timeout has passed.
 func (c *Ssm2Connection) InitEngine() (*Ssm2InitResponsePacket, error) {
 	initPacket := NewInitRequestPacket(Ssm2DeviceDiagnosticToolF0, Ssm2DeviceEngine10)
-	packetBytes, err := c.sendPacketAndFetchResponsePacket(initPacket.Packet)
-	if err != nil {
-		return nil, err
+	deadline := time.Now().Add(c.settings.ConnectTimeout)
+	c.retries = 0
+	for {
+		packetBytes, err := c.sendPacketAndFetchResponsePacket(initPacket.Packet)
+		if err == nil {
+			return NewSsm2InitResponsePacketFromBytes(packetBytes)
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("No init response within %s: %s", c.settings.ConnectTimeout, err)
+		}
+		if c.logger != nil {
+			c.logger.WithFields(log.Fields{"error": err}).Debug("Init request failed, retrying")
+		}
+		// Don't spin when the port fails straight away, like an unplugged
+		// adapter does
+		time.Sleep(c.settings.SendTimeout)
+		c.retries++
 	}
-	return NewSsm2InitResponsePacketFromBytes(packetBytes)
+}
+
+// InitRetries is how many times the last InitEngine had to resend its
+// request.
+func (c *Ssm2Connection) InitRetries() int {
+	return c.retries
 }
 
 /// <summary>
@@ -155,7 +198,7 @@ func (c *Ssm2Connection) sendPacketAndFetchResponsePacket(packet Ssm2PacketBytes
 	// Is this totally unecessary? Sleeping between putting bits on the wire, and
 	// reading them. This should be "instantaneous" since the file is local in
 	// both cases?
-	time.Sleep(time.Duration(MicrosecondsOnTheWireBytes(packet)) * time.Microsecond)
+	time.Sleep(c.wireTime(len(packet)))
 
 	_, err = c.GetNextPacketInStream()
 	if err != nil {
@@ -172,7 +215,7 @@ func (c *Ssm2Connection) GetNextPacketInStream() (Ssm2PacketBytes, error) {
 	// Always assume that we have a fully formed packet waiting for us to fetch.
 	// Also assume we're trying to fetch a response packet immediately after
 	// sending a request and wait for the ECU/TCU to put a packet header on the wire
-	time.Sleep(time.Duration(MicrosecondsOnTheWireByteCount(Ssm2PacketHeaderSize)) * time.Microsecond)
+	time.Sleep(c.wireTime(Ssm2PacketHeaderSize))
 	// Grab the header (up to the command byte)
 	header_bytes := make([]byte, Ssm2PacketHeaderSize)
 	err := c.ensureSerialRead(&header_bytes)
@@ -184,12 +227,15 @@ func (c *Ssm2Connection) GetNextPacketInStream() (Ssm2PacketBytes, error) {
 			"data":  hex.EncodeToString(header_bytes),
 		}).Debug("Read the header, to the command byte")
 	}
+	if err != nil {
+		return nil, err
+	}
 
 	// Grab the remainder of the packet. Using the DataSize byte value, which will
 	// include all data, plus the checksum byte
 	remaining_bytes := make([]byte, header_bytes[Ssm2PacketIndexDataSize])
 	// Wait for the remaining packets to be put on the wire
-	time.Sleep(time.Duration(MicrosecondsOnTheWireBytes(remaining_bytes)) * time.Microsecond)
+	time.Sleep(c.wireTime(len(remaining_bytes)))
 	//count, err = c.serial.Read(remaining_bytes)
 	err = c.ensureSerialRead(&remaining_bytes)
 	if c.logger != nil {
@@ -199,6 +245,9 @@ func (c *Ssm2Connection) GetNextPacketInStream() (Ssm2PacketBytes, error) {
 			"data":  hex.EncodeToString(remaining_bytes),
 		}).Debug("Read the remaining bytes, to the checksum")
 	}
+	if err != nil {
+		return nil, err
+	}
 	packet_bytes := append(header_bytes, remaining_bytes...)
 	if c.logger != nil {
 		c.logger.WithFields(log.Fields{
@@ -219,7 +268,7 @@ func (c *Ssm2Connection) ensureSerialRead(desiredBuffer *[]byte) error {
 	if first_count < len(*desiredBuffer) {
 		remaining_bytes_to_read := desired_buf_len - first_count
 		second_read := make([]byte, remaining_bytes_to_read)
-		time_in_microseconds := MicrosecondsOnTheWireByteCount(remaining_bytes_to_read)
+		time_in_microseconds := int(c.wireTime(remaining_bytes_to_read) / time.Microsecond)
 		if c.logger != nil {
 			c.logger.WithFields(log.Fields{"wait": time_in_microseconds, "expected_count": desired_buf_len, "read_count": first_count, "error": err}).Debug("Didn't fill the read buffer, throttling and retrying precisely once")
 		}
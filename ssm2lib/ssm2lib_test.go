@@ -1,7 +1,14 @@
 package ssm2lib_test
 
 import (
-	"encoding/binary"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -40,6 +47,17 @@ var _ = Describe("Ssm2lib", func() {
 				Ω(err.Error()).To(Equal("First byte of packet is wrong. Expected 0x80, got 0x00"))
 			})
 		})
+		Context("The checksum is wrong", func() {
+			It("Returns an error wrapping ErrChecksum", func() {
+				packet := Ssm2PacketBytes([]byte{0x80, 0x10, 0xF0, 0x03, 0xE8, 0xAA, 0xBB, 0xCF})
+				err := packet.VerifyChecksum()
+				Ω(errors.Is(err, ErrChecksum)).Should(BeTrue())
+				Ω(err.Error()).Should(ContainSubstring("expected 0xd0, got 0xcf"))
+
+				packet[len(packet)-1] = 0xD0
+				Ω(packet.VerifyChecksum()).Should(Succeed())
+			})
+		})
 	})
 
 	Context("Parameter", func() {
@@ -52,12 +70,24 @@ var _ = Describe("Ssm2lib", func() {
 					}},
 				}
 
-				binaryTen := make([]byte, binary.MaxVarintLen64)
-				binary.PutUvarint(binaryTen, 10)
-				val, err := param.Convert("%", binaryTen)
+				val, err := param.Convert("%", []byte{10})
 				Ω(err).ShouldNot(HaveOccurred())
 				Ω(val).Should(Equal(5.0))
 			})
+
+			It("Decodes multi-byte values big-endian", func() {
+				param := &Ssm2Parameter{
+					Conversions: []Ssm2ParameterConversion{{Units: "raw", Expr: "x"}},
+				}
+
+				val, err := param.Convert("raw", []byte{0x01, 0x00})
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(val).Should(Equal(256.0))
+
+				val, err = param.Convert("raw", []byte{0x01, 0x00, 0x00, 0x00})
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(val).Should(Equal(16777216.0))
+			})
 		})
 	})
 
@@ -90,5 +120,883 @@ var _ = Describe("Ssm2lib", func() {
 			Ω(mappings[1].Start).Should(Equal(2))
 			Ω(mappings[1].Length).Should(Equal(1))
 		})
+
+		It("Converts a payload with the precompiled expression", func() {
+			params := []Ssm2Parameter{
+				{Name: "A", Address: Ssm2ParameterAddress{Address: "0x000100"}, Conversions: []Ssm2ParameterConversion{{Units: "C", Expr: "x-40"}}},
+				{Name: "B", Address: Ssm2ParameterAddress{Address: "0x000200", Length: 2}, Conversions: []Ssm2ParameterConversion{{Units: "rpm", Expr: "x/4"}}},
+			}
+			_, mappings, err := BuildParameterAddressRequest(params)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			payload := []byte{0x5a, 0x0c, 0x80}
+			val, err := mappings[0].Convert(payload)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(val).Should(Equal(50.0))
+			val, err = mappings[1].Convert(payload)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(val).Should(Equal(800.0))
+		})
+
+		It("Reports conversion expressions that fail to compile", func() {
+			params := []Ssm2Parameter{
+				{Name: "Broken", Address: Ssm2ParameterAddress{Address: "0x000100"}, Conversions: []Ssm2ParameterConversion{{Units: "u", Expr: "x*("}}},
+			}
+			_, _, err := BuildParameterAddressRequest(params)
+			Ω(err).Should(HaveOccurred())
+			Ω(err.Error()).Should(ContainSubstring("Broken"))
+		})
+	})
+
+	Context("Unit selection", func() {
+		coolant := Ssm2Parameter{
+			Name:    "Coolant Temperature",
+			Address: Ssm2ParameterAddress{Address: "0x000008"},
+			Conversions: []Ssm2ParameterConversion{
+				{Units: "C", Expr: "x-40"},
+				{Units: "F", Expr: "32+9*(x-40)/5"},
+			},
+		}
+
+		It("Prefers the earliest profile unit the parameter supports", func() {
+			Ω(UnitProfileImperial.SelectUnits(coolant)).Should(Equal("F"))
+			Ω(UnitProfileMetric.SelectUnits(coolant)).Should(Equal("C"))
+		})
+
+		It("Falls back to the first conversion", func() {
+			profile := UnitProfile{Name: "custom", Units: []string{"psi"}}
+			Ω(profile.SelectUnits(coolant)).Should(Equal("C"))
+		})
+
+		It("Resolves units case-insensitively and rejects unknown ones", func() {
+			units, err := coolant.ResolveUnits("f")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(units).Should(Equal("F"))
+
+			_, err = coolant.ResolveUnits("K")
+			Ω(err).Should(HaveOccurred())
+		})
+
+		It("Converts with the selected unit", func() {
+			_, mappings, err := BuildSelectionAddressRequest([]ParameterSelection{{Param: coolant, Units: []string{"F"}}})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(mappings[0].Units).Should(Equal("F"))
+			val, err := mappings[0].Convert([]byte{140})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(val).Should(Equal(212.0))
+		})
+	})
+
+	Context("Multiple units", func() {
+		It("Emits one mapping per unit from a single address", func() {
+			boost := Ssm2Parameter{
+				Name:    "Manifold Relative Pressure",
+				Address: Ssm2ParameterAddress{Address: "0x000024"},
+				Conversions: []Ssm2ParameterConversion{
+					{Units: "psi", Expr: "(x-128)/10"},
+					{Units: "kPa", Expr: "(x-128)*0.7"},
+				},
+			}
+			addrs, mappings, err := BuildSelectionAddressRequest([]ParameterSelection{{Param: boost, Units: []string{"psi", "kPa"}}})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(addrs).Should(HaveLen(1))
+			Ω(mappings).Should(HaveLen(2))
+			Ω(mappings[0].Units).Should(Equal("psi"))
+			Ω(mappings[1].Units).Should(Equal("kPa"))
+			Ω(mappings[1].Start).Should(Equal(mappings[0].Start))
+
+			psi, err := mappings[0].Convert([]byte{228})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(psi).Should(Equal(10.0))
+			kpa, err := mappings[1].Convert([]byte{228})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(kpa).Should(BeNumerically("~", 70.0, 1e-9))
+		})
+	})
+
+	Context("Format and gauge range", func() {
+		compile := func(conversion Ssm2ParameterConversion) *CompiledConversion {
+			compiled, err := CompileConversion(conversion)
+			Ω(err).ShouldNot(HaveOccurred())
+			return compiled
+		}
+
+		It("Formats values with the definition's format string", func() {
+			Ω(compile(Ssm2ParameterConversion{Expr: "x", Format: "0"}).FormatValue(2499.6)).Should(Equal("2500"))
+			Ω(compile(Ssm2ParameterConversion{Expr: "x", Format: "0.00"}).FormatValue(1.5)).Should(Equal("1.50"))
+			Ω(compile(Ssm2ParameterConversion{Expr: "x", Format: "0.0#"}).FormatValue(1.5)).Should(Equal("1.5"))
+			Ω(compile(Ssm2ParameterConversion{Expr: "x", Format: "0.0#"}).FormatValue(1.256)).Should(Equal("1.26"))
+			Ω(compile(Ssm2ParameterConversion{Expr: "x", Format: "0.0"}).FormatValue(-0.01)).Should(Equal("0.0"))
+		})
+
+		It("Rounds halves away from zero", func() {
+			Ω(compile(Ssm2ParameterConversion{Expr: "x", Format: "0"}).FormatValue(2.5)).Should(Equal("3"))
+			Ω(compile(Ssm2ParameterConversion{Expr: "x", Format: "0"}).FormatValue(-2.5)).Should(Equal("-3"))
+			Ω(compile(Ssm2ParameterConversion{Expr: "x", Format: "0"}).RoundValue(2.5)).Should(Equal(3.0))
+			Ω(compile(Ssm2ParameterConversion{Expr: "x", Format: "#.##"}).FormatValue(0.5)).Should(Equal("0.5"))
+			Ω(compile(Ssm2ParameterConversion{Expr: "x", Format: "0.0"}).RoundValue(-0.01)).Should(Equal(0.0))
+		})
+
+		It("Rounds and pads like Java's DecimalFormat for RomRaider logs", func() {
+			Ω(compile(Ssm2ParameterConversion{Expr: "x", Format: "0"}).JavaFormatValue(2.5)).Should(Equal("2"))
+			Ω(compile(Ssm2ParameterConversion{Expr: "x", Format: "0"}).JavaFormatValue(3.5)).Should(Equal("4"))
+			Ω(compile(Ssm2ParameterConversion{Expr: "x", Format: "0.00"}).JavaFormatValue(1.005)).Should(Equal("1.00"))
+			Ω(compile(Ssm2ParameterConversion{Expr: "x", Format: "#.##"}).JavaFormatValue(0.5)).Should(Equal(".5"))
+			Ω(compile(Ssm2ParameterConversion{Expr: "x", Format: "#.##"}).JavaFormatValue(-0.25)).Should(Equal("-.25"))
+			Ω(compile(Ssm2ParameterConversion{Expr: "x", Format: "#.##"}).JavaFormatValue(10.5)).Should(Equal("10.5"))
+			Ω(compile(Ssm2ParameterConversion{Expr: "x", Format: "#"}).JavaFormatValue(0.2)).Should(Equal("0"))
+			// DecimalFormat keeps the sign of negative values that round to zero
+			Ω(compile(Ssm2ParameterConversion{Expr: "x", Format: "0.0"}).JavaFormatValue(-0.01)).Should(Equal("-0.0"))
+			Ω(compile(Ssm2ParameterConversion{Expr: "x", Format: "#"}).JavaFormatValue(-0.2)).Should(Equal("-0"))
+			Ω(compile(Ssm2ParameterConversion{Expr: "x", Format: "#.##"}).JavaFormatValue(-0.001)).Should(Equal("-0"))
+			Ω(compile(Ssm2ParameterConversion{Expr: "x", Format: "0.0"}).FormatValue(-0.01)).Should(Equal("0.0"))
+		})
+
+		It("Reports the format's decimals", func() {
+			Ω(compile(Ssm2ParameterConversion{Expr: "x", Format: "0"}).Decimals()).Should(Equal(0))
+			Ω(compile(Ssm2ParameterConversion{Expr: "x", Format: "0.0#"}).Decimals()).Should(Equal(2))
+			Ω(compile(Ssm2ParameterConversion{Expr: "x"}).Decimals()).Should(Equal(-1))
+		})
+
+		It("Falls back to %f without a format string", func() {
+			Ω(compile(Ssm2ParameterConversion{Expr: "x"}).FormatValue(1.5)).Should(Equal("1.500000"))
+		})
+
+		It("Rounds values to the format's decimals", func() {
+			Ω(compile(Ssm2ParameterConversion{Expr: "x", Format: "0.0"}).RoundValue(12.34)).Should(Equal(12.3))
+		})
+
+		It("Checks values against the gauge range with a margin", func() {
+			conversion := Ssm2ParameterConversion{GaugeMin: 0, GaugeMax: 8000}
+			Ω(conversion.InGaugeRange(6500, 0)).Should(BeTrue())
+			Ω(conversion.InGaugeRange(8500, 0)).Should(BeFalse())
+			Ω(conversion.InGaugeRange(8500, 0.1)).Should(BeTrue())
+			Ω(conversion.InGaugeRange(25000, 0.1)).Should(BeFalse())
+		})
+
+		It("Accepts everything when the gauge range is unset", func() {
+			Ω(Ssm2ParameterConversion{}.InGaugeRange(25000, 0)).Should(BeTrue())
+		})
+	})
+
+	Context("Computed channels", func() {
+		It("Evaluates an expression over other channels", func() {
+			channel, err := CompileComputedChannel("boost_psi", "psi", "(map_kpa - baro_kpa) * 0.145", "0.0")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(channel.Variables()).Should(ConsistOf("map_kpa", "baro_kpa"))
+
+			val, err := channel.Evaluate(map[string]interface{}{"map_kpa": 201.0, "baro_kpa": 101.0})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(val).Should(BeNumerically("~", 14.5, 1e-9))
+			Ω(channel.FormatValue(val)).Should(Equal("14.5"))
+		})
+
+		It("Fails when an input is missing", func() {
+			channel, err := CompileComputedChannel("afr_error", "", "target - actual", "")
+			Ω(err).ShouldNot(HaveOccurred())
+			_, err = channel.Evaluate(map[string]interface{}{"target": 14.7})
+			Ω(err).Should(HaveOccurred())
+		})
+
+		It("Rejects expressions that don't compile", func() {
+			_, err := CompileComputedChannel("broken", "", "a +* b", "")
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+
+	Context("Storage types", func() {
+		It("Decodes signed and float storage types", func() {
+			compile := func(storageType string) *CompiledConversion {
+				compiled, err := CompileConversion(Ssm2ParameterConversion{Expr: "x", StorageType: storageType})
+				Ω(err).ShouldNot(HaveOccurred())
+				return compiled
+			}
+			val, err := compile("int8").Evaluate([]byte{0xfe})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(val).Should(Equal(-2.0))
+			val, err = compile("int16").Evaluate([]byte{0xff, 0x00})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(val).Should(Equal(-256.0))
+			val, err = compile("float").Evaluate([]byte{0x3f, 0xc0, 0x00, 0x00})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(val).Should(Equal(1.5))
+			val, err = compile("").Evaluate([]byte{0xfe})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(val).Should(Equal(254.0))
+		})
+	})
+
+	Context("Overlay", func() {
+		official := []Ssm2Parameter{
+			{Id: "P8", Name: "Engine Speed", Address: Ssm2ParameterAddress{Address: "0x00000e", Length: 2}},
+		}
+		var dir string
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "overlay")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+		writeOverlay := func(name string, contents string) string {
+			path := filepath.Join(dir, name)
+			Ω(ioutil.WriteFile(path, []byte(contents), 0644)).Should(Succeed())
+			return path
+		}
+
+		It("Loads YAML overlays", func() {
+			path := writeOverlay("extra.yaml", `
+parameters:
+  - id: X1
+    name: Boost Target
+    address: "0xff6a2c"
+    length: 4
+    conversions:
+      - units: psi
+        expr: x*0.01933677
+        storagetype: float
+        gauge_min: -15
+        gauge_max: 30
+  - id: X2
+    name: Cruise Switch
+    address: "0x000121"
+    ecubyteindex: 10
+    ecubit: 3
+    conversions:
+      - units: raw
+        expr: x
+`)
+			overlay, err := LoadOverlay(path)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(overlay).Should(HaveLen(2))
+			Ω(overlay[0].Conversions[0].StorageType).Should(Equal("float"))
+			Ω(overlay[0].Conversions[0].GaugeMin).Should(Equal(-15.0))
+
+			merged, err := MergeOverlay(official, overlay)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(merged).Should(HaveLen(3))
+			Ω(merged[1].Ungated).Should(BeTrue())
+			Ω(merged[2].Ungated).Should(BeFalse())
+			Ω(merged[2].EcuByteIndex).Should(Equal(uint(10)))
+			Ω(merged[2].EcuBit).Should(Equal(uint(3)))
+		})
+
+		It("Loads XML overlays", func() {
+			path := writeOverlay("extra.xml", `<parameters>
+  <parameter id="X1" name="Boost Target">
+    <address length="2">0xff6a2c</address>
+    <conversions><conversion units="psi" expr="x/100" format="0.00"/></conversions>
+  </parameter>
+</parameters>`)
+			overlay, err := LoadOverlay(path)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(overlay).Should(HaveLen(1))
+			Ω(overlay[0].ToParameter().Address.Length).Should(Equal(2))
+			Ω(overlay[0].ToParameter().Ungated).Should(BeTrue())
+		})
+
+		It("Rejects overlays with invalid expressions", func() {
+			path := writeOverlay("bad.yaml", `
+parameters:
+  - id: X1
+    name: Broken
+    address: "0xff6a2c"
+    conversions:
+      - units: psi
+        expr: x*(
+`)
+			_, err := LoadOverlay(path)
+			Ω(err).Should(HaveOccurred())
+		})
+
+		It("Reports name and ID conflicts", func() {
+			overlay := []OverlayParameter{
+				{Id: "X1", Name: "engine speed", Address: "0x000001", Source: "a.yaml"},
+				{Id: "P8", Name: "Other", Address: "0x000002", Source: "a.yaml"},
+			}
+			_, err := MergeOverlay(official, overlay)
+			Ω(err).Should(HaveOccurred())
+			Ω(err.Error()).Should(ContainSubstring("engine speed (X1)"))
+			Ω(err.Error()).Should(ContainSubstring("Other (P8)"))
+		})
+
+		It("Replaces official parameters marked as overrides", func() {
+			overlay := []OverlayParameter{
+				{Id: "P8", Name: "Engine Speed", Address: "0x000010", Override: true, Source: "a.yaml"},
+			}
+			merged, err := MergeOverlay(official, overlay)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(merged).Should(HaveLen(1))
+			Ω(merged[0].Address.Address).Should(Equal("0x000010"))
+		})
+	})
+
+	Context("Definition validation", func() {
+		It("Reports every problem with its line number", func() {
+			defs := `<logger version="test">
+<protocols>
+<protocol id="SSM" baud="4800">
+<parameters>
+<parameter id="P8" name="Engine Speed" ecubyteindex="8" ecubit="0">
+  <address length="2">0x00000e</address>
+  <conversions><conversion units="rpm" expr="x/4"/></conversions>
+</parameter>
+<parameter id="P8" name="Bad Address" ecubyteindex="8" ecubit="9">
+  <address>0x00zz</address>
+  <conversions><conversion units="u" expr="x*("/></conversions>
+</parameter>
+<parameter id="P9" name="engine speed" ecubyteindex="9" ecubit="1">
+  <address>0xffffff</address>
+  <conversions><conversion units="u" expr="y"/></conversions>
+</parameter>
+<parameter id="P200" name="Derived">
+  <depends><ref parameter="P8"/></depends>
+  <conversions><conversion units="u" expr="P8*P12"/></conversions>
+</parameter>
+</parameters>
+<dtcodes>
+<dtcode id="D1" name="P0335" tmpaddr="0x00008E" memaddr="0x0000A4" bit="9"/>
+<dtcode id="D1" name="P0336" tmpaddr="0x8E" memaddr="0x0000A4" bit="1"/>
+</dtcodes>
+</protocol>
+</protocols>
+</logger>`
+			findings, err := ValidateDefinitions(strings.NewReader(defs))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			messages := []string{}
+			for _, finding := range findings {
+				messages = append(messages, finding.String())
+			}
+			Ω(messages).Should(ContainElement(ContainSubstring("9: error: P8 Bad Address: duplicate parameter id, first defined on line 5")))
+			Ω(messages).Should(ContainElement(ContainSubstring("9: error: P8 Bad Address: invalid address")))
+			Ω(messages).Should(ContainElement(ContainSubstring("9: error: P8 Bad Address: ecubit 9 is out of range")))
+			Ω(messages).Should(ContainElement(ContainSubstring("9: error: P8 Bad Address: Unable to compile")))
+			Ω(messages).Should(ContainElement(ContainSubstring("13: error: P9 engine speed: duplicate parameter name")))
+			Ω(messages).Should(ContainElement(ContainSubstring("13: error: P9 engine speed: conversion \"u\" references unknown variable y")))
+			Ω(messages).Should(ContainElement(ContainSubstring("17: error: P200 Derived: conversion \"u\" references P12")))
+			Ω(messages).Should(ContainElement(ContainSubstring("23: error: D1 P0335: bit 9 is out of range")))
+			Ω(messages).Should(ContainElement(ContainSubstring("24: error: D1 P0336: duplicate DTC id")))
+			Ω(messages).Should(ContainElement(ContainSubstring("24: error: D1 P0336: tmpaddr 0x8E is 1 bytes")))
+			Ω(messages).ShouldNot(ContainElement(ContainSubstring("P8 Engine Speed")))
+		})
+
+		It("Requires an SSM protocol", func() {
+			findings, err := ValidateDefinitions(strings.NewReader(`<logger><protocols><protocol id="OBD"/></protocols></logger>`))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(findings).Should(HaveLen(1))
+			Ω(findings[0].Severity).Should(Equal(FindingError))
+		})
+
+		It("Fails on malformed XML", func() {
+			_, err := ValidateDefinitions(strings.NewReader(`<logger><protocols>`))
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+
+	Context("Definition cache", func() {
+		var dir string
+		romId := []byte{0x12, 0x34, 0x56, 0x78, 0x9a}
+		params := []Ssm2Parameter{
+			{Id: "P8", Name: "Engine Speed", Address: Ssm2ParameterAddress{Address: "0x00000e", Length: 2}, Conversions: []Ssm2ParameterConversion{{Units: "rpm", Expr: "x/4"}}},
+			{Id: "P9", Name: "Vehicle Speed", Address: Ssm2ParameterAddress{Address: "0x000010"}, Conversions: []Ssm2ParameterConversion{{Units: "km/h", Expr: "x"}}},
+		}
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "defcache")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("Round trips the supported parameters", func() {
+			cache := DefinitionCache{Dir: filepath.Join(dir, "nested")}
+			defs, err := NewCachedDefinitions(params, params[:1])
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(cache.Save("abcdef0123456789abcdef", romId, defs)).Should(Succeed())
+
+			loaded, err := cache.Load("abcdef0123456789abcdef", romId)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(loaded.Supported).Should(Equal(params[:1]))
+			Ω(loaded.Unsupported).Should(Equal([]Ssm2Parameter{{Id: "P9", Name: "Vehicle Speed"}}))
+			Ω(loaded.All()).Should(HaveLen(2))
+		})
+
+		It("Misses for another ROM or definitions file", func() {
+			cache := DefinitionCache{Dir: dir}
+			defs, err := NewCachedDefinitions(params, params)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(cache.Save("abcdef0123456789abcdef", romId, defs)).Should(Succeed())
+
+			loaded, err := cache.Load("abcdef0123456789abcdef", []byte{1, 2, 3, 4, 5})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(loaded).Should(BeNil())
+			loaded, err = cache.Load("0000000000000000abcdef", romId)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(loaded).Should(BeNil())
+		})
+
+		It("Refuses to cache conversions that don't compile", func() {
+			bad := []Ssm2Parameter{{Id: "P1", Name: "Bad", Conversions: []Ssm2ParameterConversion{{Units: "u", Expr: "x +"}}}}
+			_, err := NewCachedDefinitions(bad, bad)
+			Ω(err).Should(HaveOccurred())
+		})
+
+		It("Round trips what's known about the definition files", func() {
+			cache := DefinitionCache{Dir: dir}
+			files := &CachedDefinitionFiles{Hash: "abc", DefinitionsVersion: "2024", Protocol: Ssm2Protocol{Id: "SSM", Baud: 4800}}
+			Ω(cache.SaveFiles("abcdef0123456789abcdef", "SSM", files)).Should(Succeed())
+
+			loaded, err := cache.LoadFiles("abcdef0123456789abcdef", "SSM")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(loaded).Should(Equal(files))
+			loaded, err = cache.LoadFiles("abcdef0123456789abcdef", "OBD")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(loaded).Should(BeNil())
+		})
+
+		It("Keys files by size and modification time without reading them", func() {
+			a := filepath.Join(dir, "a.xml")
+			Ω(ioutil.WriteFile(a, []byte("<logger/>"), 0644)).Should(Succeed())
+			modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+			Ω(os.Chtimes(a, modified, modified)).Should(Succeed())
+			first, err := DefinitionsKey(a)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(ioutil.WriteFile(a, []byte("<LOGGER/>"), 0644)).Should(Succeed())
+			Ω(os.Chtimes(a, modified, modified)).Should(Succeed())
+			Ω(DefinitionsKey(a)).Should(Equal(first))
+
+			Ω(os.Chtimes(a, modified, modified.Add(time.Second))).Should(Succeed())
+			Ω(DefinitionsKey(a)).ShouldNot(Equal(first))
+			Ω(ioutil.WriteFile(a, []byte("<logger />"), 0644)).Should(Succeed())
+			Ω(os.Chtimes(a, modified, modified)).Should(Succeed())
+			Ω(DefinitionsKey(a)).ShouldNot(Equal(first))
+
+			_, err = DefinitionsKey(filepath.Join(dir, "missing.xml"))
+			Ω(err).Should(HaveOccurred())
+		})
+
+		It("Hashes file contents", func() {
+			a := filepath.Join(dir, "a.xml")
+			Ω(ioutil.WriteFile(a, []byte("<logger/>"), 0644)).Should(Succeed())
+			first, err := DefinitionsHash(a)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(ioutil.WriteFile(a, []byte("<logger />"), 0644)).Should(Succeed())
+			second, err := DefinitionsHash(a)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(second).ShouldNot(Equal(first))
+
+			_, err = DefinitionsHash(filepath.Join(dir, "missing.xml"))
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+
+	Context("Serial settings", func() {
+		It("Reads the protocol attributes and defaults missing ones", func() {
+			protocol, err := ReadProtocol(strings.NewReader(`<logger><protocols>
+<protocol id="OBD" baud="500000"><parameters><parameter id="P1"/></parameters></protocol>
+<protocol id="SSM" baud="9600" databits="8" stopbits="2" parity="2" send_timeout="55">
+<parameters><parameter id="P8"/></parameters>
+</protocol></protocols></logger>`), "SSM")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(protocol.Parameters).Should(BeEmpty())
+
+			settings := protocol.SerialSettings()
+			Ω(settings.Baud).Should(Equal(9600))
+			Ω(settings.StopBits).Should(Equal(2))
+			Ω(settings.Parity).Should(Equal(2))
+			Ω(settings.SendTimeout).Should(Equal(55 * time.Millisecond))
+			Ω(settings.ConnectTimeout).Should(Equal(DefaultSerialSettings.ConnectTimeout))
+			Ω(settings.String()).Should(Equal("9600 8E2"))
+			Ω(settings.Validate()).Should(Succeed())
+		})
+
+		It("Finds the protocol regardless of case", func() {
+			protocol, err := ReadProtocol(strings.NewReader(`<logger><protocols><protocol id="Ssm" baud="9600"/></protocols></logger>`), "SSM")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(protocol.Baud).Should(Equal(9600))
+		})
+
+		It("Reports a missing protocol", func() {
+			_, err := ReadProtocol(strings.NewReader(`<logger><protocols><protocol id="OBD"/></protocols></logger>`), "SSM")
+			Ω(err).Should(HaveOccurred())
+		})
+
+		It("Reads the definitions version from the root element", func() {
+			version, err := ReadDefinitionsVersion(strings.NewReader(`<?xml version="1.0"?><logger version="3.7.0"><protocols>`))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(version).Should(Equal("3.7.0"))
+
+			version, err = ReadDefinitionsVersion(strings.NewReader(`<logger/>`))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(version).Should(BeEmpty())
+
+			_, err = ReadDefinitionsVersion(strings.NewReader(`<roms/>`))
+			Ω(err).Should(HaveOccurred())
+		})
+
+		It("Times bytes on the wire", func() {
+			Ω(DefaultSerialSettings.WireTime(10).Round(time.Microsecond)).Should(Equal(time.Duration(MicrosecondsOnTheWireByteCount(10)) * time.Microsecond))
+			parity := DefaultSerialSettings
+			parity.Parity = 1
+			Ω(parity.BitsPerByte()).Should(Equal(11))
+		})
+
+		It("Parses parity names and numbers", func() {
+			Ω(ParseParity("Even")).Should(Equal(2))
+			Ω(ParseParity("4")).Should(Equal(4))
+			_, err := ParseParity("sometimes")
+			Ω(err).Should(HaveOccurred())
+		})
+
+		It("Rejects impossible settings", func() {
+			bad := DefaultSerialSettings
+			bad.StopBits = 3
+			Ω(bad.Validate()).ShouldNot(Succeed())
+		})
+
+		It("Keeps the serial read timeout from getting shorter than a second", func() {
+			settings := DefaultSerialSettings
+			settings.SendTimeout = 55 * time.Millisecond
+			Ω(settings.ReadTimeout()).Should(Equal(time.Second))
+			settings.SendTimeout = 3 * time.Second
+			Ω(settings.ReadTimeout()).Should(Equal(3 * time.Second))
+		})
+
+		It("Keeps the init reply and what a corrupt frame carried", func() {
+			port := &flakySsmPort{}
+			session := &SsmSession{Conn: NewSsm2Connection(port, DefaultSerialSettings)}
+			info, err := session.Init()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(info.InitResponse).Should(Equal([]byte{0x80, 0xf0, 0x10, 0x09, 0xff, 0xa2, 0x10, 0x11, 0x01, 0x02, 0x03, 0x04, 0x05, 0x00}))
+
+			port.pending = append(port.pending, 0x80, 0xf0, 0x10, 0x03, 0xe8, 0xaa, 0xbb, 0xcf)
+			payload, err := session.NextPayload()
+			Ω(errors.Is(err, ErrChecksum)).Should(BeTrue())
+			Ω(payload).Should(Equal([]byte{0xaa, 0xbb}))
+		})
+
+		It("Waits the send timeout between init attempts", func() {
+			settings := DefaultSerialSettings
+			settings.SendTimeout = 20 * time.Millisecond
+			settings.ConnectTimeout = 100 * time.Millisecond
+
+			port := &flakySsmPort{failures: 2}
+			started := time.Now()
+			response, err := NewSsm2Connection(port, settings).InitEngine()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(response.GetRomId()).Should(Equal([]byte{0x01, 0x02, 0x03, 0x04, 0x05}))
+			Ω(time.Since(started)).Should(BeNumerically(">=", 2*settings.SendTimeout))
+			Ω(port.writes).Should(Equal(3))
+
+			// An unplugged adapter fails every write straight away
+			port = &flakySsmPort{failures: 1000}
+			connection := NewSsm2Connection(port, settings)
+			_, err = connection.InitEngine()
+			Ω(err).Should(MatchError(ContainSubstring("No init response within 100ms")))
+			Ω(port.writes).Should(BeNumerically("<=", 7))
+			Ω(connection.InitRetries()).Should(Equal(port.writes - 1))
+		})
+	})
+
+	Context("OBD session", func() {
+		responses := map[string]string{
+			"ATZ":  "\r\rELM327 v1.5\r\r>",
+			"ATE0": "ATE0\rOK\r\r>",
+			"0100": "SEARCHING...\r4100BE1FA813\r\r>",
+			"0120": "41208005B011\r\r>",
+			"0140": "NO DATA\r\r>",
+			"0902": "014\r0:490201314434\r1:47503030523535\r2:42313233343536\r\r>",
+			"010C": "410C1AF8\r\r>",
+			"0105": "41057B\r\r>",
+			"0111": "NO DATA\r\r>",
+		}
+		params := []Ssm2Parameter{
+			{Id: "O12", Name: "Engine RPM", Address: Ssm2ParameterAddress{Address: "0x0C", Length: 2}, Conversions: []Ssm2ParameterConversion{{Units: "rpm", Expr: "x/4"}}},
+			{Id: "O5", Name: "Coolant Temperature", Address: Ssm2ParameterAddress{Address: "0x0105"}, Conversions: []Ssm2ParameterConversion{{Units: "C", Expr: "x-40"}}},
+			{Id: "O17", Name: "Throttle Position", Address: Ssm2ParameterAddress{Address: "0x11"}, Conversions: []Ssm2ParameterConversion{{Units: "%", Expr: "x*100/255"}}},
+			{Id: "O2", Name: "Freeze DTC", Address: Ssm2ParameterAddress{Address: "0x02"}, Conversions: []Ssm2ParameterConversion{{Units: "", Expr: "x"}}},
+		}
+
+		newSession := func() *ObdSession {
+			return NewObdSession(&fakeElm{responses: responses}, DefaultObdSerialSettings, nil)
+		}
+
+		It("Initialises the adapter and reads supported PIDs and the VIN", func() {
+			info, err := newSession().Init()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(info.Capabilities).Should(Equal([]byte{0xbe, 0x1f, 0xa8, 0x13, 0x80, 0x05, 0xb0, 0x11}))
+			Ω(info.RomIdString()).Should(Equal("1D4GP00R55B123456"))
+		})
+
+		It("Picks supported parameters from the PID bitmap", func() {
+			session := newSession()
+			info, err := session.Init()
+			Ω(err).ShouldNot(HaveOccurred())
+			supported := session.SupportedParameters(params, info)
+			names := []string{}
+			for _, param := range supported {
+				names = append(names, param.Name)
+			}
+			// 0x0C, 0x05 and 0x11 are set in BE1FA813, 0x02 isn't
+			Ω(names).Should(Equal([]string{"Engine RPM", "Coolant Temperature", "Throttle Position"}))
+		})
+
+		It("Polls each selected PID into one payload", func() {
+			session := newSession()
+			_, err := session.Init()
+			Ω(err).ShouldNot(HaveOccurred())
+			mappings, err := session.StartLogging([]ParameterSelection{{Param: params[0]}, {Param: params[1]}})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(PayloadLength(mappings)).Should(Equal(3))
+
+			payload, err := session.NextPayload()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(payload).Should(Equal([]byte{0x1a, 0xf8, 0x7b}))
+			Ω(mappings[0].Convert(payload)).Should(Equal(1726.0))
+			Ω(mappings[1].Convert(payload)).Should(Equal(83.0))
+		})
+
+		It("Returns a short payload when a PID isn't answered", func() {
+			session := newSession()
+			_, err := session.Init()
+			Ω(err).ShouldNot(HaveOccurred())
+			_, err = session.StartLogging([]ParameterSelection{{Param: params[0]}, {Param: params[2]}})
+			Ω(err).ShouldNot(HaveOccurred())
+			payload, err := session.NextPayload()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(payload).Should(HaveLen(2))
+		})
+
+		It("Rejects unknown protocols", func() {
+			_, err := NewEcuSession("J1850", nil)
+			Ω(err).Should(HaveOccurred())
+			session, err := NewEcuSession("obd", nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(session.SerialSettings(Ssm2Protocol{Baud: 500000, SendTimeout: 200}).Baud).Should(Equal(DefaultObdSerialSettings.Baud))
+		})
+	})
+
+	Context("RomRaider log", func() {
+		It("Writes milliseconds since the start, unquoted cells and CRLF", func() {
+			started := time.Date(2018, 5, 12, 9, 30, 15, 0, time.Local)
+			out := &strings.Builder{}
+			writer := NewRomRaiderLogWriter(out, started)
+			Ω(writer.WriteHeader([]RomRaiderColumn{{Name: "Engine Speed", Units: "rpm"}, {Name: "A/F Sensor #1", Units: "AFR"}})).Should(Succeed())
+			Ω(writer.WriteRow(started, []string{"812", "14.70"})).Should(Succeed())
+			// Times are truncated to whole milliseconds
+			Ω(writer.WriteRow(started.Add(121900*time.Microsecond), []string{"815", ""})).Should(Succeed())
+			Ω(out.String()).Should(BeEmpty())
+			Ω(writer.Flush()).Should(Succeed())
+			Ω(out.String()).Should(Equal("Time,Engine Speed (rpm),A/F Sensor #1 (AFR)\r\n0,812,14.70\r\n121,815,\r\n"))
+		})
+
+		It("Keeps the brackets without units", func() {
+			Ω(RomRaiderColumn{Name: "Gear Position"}.Header()).Should(Equal("Gear Position ()"))
+			Ω(RomRaiderColumn{Name: "Engine Speed", Units: "rpm"}.Header()).Should(Equal("Engine Speed (rpm)"))
+		})
+	})
+
+	Context("Raw log", func() {
+		params := []Ssm2Parameter{
+			{Id: "P2", Name: "Coolant Temperature", Address: Ssm2ParameterAddress{Address: "0x000008"}, Conversions: []Ssm2ParameterConversion{{Units: "C", Expr: "x-40"}, {Units: "F", Expr: "32+9*(x-40)/5"}}},
+			{Id: "P8", Name: "Engine Speed", Address: Ssm2ParameterAddress{Address: "0x00000e", Length: 2}, Conversions: []Ssm2ParameterConversion{{Units: "rpm", Expr: "x/4"}}},
+		}
+		started := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+		record := func(frames ...[]byte) *bytes.Buffer {
+			_, mappings, err := BuildSelectionAddressRequest([]ParameterSelection{{Param: params[0], Units: []string{"F"}}, {Param: params[1]}})
+			Ω(err).ShouldNot(HaveOccurred())
+			out := &bytes.Buffer{}
+			writer, err := NewRawLogWriter(out, RawLogHeader{
+				Started:         started,
+				Info:            EcuInfo{Protocol: ProtocolSsm, RomId: []byte{0x12, 0x34, 0x56, 0x78, 0x90}},
+				DefinitionsHash: "abc",
+				Mappings:        NewRawLogMappings(mappings),
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+			for idx, frame := range frames {
+				Ω(writer.WriteFrame(RawFrame{Time: started.Add(time.Duration(idx+1) * 12345678 * time.Nanosecond), Payload: frame})).Should(Succeed())
+			}
+			Ω(writer.Flush()).Should(Succeed())
+			return out
+		}
+
+		It("Reads back the header and every frame", func() {
+			reader, err := NewRawLogReader(record([]byte{0x5a, 0x0c, 0x80}, []byte{0x5b, 0x0d, 0x00}))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(reader.Header.Started.Equal(started)).Should(BeTrue())
+			Ω(reader.Header.Info.RomIdString()).Should(Equal("1234567890"))
+			Ω(reader.Header.DefinitionsHash).Should(Equal("abc"))
+			Ω(reader.Header.Mappings).Should(Equal([]RawLogMapping{
+				{Id: "P2", Name: "Coolant Temperature", Units: "F", Start: 0, Length: 1},
+				{Id: "P8", Name: "Engine Speed", Units: "rpm", Start: 1, Length: 2},
+			}))
+
+			frame, err := reader.Next()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(frame.Time.Sub(started)).Should(Equal(12345 * time.Microsecond))
+			Ω(frame.Payload).Should(Equal([]byte{0x5a, 0x0c, 0x80}))
+			Ω(frame.Corrupt).Should(BeFalse())
+			frame, err = reader.Next()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(frame.Time.Sub(started)).Should(Equal(24691 * time.Microsecond))
+			Ω(frame.Payload).Should(Equal([]byte{0x5b, 0x0d, 0x00}))
+			_, err = reader.Next()
+			Ω(err).Should(Equal(io.EOF))
+		})
+
+		It("Keeps corrupt frames and the init reply", func() {
+			out := &bytes.Buffer{}
+			initResponse := []byte{0x80, 0xf0, 0x10, 0x09, 0xff, 0xa2, 0x10, 0x11, 0x01, 0x02, 0x03, 0x04, 0x05, 0x00}
+			writer, err := NewRawLogWriter(out, RawLogHeader{Started: started, Info: EcuInfo{Protocol: ProtocolSsm, InitResponse: initResponse}})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(writer.WriteFrame(RawFrame{Time: started, Payload: []byte{0x5a, 0xff}, Corrupt: true})).Should(Succeed())
+			Ω(writer.WriteFrame(RawFrame{Time: started, Payload: []byte{0x5a}})).Should(Succeed())
+			Ω(writer.Flush()).Should(Succeed())
+
+			reader, err := NewRawLogReader(out)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(reader.Header.Info.InitResponse).Should(Equal(initResponse))
+			frame, err := reader.Next()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(frame).Should(Equal(RawFrame{Time: started, Payload: []byte{0x5a, 0xff}, Corrupt: true}))
+			frame, err = reader.Next()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(frame.Corrupt).Should(BeFalse())
+		})
+
+		It("Reads logs from before frames had flags", func() {
+			v1 := []byte("SSM2RAW\x01\x02{}")
+			// 1000µs after the start, then a 2 byte payload
+			v1 = append(v1, 0xe8, 0x07, 0x02, 0x5a, 0x0c)
+			reader, err := NewRawLogReader(bytes.NewReader(v1))
+			Ω(err).ShouldNot(HaveOccurred())
+			frame, err := reader.Next()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(frame.Time.Sub(reader.Header.Started)).Should(Equal(time.Millisecond))
+			Ω(frame.Payload).Should(Equal([]byte{0x5a, 0x0c}))
+			_, err = reader.Next()
+			Ω(err).Should(Equal(io.EOF))
+		})
+
+		It("Reports a log cut off partway through a frame", func() {
+			log := record([]byte{0x5a, 0x0c, 0x80})
+			reader, err := NewRawLogReader(bytes.NewReader(log.Bytes()[:log.Len()-1]))
+			Ω(err).ShouldNot(HaveOccurred())
+			_, err = reader.Next()
+			Ω(err).Should(Equal(io.ErrUnexpectedEOF))
+		})
+
+		It("Rejects files that aren't raw logs", func() {
+			_, err := NewRawLogReader(strings.NewReader("timestamp,Engine Speed (rpm)\n"))
+			Ω(err).Should(HaveOccurred())
+		})
+
+		It("Decodes the payloads with fixed definitions", func() {
+			reader, err := NewRawLogReader(record([]byte{0x5a, 0x0c, 0x80}))
+			Ω(err).ShouldNot(HaveOccurred())
+			frame, err := reader.Next()
+			Ω(err).ShouldNot(HaveOccurred())
+			payload := frame.Payload
+
+			fixed := []Ssm2Parameter{params[0], params[1]}
+			fixed[0].Conversions = []Ssm2ParameterConversion{{Units: "F", Expr: "32+9*(x-50)/5"}}
+			mappings, err := reader.Header.Remap(fixed)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(mappings).Should(HaveLen(2))
+			val, err := mappings[0].Convert(payload)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(val).Should(Equal(104.0))
+			val, err = mappings[1].Convert(payload)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(val).Should(Equal(800.0))
+		})
+
+		It("Refuses definitions that no longer match the logged bytes", func() {
+			reader, err := NewRawLogReader(record())
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, err = reader.Header.Remap(params[:1])
+			Ω(err).Should(MatchError(ContainSubstring("P8")))
+
+			resized := []Ssm2Parameter{params[0], params[1]}
+			resized[1].Address.Length = 4
+			_, err = reader.Header.Remap(resized)
+			Ω(err).Should(MatchError(ContainSubstring("logged as 2 bytes")))
+
+			renamed := []Ssm2Parameter{params[0], params[1]}
+			renamed[0].Conversions = []Ssm2ParameterConversion{{Units: "C", Expr: "x-40"}}
+			_, err = reader.Header.Remap(renamed)
+			Ω(err).Should(HaveOccurred())
+		})
 	})
 })
+
+// fakeElm answers each command written to it with a canned ELM327 response,
+// or "?" for commands it doesn't know.
+type fakeElm struct {
+	responses map[string]string
+	pending   []byte
+}
+
+func (f *fakeElm) Write(p []byte) (int, error) {
+	command := strings.TrimSpace(string(p))
+	response, ok := f.responses[command]
+	if !ok {
+		response = "OK\r\r>"
+		if !strings.HasPrefix(command, "AT") {
+			response = "?\r\r>"
+		}
+	}
+	f.pending = append(f.pending, []byte(response)...)
+	return len(p), nil
+}
+
+func (f *fakeElm) Read(p []byte) (int, error) {
+	if len(f.pending) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, f.pending)
+	f.pending = f.pending[n:]
+	return n, nil
+}
+
+func (f *fakeElm) Close() error {
+	return nil
+}
+
+// flakySsmPort fails the first failures writes, then echoes each request
+// followed by an init response.
+type flakySsmPort struct {
+	failures int
+	writes   int
+	pending  []byte
+}
+
+func (f *flakySsmPort) Write(p []byte) (int, error) {
+	f.writes++
+	if f.writes <= f.failures {
+		return 0, errors.New("device not configured")
+	}
+	f.pending = append(f.pending, p...)
+	f.pending = append(f.pending, 0x80, 0xf0, 0x10, 0x09, 0xff, 0xa2, 0x10, 0x11, 0x01, 0x02, 0x03, 0x04, 0x05, 0x00)
+	return len(p), nil
+}
+
+func (f *flakySsmPort) Read(p []byte) (int, error) {
+	if len(f.pending) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, f.pending)
+	f.pending = f.pending[n:]
+	return n, nil
+}
+
+func (f *flakySsmPort) Close() error {
+	return nil
+}
@@ -2,9 +2,13 @@ package ssm2lib
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 )
 
+// ErrChecksum means a packet's checksum byte doesn't match its contents.
+var ErrChecksum = errors.New("packet checksum mismatch")
+
 type Ssm2PacketIndex int
 
 const (
@@ -93,6 +97,19 @@ func (b Ssm2PacketBytes) GetCommand() Ssm2Command {
 	return Ssm2Command(b[Ssm2PacketIndexCommand])
 }
 
+// VerifyChecksum checks the last byte against the sum of the others. The
+// error wraps ErrChecksum.
+func (b Ssm2PacketBytes) VerifyChecksum() error {
+	if len(b) < 2 {
+		return fmt.Errorf("%w: packet is only %d bytes", ErrChecksum, len(b))
+	}
+	expected := CalculateChecksum(b)
+	if b[len(b)-1] != expected {
+		return fmt.Errorf("%w: expected 0x%.2x, got 0x%.2x", ErrChecksum, expected, b[len(b)-1])
+	}
+	return nil
+}
+
 func (b Ssm2PacketBytes) Validate() error {
 	if b.GetFirstByte() != Ssm2PacketFirstByte {
 		return fmt.Errorf("First byte of packet is wrong. Expected 0x80, got 0x%.2x", b.GetFirstByte())
@@ -2,9 +2,9 @@ package ssm2lib
 
 import (
 	"encoding/hex"
+	"encoding/xml"
 	"fmt"
-
-	"github.com/Knetic/govaluate"
+	"io"
 )
 
 // TODO: These are all prefixed as "SSM2", but they're really RomRaider definitions
@@ -15,6 +15,34 @@ type Ssm2Logger struct {
 	Protocols []Ssm2Protocol `xml:"protocols>protocol"`
 }
 
+// ReadDefinitionsVersion returns the version attribute of the root logger
+// element, without reading any further into the file.
+func ReadDefinitionsVersion(r io.Reader) (string, error) {
+	decoder := xml.NewDecoder(r)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return "", fmt.Errorf("no logger element found")
+		}
+		if err != nil {
+			return "", err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if start.Name.Local != "logger" {
+			return "", fmt.Errorf("expected a logger element, found %s", start.Name.Local)
+		}
+		for _, attr := range start.Attr {
+			if attr.Name.Local == "version" {
+				return attr.Value, nil
+			}
+		}
+		return "", nil
+	}
+}
+
 type Ssm2Protocol struct {
 	Id             string          `xml:"id,attr"`
 	Baud           int             `xml:"baud,attr"`
@@ -63,39 +91,45 @@ type Ssm2Parameter struct {
 	Target       uint                      `xml:"target,attr"`
 	Address      Ssm2ParameterAddress      `xml:"address"`
 	Conversions  []Ssm2ParameterConversion `xml:"conversions>conversion"`
+	Depends      []Ssm2ParameterRef        `xml:"depends>ref"`
+	// Ungated parameters have no capability bit in the init response and are
+	// always treated as supported. Only overlay parameters can be ungated.
+	Ungated bool `xml:"-"`
 }
 
+// Convert looks up the conversion for unit and evaluates it against value.
+// It parses the expression on every call; the logging loop should use the
+// precompiled conversions on ParameterMapping instead.
 func (p Ssm2Parameter) Convert(unit string, value []byte) (float64, error) {
-	var intval int
-	// TODO: I'm making several assumptions here. I've only tested with 1 byte
-	// responses so far, and I'm not 100% sure what the 2+ byte responses are or
-	// how they work.
-	if len(value) == 4 {
-		intval = int(uint(value[3]) | uint(value[2])<<8 | uint(value[1])<<16 | uint(value[0]<<32))
-	} else if len(value) == 2 {
-		intval = int(uint(value[1]) | uint(value[0])<<8)
-	} else if len(value) == 1 {
-		intval = int(value[0])
-	} else {
-		intval = 0
+	conversion, err := p.GetConversion(unit)
+	if err != nil {
+		return 0, err
 	}
+	compiled, err := CompileConversion(conversion)
+	if err != nil {
+		return 0, err
+	}
+	return compiled.Evaluate(value)
+}
+
+func (p Ssm2Parameter) GetConversion(unit string) (Ssm2ParameterConversion, error) {
 	for _, conversion := range p.Conversions {
 		if conversion.Units == unit {
-			params := make(map[string]interface{}, 1)
-			params["x"] = intval
-			expr, err := govaluate.NewEvaluableExpression(conversion.Expr)
-			if err != nil {
-				return 0, err
-			}
-
-			result, err := expr.Evaluate(params)
-			if err != nil {
-				return 0, err
-			}
-			return result.(float64), nil
+			return conversion, nil
 		}
 	}
-	return 0, fmt.Errorf("Unable to find a converstion with unit (%s)", unit)
+	return Ssm2ParameterConversion{}, fmt.Errorf("Unable to find a converstion with unit (%s)", unit)
+}
+
+// Ssm2ParameterRef points a derived parameter at one of its inputs.
+type Ssm2ParameterRef struct {
+	Parameter string `xml:"parameter,attr"`
+}
+
+// IsDerived is true for parameters calculated from other parameters rather
+// than read from an address.
+func (p Ssm2Parameter) IsDerived() bool {
+	return len(p.Depends) > 0
 }
 
 type Ssm2ParameterAddress struct {
@@ -112,10 +146,24 @@ func (a Ssm2ParameterAddress) GetAddressBytes() ([]byte, error) {
 }
 
 type Ssm2ParameterConversion struct {
-	Units     string  `xml:"units,attr"`
-	Expr      string  `xml:"expr,attr"`
-	Format    string  `xml:"format,attr"`
-	GaugeMin  float64 `xml:"gauge_min,attr"`
-	GaugeMax  float64 `xml:"gauge_max,attr"`
-	GaugeStep float64 `xml:"gauge_step,attr"`
+	Units       string  `xml:"units,attr" yaml:"units"`
+	Expr        string  `xml:"expr,attr" yaml:"expr"`
+	Format      string  `xml:"format,attr" yaml:"format"`
+	StorageType string  `xml:"storagetype,attr" yaml:"storagetype"` // uint8/16/32, int8/16/32 or float
+	GaugeMin    float64 `xml:"gauge_min,attr" yaml:"gauge_min"`
+	GaugeMax    float64 `xml:"gauge_max,attr" yaml:"gauge_max"`
+	GaugeStep   float64 `xml:"gauge_step,attr" yaml:"gauge_step"`
+}
+
+// HasGaugeRange is false for definitions that leave the gauge limits unset.
+func (c Ssm2ParameterConversion) HasGaugeRange() bool {
+	return c.GaugeMax > c.GaugeMin
+}
+
+func (c Ssm2ParameterConversion) InGaugeRange(value float64, margin float64) bool {
+	if !c.HasGaugeRange() {
+		return true
+	}
+	slack := (c.GaugeMax - c.GaugeMin) * margin
+	return value >= c.GaugeMin-slack && value <= c.GaugeMax+slack
 }
@@ -0,0 +1,90 @@
+package ssm2lib
+
+import (
+	"fmt"
+	"strings"
+)
+
+// UnitProfile is an ordered list of preferred units. For every parameter the
+// conversion whose unit appears earliest in the list wins; parameters with no
+// matching conversion keep their first (default) conversion.
+type UnitProfile struct {
+	Name  string
+	Units []string
+}
+
+var (
+	UnitProfileMetric = UnitProfile{
+		Name:  "metric",
+		Units: []string{"C", "kPa", "km/h", "km", "g/s", "l", "lambda"},
+	}
+	UnitProfileImperial = UnitProfile{
+		Name:  "imperial",
+		Units: []string{"F", "psi", "mph", "miles", "lb/min", "gal", "AFR"},
+	}
+	// UnitProfilePsiBoost is metric, except pressures are shown in psi.
+	UnitProfilePsiBoost = UnitProfile{
+		Name:  "psi-boost",
+		Units: []string{"psi", "C", "km/h", "km", "g/s", "l", "lambda"},
+	}
+)
+
+var BuiltinUnitProfiles = map[string]UnitProfile{
+	UnitProfileMetric.Name:   UnitProfileMetric,
+	UnitProfileImperial.Name: UnitProfileImperial,
+	UnitProfilePsiBoost.Name: UnitProfilePsiBoost,
+}
+
+// SelectUnits returns the unit this profile prefers for param, or the unit of
+// its first conversion when none of the profile's units are available.
+func (u UnitProfile) SelectUnits(param Ssm2Parameter) string {
+	for _, preferred := range u.Units {
+		if conversion, ok := param.FindConversion(preferred); ok {
+			return conversion.Units
+		}
+	}
+	return DefaultUnits(param)
+}
+
+// DefaultUnits is the unit of the first conversion listed in the definitions.
+func DefaultUnits(param Ssm2Parameter) string {
+	if len(param.Conversions) > 0 {
+		return param.Conversions[0].Units
+	}
+	return ""
+}
+
+// FindConversion looks for a conversion by unit, preferring an exact match
+// and falling back to a case-insensitive one so "f" finds "F".
+func (p Ssm2Parameter) FindConversion(unit string) (Ssm2ParameterConversion, bool) {
+	for _, conversion := range p.Conversions {
+		if conversion.Units == unit {
+			return conversion, true
+		}
+	}
+	for _, conversion := range p.Conversions {
+		if strings.EqualFold(conversion.Units, unit) {
+			return conversion, true
+		}
+	}
+	return Ssm2ParameterConversion{}, false
+}
+
+// AvailableUnits lists every unit the parameter can be converted to.
+func (p Ssm2Parameter) AvailableUnits() []string {
+	units := []string{}
+	for _, conversion := range p.Conversions {
+		units = append(units, conversion.Units)
+	}
+	return units
+}
+
+// ResolveUnits checks unit against the parameter's conversions and returns the
+// spelling used in the definitions.
+func (p Ssm2Parameter) ResolveUnits(unit string) (string, error) {
+	conversion, ok := p.FindConversion(unit)
+	if !ok {
+		return "", fmt.Errorf("%s has no conversion with unit %q; available units: %s", p.Name, unit, strings.Join(p.AvailableUnits(), ", "))
+	}
+	return conversion.Units, nil
+}
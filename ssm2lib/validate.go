@@ -0,0 +1,253 @@
+package ssm2lib
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type FindingSeverity string
+
+const (
+	FindingError   FindingSeverity = "error"
+	FindingWarning FindingSeverity = "warning"
+)
+
+// The capability bytes returned by GetCapabilityBytes start with the 3 byte
+// SSM ID and 5 byte ROM ID, so real capability bits start at index 8.
+const capabilityFirstIndex = 8
+
+// DefinitionFinding is a single problem found while validating a logger
+// definitions file.
+type DefinitionFinding struct {
+	Severity FindingSeverity `json:"severity"`
+	Line     int             `json:"line"`
+	Protocol string          `json:"protocol,omitempty"`
+	Id       string          `json:"id,omitempty"`
+	Name     string          `json:"name,omitempty"`
+	Message  string          `json:"message"`
+}
+
+func (f DefinitionFinding) String() string {
+	subject := strings.TrimSpace(fmt.Sprintf("%s %s", f.Id, f.Name))
+	if subject != "" {
+		subject += ": "
+	}
+	return fmt.Sprintf("%d: %s: %s%s", f.Line, f.Severity, subject, f.Message)
+}
+
+type definitionValidator struct {
+	findings []DefinitionFinding
+	protocol string
+	names    map[string]int
+	ids      map[string]int
+	dtcIds   map[string]int
+	sawSsm   bool
+}
+
+func (v *definitionValidator) add(severity FindingSeverity, line int, id string, name string, format string, args ...interface{}) {
+	v.findings = append(v.findings, DefinitionFinding{
+		Severity: severity,
+		Line:     line,
+		Protocol: v.protocol,
+		Id:       id,
+		Name:     name,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// ValidateDefinitions checks a RomRaider logger definitions file and returns
+// every problem found, with the line it was found on. The returned error is
+// only set when the XML itself is malformed.
+func ValidateDefinitions(r io.Reader) ([]DefinitionFinding, error) {
+	decoder := xml.NewDecoder(r)
+	v := &definitionValidator{names: map[string]int{}, ids: map[string]int{}, dtcIds: map[string]int{}}
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			line, _ := decoder.InputPos()
+			return v.findings, fmt.Errorf("line %d: %s", line, err)
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		line, _ := decoder.InputPos()
+		switch start.Name.Local {
+		case "protocol":
+			v.startProtocol(start)
+		case "parameter":
+			param := Ssm2Parameter{}
+			if err := decoder.DecodeElement(&param, &start); err != nil {
+				v.add(FindingError, line, "", "", "unable to read parameter: %s", err)
+				continue
+			}
+			v.checkParameter(line, param)
+		case "dtcode":
+			dtc := Ssm2Dtc{}
+			if err := decoder.DecodeElement(&dtc, &start); err != nil {
+				v.add(FindingError, line, "", "", "unable to read DTC: %s", err)
+				continue
+			}
+			v.checkDtc(line, dtc, start)
+		}
+	}
+
+	if !v.sawSsm {
+		v.protocol = ""
+		v.add(FindingError, 0, "", "", "no protocol with id \"SSM\" found")
+	}
+	return v.findings, nil
+}
+
+func (v *definitionValidator) startProtocol(start xml.StartElement) {
+	v.protocol = ""
+	for _, attr := range start.Attr {
+		if attr.Name.Local == "id" {
+			v.protocol = attr.Value
+		}
+	}
+	if v.protocol == "SSM" {
+		v.sawSsm = true
+	}
+	v.names = map[string]int{}
+	v.ids = map[string]int{}
+	v.dtcIds = map[string]int{}
+}
+
+func (v *definitionValidator) checkParameter(line int, param Ssm2Parameter) {
+	if param.Id == "" {
+		v.add(FindingError, line, param.Id, param.Name, "parameter has no id")
+	} else if first, ok := v.ids[param.Id]; ok {
+		v.add(FindingError, line, param.Id, param.Name, "duplicate parameter id, first defined on line %d", first)
+	} else {
+		v.ids[param.Id] = line
+	}
+	if param.Name == "" {
+		v.add(FindingError, line, param.Id, param.Name, "parameter has no name")
+	} else if first, ok := v.names[strings.ToLower(param.Name)]; ok {
+		v.add(FindingError, line, param.Id, param.Name, "duplicate parameter name, first defined on line %d", first)
+	} else {
+		v.names[strings.ToLower(param.Name)] = line
+	}
+
+	if !param.IsDerived() {
+		v.checkAddress(line, param)
+		v.checkCapability(line, param)
+	}
+	v.checkConversions(line, param)
+}
+
+func (v *definitionValidator) checkAddress(line int, param Ssm2Parameter) {
+	address, err := param.Address.GetAddressBytes()
+	if err != nil {
+		v.add(FindingError, line, param.Id, param.Name, "invalid address %q: %s", param.Address.Address, err)
+		return
+	}
+	if v.protocol != "SSM" {
+		return
+	}
+	if len(address) != 3 {
+		v.add(FindingError, line, param.Id, param.Name, "address %s is %d bytes, expected 3", param.Address.Address, len(address))
+		return
+	}
+	if param.Address.Length < 0 {
+		v.add(FindingError, line, param.Id, param.Name, "address length %d is negative", param.Address.Length)
+		return
+	}
+	if _, err := ExpandAddress(address, ParameterLength(param)-1); err != nil {
+		v.add(FindingError, line, param.Id, param.Name, "address %s with length %d: %s", param.Address.Address, param.Address.Length, err)
+	}
+}
+
+func (v *definitionValidator) checkCapability(line int, param Ssm2Parameter) {
+	if v.protocol != "SSM" {
+		return
+	}
+	if param.EcuBit > 7 {
+		v.add(FindingError, line, param.Id, param.Name, "ecubit %d is out of range 0-7", param.EcuBit)
+	}
+	if param.EcuByteIndex < capabilityFirstIndex {
+		v.add(FindingWarning, line, param.Id, param.Name, "ecubyteindex %d points into the SSM/ROM ID, capability bytes start at %d", param.EcuByteIndex, capabilityFirstIndex)
+	} else if int(param.EcuByteIndex) >= Ssm2PacketMaxSize-Ssm2PacketMinSize {
+		v.add(FindingError, line, param.Id, param.Name, "ecubyteindex %d is beyond the largest possible init response", param.EcuByteIndex)
+	}
+}
+
+func (v *definitionValidator) checkConversions(line int, param Ssm2Parameter) {
+	if len(param.Conversions) == 0 {
+		v.add(FindingWarning, line, param.Id, param.Name, "parameter has no conversions")
+	}
+	depends := map[string]bool{}
+	for _, ref := range param.Depends {
+		depends[ref.Parameter] = true
+	}
+	units := map[string]bool{}
+	for _, conversion := range param.Conversions {
+		if units[conversion.Units] {
+			v.add(FindingWarning, line, param.Id, param.Name, "duplicate conversion unit %q", conversion.Units)
+		}
+		units[conversion.Units] = true
+
+		compiled, err := CompileConversion(conversion)
+		if err != nil {
+			v.add(FindingError, line, param.Id, param.Name, "%s", err)
+			continue
+		}
+		for _, variable := range compiled.expr.Vars() {
+			ref := strings.SplitN(variable, ":", 2)[0]
+			if param.IsDerived() && !depends[ref] {
+				v.add(FindingError, line, param.Id, param.Name, "conversion %q references %s, which is not listed in depends", conversion.Units, variable)
+			} else if !param.IsDerived() && variable != "x" {
+				v.add(FindingError, line, param.Id, param.Name, "conversion %q references unknown variable %s", conversion.Units, variable)
+			}
+		}
+		if conversion.GaugeMin > conversion.GaugeMax {
+			v.add(FindingWarning, line, param.Id, param.Name, "conversion %q has gauge_min %v above gauge_max %v", conversion.Units, conversion.GaugeMin, conversion.GaugeMax)
+		}
+		switch conversion.StorageType {
+		case "", "uint8", "uint16", "uint32", "int8", "int16", "int32", "float":
+		default:
+			v.add(FindingWarning, line, param.Id, param.Name, "conversion %q has unknown storagetype %q", conversion.Units, conversion.StorageType)
+		}
+	}
+}
+
+func (v *definitionValidator) checkDtc(line int, dtc Ssm2Dtc, start xml.StartElement) {
+	if dtc.Id == "" {
+		v.add(FindingError, line, dtc.Id, dtc.Name, "DTC has no id")
+	} else if first, ok := v.dtcIds[dtc.Id]; ok {
+		v.add(FindingError, line, dtc.Id, dtc.Name, "duplicate DTC id, first defined on line %d", first)
+	} else {
+		v.dtcIds[dtc.Id] = line
+	}
+
+	if tmp, err := dtc.GetTmpAddressBytes(); err != nil {
+		v.add(FindingError, line, dtc.Id, dtc.Name, "invalid tmpaddr %q: %s", dtc.TmpAddr, err)
+	} else if len(tmp) != 3 {
+		v.add(FindingError, line, dtc.Id, dtc.Name, "tmpaddr %s is %d bytes, expected 3", dtc.TmpAddr, len(tmp))
+	}
+	if mem, err := dtc.GetMemAddressBytes(); err != nil {
+		v.add(FindingError, line, dtc.Id, dtc.Name, "invalid memaddr %q: %s", dtc.MemAddr, err)
+	} else if len(mem) != 3 {
+		v.add(FindingError, line, dtc.Id, dtc.Name, "memaddr %s is %d bytes, expected 3", dtc.MemAddr, len(mem))
+	}
+
+	hasBit := false
+	for _, attr := range start.Attr {
+		if attr.Name.Local == "bit" {
+			hasBit = true
+		}
+	}
+	if !hasBit {
+		v.add(FindingWarning, line, dtc.Id, dtc.Name, "DTC has no bit attribute, bit 0 will be used")
+	} else if dtc.Bit > 7 {
+		v.add(FindingError, line, dtc.Id, dtc.Name, "bit %d is out of range 0-7", dtc.Bit)
+	}
+}
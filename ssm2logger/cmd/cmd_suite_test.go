@@ -0,0 +1,23 @@
+package cmd
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestCmd(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Cmd Suite")
+}
+
+// logs records what every spec logs.
+var logs *test.Hook
+
+var _ = BeforeEach(func() {
+	logger, logs = test.NewNullLogger()
+	logger.SetLevel(log.DebugLevel)
+})
@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	. "github.com/nanoadmin/go-ssm2logger/ssm2lib"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var decodeCmd = &cobra.Command{
+	Use:   "decode <raw log>",
+	Short: "Convert a raw log recorded with --sink raw into any output format",
+	Long: `Runs the payloads of a raw log through the conversions of --defs and writes
+them like log would, so a drive can be decoded again after fixing a conversion
+expression. The protocol and the logged parameters and units come from the
+raw log; each parameter is looked up by ID and must still have the same
+length. Like defs, it doesn't need --port or an ECU.
+
+  ssm2logger decode logs/1234567890-1717243200-log.ssm2raw \
+    --defs logger_fixed.xml --sink csv:./decoded
+
+Every sink waits for room instead of dropping samples when it falls behind,
+unless its spec sets another policy. Files are named like the ones written
+while logging, so decode into another directory; existing files are never
+overwritten.`,
+	Args: cobra.ExactArgs(1),
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		setupLogger()
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// There's no ECU to keep up with, so nothing needs to be dropped
+		sinks, err := newLogSinkSet(cmd, policyBlock)
+		if err != nil {
+			return err
+		}
+		for _, state := range sinks.sinks {
+			if _, ok := state.sink.(*rawSink); ok {
+				return fmt.Errorf("decode can't write raw logs, it would overwrite its input")
+			}
+		}
+		if err := validatePlausibilityMode(plausibilityMode); err != nil {
+			return err
+		}
+
+		file, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		reader, err := NewRawLogReader(file)
+		if err != nil {
+			return fmt.Errorf("%s: %s", args[0], err)
+		}
+		header := reader.Header
+		protocolId = header.Info.Protocol
+
+		defsHash, err := DefinitionsHash(append([]string{defsPath}, overlayPaths...)...)
+		if err != nil {
+			return err
+		}
+		defsVersion, err := readDefinitionsVersion(defsPath)
+		if err != nil {
+			return err
+		}
+		if defsHash != header.DefinitionsHash {
+			logger.WithFields(log.Fields{"logged_with": header.DefinitionsVersion, "decoding_with": defsVersion}).Info("Decoding with different definitions than the log was recorded with")
+		}
+		logDefs, err := loadLoggerDefinitions(defsPath)
+		if err != nil {
+			return err
+		}
+		all, err := applyOverlays(getProtocolParameters(logDefs), overlayPaths)
+		if err != nil {
+			return err
+		}
+		mappings, err := header.Remap(all)
+		if err != nil {
+			return err
+		}
+
+		computed, err := loadComputedChannels(computedSpecs)
+		if err != nil {
+			return err
+		}
+		decoder, err := newSampleDecoder(mappings, computed, plausibilityMode, plausibilityMargin, disableAfterErrors)
+		if err != nil {
+			return err
+		}
+		defer decoder.LogSummary()
+
+		if err := sinks.Open(sinkSession{
+			Info:               &header.Info,
+			Columns:            decoder.Columns(),
+			Plausibility:       plausibilityMode,
+			Started:            header.Started,
+			DefinitionsVersion: defsVersion,
+			DefinitionsHash:    defsHash,
+			Mappings:           mappings,
+		}); err != nil {
+			return err
+		}
+		defer sinks.Close()
+
+		payloadLength := PayloadLength(mappings)
+		frames := 0
+		for {
+			frame, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				logger.WithFields(log.Fields{"frames": frames}).Warn("The raw log ends partway through a frame, decoded up to it")
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %s", args[0], err)
+			}
+			frames++
+			if frame.Corrupt {
+				sinks.Write(corruptFrameMarker(frame.Time))
+				continue
+			}
+			if len(frame.Payload) != payloadLength {
+				logger.WithFields(log.Fields{"expected_payload": payloadLength, "actual_payload": len(frame.Payload)}).Debug("Skipping sample due to unexpected payload length")
+				sinks.Write(skippedPayloadMarker(frame.Time, len(frame.Payload)))
+				continue
+			}
+			sinks.Write(sample{Time: frame.Time, Payload: frame.Payload, Values: decoder.Decode(frame.Payload)})
+		}
+		logger.WithFields(log.Fields{"frames": frames}).Info("Decoded raw log")
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(decodeCmd)
+
+	// The output flags are shared with log, which the sinks read
+	decodeCmd.Flags().StringVar(&logfile_path, "logfile-path", ".", "Directory for csv, romraider-csv, parquet and mlg output")
+	decodeCmd.Flags().StringVar(&defsPath, "defs", "logger_STD_EN_v336.xml", "Path to RomRaider logger definition XML")
+	decodeCmd.Flags().StringArrayVar(&overlayPaths, "overlay", nil, "YAML or XML file of extra parameters merged with --defs. May be repeated")
+	decodeCmd.Flags().StringVar(&logFormat, "format", "csv", "Output format: csv, ndjson or romraider-csv")
+	decodeCmd.Flags().StringArrayVar(&sinkSpecs, "sink", nil, "Output as kind[:target][;option=value...], like log. May be repeated")
+	decodeCmd.Flags().StringVar(&unixSocketPath, "unix-socket", "", "Unix domain socket path for NDJSON output (requires --format ndjson)")
+	decodeCmd.Flags().StringVar(&plausibilityMode, "plausibility", plausibilityOff, "Check values against the definition's gauge range: off, flag or null")
+	decodeCmd.Flags().Float64Var(&plausibilityMargin, "plausibility-margin", 0.1, "Fraction of the gauge span a value may fall outside the gauge range before it counts as implausible")
+	decodeCmd.Flags().IntVar(&disableAfterErrors, "disable-after-errors", 0, "Stop converting a parameter after this many consecutive conversion errors (0 never disables)")
+	decodeCmd.Flags().StringArrayVar(&computedSpecs, "computed", nil, "Computed channel as name=expression over other channels' NDJSON keys. May be repeated")
+}
@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/nanoadmin/go-ssm2logger/ssm2lib"
+)
+
+var _ = Describe("Decode", func() {
+	var dir string
+	defs := `<logger version="test">
+<protocols>
+<protocol id="SSM" baud="4800">
+<parameters>
+<parameter id="P2" name="Coolant Temperature" ecubyteindex="8" ecubit="6">
+  <address>0x000008</address>
+  <conversions>
+    <conversion units="C" expr="x-40" format="0"/>
+    <conversion units="F" expr="32+9*(x-40)/5" format="0.0"/>
+  </conversions>
+</parameter>
+<parameter id="P8" name="Engine Speed" ecubyteindex="8" ecubit="0">
+  <address length="2">0x00000e</address>
+  <conversions><conversion units="rpm" expr="x/4" format="0"/></conversions>
+</parameter>
+</parameters>
+</protocol>
+</protocols>
+</logger>`
+	started := time.Unix(1717243200, 0)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "decode")
+		Ω(err).ShouldNot(HaveOccurred())
+		defsPath = filepath.Join(dir, "defs.xml")
+		Ω(ioutil.WriteFile(defsPath, []byte(defs), 0644)).Should(Succeed())
+		noDefsCache = true
+		plausibilityMode = plausibilityOff
+		logFormat = "csv"
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+		defsPath, noDefsCache, sinkSpecs, protocolId = "", false, nil, ""
+	})
+
+	It("Writes a raw log as log would have", func() {
+		params := []Ssm2Parameter{
+			{Id: "P2", Name: "Coolant Temperature", Address: Ssm2ParameterAddress{Address: "0x000008"}, Conversions: []Ssm2ParameterConversion{{Units: "C", Expr: "x-40"}, {Units: "F", Expr: "32+9*(x-40)/5"}}},
+			{Id: "P8", Name: "Engine Speed", Address: Ssm2ParameterAddress{Address: "0x00000e", Length: 2}, Conversions: []Ssm2ParameterConversion{{Units: "rpm", Expr: "x/4"}}},
+		}
+		_, mappings, err := BuildSelectionAddressRequest([]ParameterSelection{{Param: params[0], Units: []string{"F"}}, {Param: params[1]}})
+		Ω(err).ShouldNot(HaveOccurred())
+		rawPath := filepath.Join(dir, "0102030405-1717243200-log.ssm2raw")
+		file, err := os.Create(rawPath)
+		Ω(err).ShouldNot(HaveOccurred())
+		writer, err := NewRawLogWriter(file, RawLogHeader{
+			Started:  started,
+			Info:     EcuInfo{Protocol: ProtocolSsm, RomId: []byte{1, 2, 3, 4, 5}},
+			Mappings: NewRawLogMappings(mappings),
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(writer.WriteFrame(RawFrame{Time: started.Add(500 * time.Millisecond), Payload: []byte{0x7c, 0x0c, 0xb0}})).Should(Succeed())
+		Ω(writer.WriteFrame(RawFrame{Time: started.Add(1200 * time.Millisecond), Payload: []byte{0x7d, 0x0d, 0x00}})).Should(Succeed())
+		// The wrong length and corrupt frames are skipped like they are while logging
+		Ω(writer.WriteFrame(RawFrame{Time: started.Add(1300 * time.Millisecond), Payload: []byte{0x7d}})).Should(Succeed())
+		Ω(writer.WriteFrame(RawFrame{Time: started.Add(1400 * time.Millisecond), Payload: []byte{0x7d, 0x0d, 0x00}, Corrupt: true})).Should(Succeed())
+		Ω(writer.WriteFrame(RawFrame{Time: started.Add(2100 * time.Millisecond), Payload: []byte{0x7e, 0x0e, 0x01}})).Should(Succeed())
+		Ω(writer.Flush()).Should(Succeed())
+		Ω(file.Close()).Should(Succeed())
+
+		sinkSpecs = []string{"csv:" + filepath.Join(dir, "decoded")}
+		Ω(os.Mkdir(filepath.Join(dir, "decoded"), 0755)).Should(Succeed())
+		Ω(decodeCmd.RunE(decodeCmd, []string{rawPath})).Should(Succeed())
+
+		decoded, err := ioutil.ReadFile(filepath.Join(dir, "decoded", "0102030405-1717243200-log.csv"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(decoded)).Should(Equal(
+			"timestamp,Coolant Temperature (F),Engine Speed (rpm)\n" +
+				"1717243200,183.2,812\n" +
+				"1717243201,185.0,832\n" +
+				"1717243202,186.8,896\n"))
+	})
+
+	It("Refuses to overwrite the files written while logging", func() {
+		rawPath := filepath.Join(dir, "0102030405-1717243200-log.ssm2raw")
+		file, err := os.Create(rawPath)
+		Ω(err).ShouldNot(HaveOccurred())
+		writer, err := NewRawLogWriter(file, RawLogHeader{Started: started, Info: EcuInfo{Protocol: ProtocolSsm, RomId: []byte{1, 2, 3, 4, 5}}})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(writer.Flush()).Should(Succeed())
+		Ω(file.Close()).Should(Succeed())
+		livePath := filepath.Join(dir, "0102030405-1717243200-log.csv")
+		Ω(ioutil.WriteFile(livePath, []byte("logged live\n"), 0644)).Should(Succeed())
+
+		// Next to the raw log, as the default --logfile-path of . would be
+		sinkSpecs = []string{"csv:" + dir}
+		err = decodeCmd.RunE(decodeCmd, []string{rawPath})
+		Ω(errors.Is(err, errLogExists)).Should(BeTrue())
+		Ω(err).Should(MatchError(ContainSubstring("not overwriting " + livePath)))
+		live, err := ioutil.ReadFile(livePath)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(live)).Should(Equal("logged live\n"))
+	})
+
+	It("Keeps every sample unless a sink asks otherwise", func() {
+		sinkSpecs = []string{"ndjson", "influx", "csv:" + dir + ";policy=drop-newest"}
+		sinks, err := newLogSinkSet(decodeCmd, policyBlock)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(sinks.sinks[0].queue.policy).Should(Equal(policyBlock))
+		Ω(sinks.sinks[1].queue.policy).Should(Equal(policyBlock))
+		Ω(sinks.sinks[2].queue.policy).Should(Equal(policyDropNewest))
+
+		// While logging they keep their own defaults
+		sinks, err = newLogSinkSet(logCmd, "")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(sinks.sinks[0].queue.policy).Should(Equal(policyDropOldest))
+	})
+})
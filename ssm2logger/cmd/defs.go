@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	. "github.com/nanoadmin/go-ssm2logger/ssm2lib"
+	"github.com/spf13/cobra"
+)
+
+var defsDefsPath string
+var defsFormat string
+var defsOverlayPaths []string
+
+// defsCmd groups the commands that work on the definitions file alone, so
+// unlike the rest they don't need --port or an ECU.
+var defsCmd = &cobra.Command{
+	Use:   "defs",
+	Short: "Inspect RomRaider logger definitions without an ECU connected",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		setupLogger()
+		return nil
+	},
+}
+
+var defsValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Check a logger definitions file for problems that would only show up mid-drive",
+	Long: `Parses the definitions file and reports every problem found with its line
+number: malformed or overflowing addresses, conversion expressions that don't
+compile, ecubyteindex/ecubit values out of range, duplicate parameter names and
+IDs, and DTC address problems. Overlay files are checked too.
+
+Exits non-zero when any errors (not just warnings) were found.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := validateDefsOutputFormat(); err != nil {
+			return err
+		}
+
+		xmlfile, err := os.Open(defsDefsPath)
+		if err != nil {
+			return err
+		}
+		defer xmlfile.Close()
+
+		findings, err := ValidateDefinitions(xmlfile)
+		if err != nil {
+			findings = append(findings, DefinitionFinding{Severity: FindingError, Message: err.Error()})
+		}
+		findings = append(findings, validateOverlays(defsDefsPath, defsOverlayPaths)...)
+
+		errorCount := 0
+		encoder := json.NewEncoder(os.Stdout)
+		for _, finding := range findings {
+			if finding.Severity == FindingError {
+				errorCount++
+			}
+			switch defsFormat {
+			case "ndjson":
+				if err := encoder.Encode(finding); err != nil {
+					return err
+				}
+			case "text":
+				fmt.Printf("%s:%s\n", defsDefsPath, finding)
+			}
+		}
+
+		switch defsFormat {
+		case "text":
+			fmt.Printf("%d errors, %d warnings\n", errorCount, len(findings)-errorCount)
+		case "json":
+			if err := printIndentedJson(findings); err != nil {
+				return err
+			}
+		}
+		if errorCount > 0 {
+			cmd.SilenceUsage = true
+			cmd.SilenceErrors = true
+			return fmt.Errorf("%s has %d errors", defsDefsPath, errorCount)
+		}
+		return nil
+	},
+}
+
+// validateOverlays reports overlay files that fail to load or conflict with
+// the definitions. Overlay problems don't have line numbers.
+func validateOverlays(defsPath string, overlayPaths []string) []DefinitionFinding {
+	if len(overlayPaths) == 0 {
+		return nil
+	}
+	logDefs, err := loadLoggerDefinitions(defsPath)
+	if err != nil {
+		return []DefinitionFinding{{Severity: FindingError, Message: err.Error()}}
+	}
+	if _, err := applyOverlays(getProtocolParameters(logDefs), overlayPaths); err != nil {
+		return []DefinitionFinding{{Severity: FindingError, Protocol: "SSM", Message: err.Error()}}
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(defsCmd)
+	defsCmd.AddCommand(defsValidateCmd)
+
+	defsCmd.PersistentFlags().StringVar(&defsDefsPath, "defs", "logger_STD_EN_v336.xml", "Path to RomRaider logger definition XML")
+	defsCmd.PersistentFlags().StringVar(&defsFormat, "format", "text", "Output format: text, json or ndjson")
+	defsCmd.PersistentFlags().StringArrayVar(&defsOverlayPaths, "overlay", nil, "YAML or XML file of extra parameters merged with --defs. May be repeated")
+}
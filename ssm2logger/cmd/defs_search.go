@@ -0,0 +1,379 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	. "github.com/nanoadmin/go-ssm2logger/ssm2lib"
+	"github.com/spf13/cobra"
+)
+
+var defsSearchUnit string
+var defsSearchTarget string
+var defsSearchEcuByteIndex int
+var defsSearchLimit int
+
+type defConversionOutput struct {
+	Units       string  `json:"units"`
+	Expr        string  `json:"expr"`
+	Format      string  `json:"format,omitempty"`
+	StorageType string  `json:"storage_type,omitempty"`
+	GaugeMin    float64 `json:"gauge_min"`
+	GaugeMax    float64 `json:"gauge_max"`
+	GaugeStep   float64 `json:"gauge_step"`
+}
+
+type defParamOutput struct {
+	Id           string                `json:"id"`
+	Name         string                `json:"name"`
+	Description  string                `json:"desc,omitempty"`
+	Address      string                `json:"address,omitempty"`
+	Addresses    []string              `json:"addresses,omitempty"`
+	Length       int                   `json:"length"`
+	EcuByteIndex uint                  `json:"ecu_byte_index"`
+	EcuBit       uint                  `json:"ecu_bit"`
+	Target       string                `json:"target"`
+	Ungated      bool                  `json:"ungated,omitempty"`
+	Conversions  []defConversionOutput `json:"conversions"`
+	Depends      []string              `json:"depends,omitempty"`
+	UsedBy       []string              `json:"used_by,omitempty"`
+}
+
+var defsSearchCmd = &cobra.Command{
+	Use:   "search <query>",
+	Short: "Fuzzy search parameter names and descriptions",
+	Long: `Fuzzy searches the parameters of the definitions file (and overlays) by
+name and description. An empty query lists everything that matches the filters.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := validateDefsOutputFormat(); err != nil {
+			return err
+		}
+		params, err := loadDefsParameters()
+		if err != nil {
+			return err
+		}
+
+		query := ""
+		if len(args) > 0 {
+			query = args[0]
+		}
+
+		results := []defParamOutput{}
+		for _, param := range searchParameters(params, query) {
+			results = append(results, describeParameter(param, params))
+		}
+
+		switch defsFormat {
+		case "json":
+			return printIndentedJson(results)
+		case "ndjson":
+			encoder := json.NewEncoder(os.Stdout)
+			for _, result := range results {
+				if err := encoder.Encode(result); err != nil {
+					return err
+				}
+			}
+		default:
+			for _, result := range results {
+				units := []string{}
+				for _, conversion := range result.Conversions {
+					units = append(units, conversion.Units)
+				}
+				address := result.Address
+				if address == "" {
+					address = "derived"
+				}
+				fmt.Printf("%-6s %-45s units=%s address=%s\n", result.Id, result.Name, strings.Join(units, ","), address)
+			}
+		}
+		return nil
+	},
+}
+
+var defsShowCmd = &cobra.Command{
+	Use:   "show <id|name>",
+	Short: "Show everything the definitions say about a parameter",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := validateDefsOutputFormat(); err != nil {
+			return err
+		}
+		params, err := loadDefsParameters()
+		if err != nil {
+			return err
+		}
+
+		param, ok := findParameterByIdOrName(params, args[0])
+		if !ok {
+			suggestions := []string{}
+			for _, p := range params {
+				if searchScore(args[0], p) > 0 {
+					suggestions = append(suggestions, fmt.Sprintf("%s (%s)", p.Name, p.Id))
+				}
+				if len(suggestions) == 5 {
+					break
+				}
+			}
+			if len(suggestions) > 0 {
+				return fmt.Errorf("no parameter with id or name %q; did you mean: %s", args[0], strings.Join(suggestions, ", "))
+			}
+			return fmt.Errorf("no parameter with id or name %q", args[0])
+		}
+
+		out := describeParameter(param, params)
+		if defsFormat != "text" {
+			return printIndentedJson(out)
+		}
+
+		fmt.Printf("id:             %s\n", out.Id)
+		fmt.Printf("name:           %s\n", out.Name)
+		fmt.Printf("description:    %s\n", out.Description)
+		fmt.Printf("target:         %s\n", out.Target)
+		if param.IsDerived() {
+			fmt.Printf("depends:        %s\n", strings.Join(out.Depends, ", "))
+		} else {
+			fmt.Printf("address:        %s\n", out.Address)
+			fmt.Printf("length:         %d (%s)\n", out.Length, strings.Join(out.Addresses, " "))
+			if out.Ungated {
+				fmt.Printf("capability:     none (overlay, always requested)\n")
+			} else {
+				fmt.Printf("capability:     ecubyteindex=%d ecubit=%d\n", out.EcuByteIndex, out.EcuBit)
+			}
+		}
+		if len(out.UsedBy) > 0 {
+			fmt.Printf("used by:        %s\n", strings.Join(out.UsedBy, ", "))
+		}
+		fmt.Printf("conversions:\n")
+		for _, conversion := range out.Conversions {
+			fmt.Printf("  %-8s expr=%q format=%q storagetype=%q gauge=%v..%v step %v\n", conversion.Units, conversion.Expr, conversion.Format, conversion.StorageType, conversion.GaugeMin, conversion.GaugeMax, conversion.GaugeStep)
+		}
+		return nil
+	},
+}
+
+func validateDefsOutputFormat() error {
+	switch defsFormat {
+	case "text", "json", "ndjson":
+		return nil
+	}
+	return fmt.Errorf("unsupported format %q; expected text, json or ndjson", defsFormat)
+}
+
+func loadDefsParameters() ([]Ssm2Parameter, error) {
+	logDefs, err := loadLoggerDefinitions(defsDefsPath)
+	if err != nil {
+		return nil, err
+	}
+	return applyOverlays(getProtocolParameters(logDefs), defsOverlayPaths)
+}
+
+func printIndentedJson(v interface{}) error {
+	js, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(js))
+	return nil
+}
+
+func findParameterByIdOrName(params []Ssm2Parameter, idOrName string) (Ssm2Parameter, bool) {
+	for _, param := range params {
+		if strings.EqualFold(param.Id, idOrName) {
+			return param, true
+		}
+	}
+	for _, param := range params {
+		if strings.EqualFold(param.Name, idOrName) {
+			return param, true
+		}
+	}
+	return Ssm2Parameter{}, false
+}
+
+func matchesDefsFilters(param Ssm2Parameter) bool {
+	if defsSearchUnit != "" {
+		if _, ok := param.FindConversion(defsSearchUnit); !ok {
+			return false
+		}
+	}
+	if defsSearchTarget != "" && !targetMatches(param.Target, defsSearchTarget) {
+		return false
+	}
+	if defsSearchEcuByteIndex >= 0 && (param.Ungated || param.IsDerived() || param.EcuByteIndex != uint(defsSearchEcuByteIndex)) {
+		return false
+	}
+	return true
+}
+
+// RomRaider targets are a bit field: 1 is the ECU, 2 the TCU.
+func targetName(target uint) string {
+	switch target {
+	case 1:
+		return "ecu"
+	case 2:
+		return "tcu"
+	case 3:
+		return "ecu,tcu"
+	default:
+		return strconv.Itoa(int(target))
+	}
+}
+
+func targetMatches(target uint, filter string) bool {
+	switch strings.ToLower(filter) {
+	case "ecu":
+		return target&1 > 0
+	case "tcu":
+		return target&2 > 0
+	}
+	value, err := strconv.Atoi(filter)
+	return err == nil && uint(value) == target
+}
+
+// searchParameters returns the parameters that match the query and the
+// search flags, best match first and at most --limit of them.
+func searchParameters(params []Ssm2Parameter, query string) []Ssm2Parameter {
+	type match struct {
+		param Ssm2Parameter
+		score int
+	}
+	matches := []match{}
+	for _, param := range params {
+		if !matchesDefsFilters(param) {
+			continue
+		}
+		score := searchScore(query, param)
+		if score > 0 {
+			matches = append(matches, match{param: param, score: score})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].score > matches[j].score
+	})
+	if defsSearchLimit > 0 && len(matches) > defsSearchLimit {
+		matches = matches[:defsSearchLimit]
+	}
+
+	results := []Ssm2Parameter{}
+	for _, m := range matches {
+		results = append(results, m.param)
+	}
+	return results
+}
+
+// searchScore ranks how well a parameter matches a query; 0 means no match.
+// Exact and prefix name matches rank highest, then substrings of the name,
+// then every query word appearing in the name or description, then the
+// query's letters appearing in order in the name.
+func searchScore(query string, param Ssm2Parameter) int {
+	q := strings.ToLower(strings.TrimSpace(query))
+	if q == "" {
+		return 1
+	}
+	name := strings.ToLower(param.Name)
+	desc := strings.ToLower(param.Description)
+	switch {
+	case name == q || strings.ToLower(param.Id) == q:
+		return 1000
+	case strings.HasPrefix(name, q):
+		return 800
+	case strings.Contains(name, q):
+		return 600
+	}
+
+	words := strings.Fields(q)
+	allWords := true
+	inName := 0
+	for _, word := range words {
+		if strings.Contains(name, word) {
+			inName++
+		} else if !strings.Contains(desc, word) {
+			allWords = false
+		}
+	}
+	if allWords {
+		return 300 + 100*inName/len(words)
+	}
+
+	// Subsequence match, favouring tighter matches
+	pos := 0
+	gaps := 0
+	for _, r := range strings.Replace(q, " ", "", -1) {
+		idx := strings.IndexRune(name[pos:], r)
+		if idx < 0 {
+			return 0
+		}
+		gaps += idx
+		pos += idx + 1
+	}
+	score := 200 - gaps
+	if score < 1 {
+		score = 1
+	}
+	return score
+}
+
+func describeParameter(param Ssm2Parameter, all []Ssm2Parameter) defParamOutput {
+	out := defParamOutput{
+		Id:           param.Id,
+		Name:         param.Name,
+		Description:  param.Description,
+		EcuByteIndex: param.EcuByteIndex,
+		EcuBit:       param.EcuBit,
+		Target:       targetName(param.Target),
+		Ungated:      param.Ungated,
+	}
+	if !param.IsDerived() {
+		out.Address = param.Address.Address
+		out.Length = ParameterLength(param)
+		if base, err := param.Address.GetAddressBytes(); err == nil {
+			for i := 0; i < out.Length; i++ {
+				if addr, err := ExpandAddress(base, i); err == nil {
+					out.Addresses = append(out.Addresses, fmt.Sprintf("0x%x", addr))
+				}
+			}
+		}
+	}
+	for _, conversion := range param.Conversions {
+		out.Conversions = append(out.Conversions, defConversionOutput{
+			Units:       conversion.Units,
+			Expr:        conversion.Expr,
+			Format:      conversion.Format,
+			StorageType: conversion.StorageType,
+			GaugeMin:    conversion.GaugeMin,
+			GaugeMax:    conversion.GaugeMax,
+			GaugeStep:   conversion.GaugeStep,
+		})
+	}
+
+	names := map[string]string{}
+	for _, p := range all {
+		names[p.Id] = p.Name
+	}
+	for _, ref := range param.Depends {
+		out.Depends = append(out.Depends, fmt.Sprintf("%s (%s)", ref.Parameter, names[ref.Parameter]))
+	}
+	for _, p := range all {
+		for _, ref := range p.Depends {
+			if ref.Parameter == param.Id {
+				out.UsedBy = append(out.UsedBy, fmt.Sprintf("%s (%s)", p.Id, p.Name))
+			}
+		}
+	}
+	return out
+}
+
+func init() {
+	defsCmd.AddCommand(defsSearchCmd)
+	defsCmd.AddCommand(defsShowCmd)
+
+	defsSearchCmd.Flags().StringVar(&defsSearchUnit, "unit", "", "Only parameters with a conversion to this unit")
+	defsSearchCmd.Flags().StringVar(&defsSearchTarget, "target", "", "Only parameters for this target device: ecu, tcu or the numeric target")
+	defsSearchCmd.Flags().IntVar(&defsSearchEcuByteIndex, "ecubyteindex", -1, "Only parameters gated by this capability byte")
+	defsSearchCmd.Flags().IntVar(&defsSearchLimit, "limit", 0, "Maximum number of results (0 for all)")
+}
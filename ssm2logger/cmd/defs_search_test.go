@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	. "github.com/nanoadmin/go-ssm2logger/ssm2lib"
+)
+
+var _ = Describe("Defs search", func() {
+	params := []Ssm2Parameter{
+		{Id: "P8", Name: "Engine Speed", Description: "Engine speed in revolutions per minute", Target: 1, EcuByteIndex: 8, EcuBit: 0,
+			Conversions: []Ssm2ParameterConversion{{Units: "rpm"}}},
+		{Id: "P2", Name: "Coolant Temperature", Description: "Engine coolant temperature", Target: 1, EcuByteIndex: 8, EcuBit: 6,
+			Conversions: []Ssm2ParameterConversion{{Units: "C"}, {Units: "F"}}},
+		{Id: "P7", Name: "Manifold Absolute Pressure", Description: "Boost", Target: 3, EcuByteIndex: 9, EcuBit: 1,
+			Conversions: []Ssm2ParameterConversion{{Units: "psi"}, {Units: "bar"}}},
+		{Id: "P90", Name: "Transmission Temperature", Target: 2, EcuByteIndex: 40, EcuBit: 2,
+			Conversions: []Ssm2ParameterConversion{{Units: "C"}}},
+		{Id: "P200", Name: "Engine Load (Calculated)", Target: 1, EcuByteIndex: 8,
+			Depends: []Ssm2ParameterRef{{Parameter: "P8"}}, Conversions: []Ssm2ParameterConversion{{Units: "%"}}},
+		{Id: "X1", Name: "Boost Target", Target: 1, Ungated: true,
+			Conversions: []Ssm2ParameterConversion{{Units: "psi"}}},
+	}
+	ids := func(found []Ssm2Parameter) []string {
+		retval := []string{}
+		for _, param := range found {
+			retval = append(retval, param.Id)
+		}
+		return retval
+	}
+
+	BeforeEach(func() {
+		defsSearchUnit, defsSearchTarget, defsSearchEcuByteIndex, defsSearchLimit = "", "", -1, 0
+	})
+	AfterEach(func() {
+		defsSearchUnit, defsSearchTarget, defsSearchEcuByteIndex, defsSearchLimit = "", "", -1, 0
+	})
+
+	table.DescribeTable("Scores a query against a parameter",
+		func(query string, param int, score int) {
+			Ω(searchScore(query, params[param])).Should(Equal(score))
+		},
+		table.Entry("exact name", "engine speed", 0, 1000),
+		table.Entry("ID", "p8", 0, 1000),
+		table.Entry("name prefix", "engine", 0, 800),
+		table.Entry("name substring", "speed", 0, 600),
+		table.Entry("every word in the description", "revolutions minute", 0, 300),
+		table.Entry("words split between name and description", "speed revolutions", 0, 350),
+		table.Entry("letters in order, less the letters skipped", "cltmp", 1, 193),
+		table.Entry("no match", "xyz", 0, 0),
+		table.Entry("empty query", "", 3, 1),
+	)
+
+	table.DescribeTable("Filters and ranks parameters",
+		func(query string, setup func(), expected []string) {
+			setup()
+			Ω(ids(searchParameters(params, query))).Should(Equal(expected))
+		},
+		table.Entry("prefix matches before description matches", "engine", func() {}, []string{"P8", "P200", "P2"}),
+		table.Entry("name before description", "boost", func() {}, []string{"X1", "P7"}),
+		table.Entry("unit", "", func() { defsSearchUnit = "psi" }, []string{"P7", "X1"}),
+		table.Entry("unit regardless of case", "", func() { defsSearchUnit = "c" }, []string{"P2", "P90"}),
+		table.Entry("ecu target", "", func() { defsSearchTarget = "ecu" }, []string{"P8", "P2", "P7", "P200", "X1"}),
+		table.Entry("tcu target", "", func() { defsSearchTarget = "TCU" }, []string{"P7", "P90"}),
+		table.Entry("numeric target", "", func() { defsSearchTarget = "3" }, []string{"P7"}),
+		table.Entry("capability byte, leaving out derived and ungated parameters", "", func() { defsSearchEcuByteIndex = 8 }, []string{"P8", "P2"}),
+		table.Entry("filters and a query together", "temperature", func() { defsSearchUnit = "C"; defsSearchTarget = "ecu" }, []string{"P2"}),
+		table.Entry("limit", "", func() { defsSearchLimit = 2 }, []string{"P8", "P2"}),
+	)
+
+	It("Lists what a parameter depends on and what uses it", func() {
+		Ω(describeParameter(params[4], params).Depends).Should(Equal([]string{"P8 (Engine Speed)"}))
+		Ω(describeParameter(params[0], params).UsedBy).Should(Equal([]string{"P200 (Engine Load (Calculated))"}))
+		Ω(describeParameter(params[0], params).Target).Should(Equal("ecu"))
+		Ω(describeParameter(params[2], params).Target).Should(Equal("ecu,tcu"))
+	})
+})
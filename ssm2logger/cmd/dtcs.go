@@ -16,8 +16,10 @@ package cmd
 
 import (
 	"encoding/xml"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 
 	. "github.com/nanoadmin/go-ssm2logger/ssm2lib"
 	log "github.com/sirupsen/logrus"
@@ -52,11 +54,19 @@ to quickly create a Cobra application.`,
 			return err
 		}
 
-		ssm2_conn := &Ssm2Connection{}
-		ssm2_conn.SetLogger(logger)
-
-		ssm2_conn.Open(port)
-		defer ssm2_conn.Close()
+		if !strings.EqualFold(protocolId, ProtocolSsm) {
+			return fmt.Errorf("dtcs only supports the %s protocol", ProtocolSsm)
+		}
+		protocol, err := getProtocol(logDefs)
+		if err != nil {
+			return err
+		}
+		session, err := openSession(protocol)
+		if err != nil {
+			return err
+		}
+		defer session.Close()
+		ssm2_conn := session.(*SsmSession).Conn
 
 		initResponse, err := ssm2_conn.InitEngine()
 		if err != nil {
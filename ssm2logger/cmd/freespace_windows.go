@@ -0,0 +1,16 @@
+package cmd
+
+import "golang.org/x/sys/windows"
+
+// freeSpace is the number of bytes available to us in dir.
+func freeSpace(dir string) (uint64, error) {
+	path, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	if err := windows.GetDiskFreeSpaceEx(path, &free, nil, nil); err != nil {
+		return 0, err
+	}
+	return free, nil
+}
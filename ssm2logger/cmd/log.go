@@ -15,14 +15,11 @@
 package cmd
 
 import (
-	"encoding/csv"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
-	"io"
-	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -37,59 +34,76 @@ var defsPath string
 var logFormat string
 var paramsCsv string
 var allParams bool
+var strictParams bool
 var maxAddresses int
 var unixSocketPath string
-
-type ndjsonSample struct {
-	Ts    int64              `json:"ts"`
-	RomID string             `json:"rom_id"`
-	SsmID string             `json:"ssm_id"`
-	Data  map[string]float64 `json:"data"`
-}
+var unitProfileName string
+var plausibilityMode string
+var plausibilityMargin float64
+var disableAfterErrors int
+var computedSpecs []string
+var overlayPaths []string
+var sinkSpecs []string
+var defsCacheDir string
+var noDefsCache bool
 
 // logCmd represents the log command
 var logCmd = &cobra.Command{
 	Use:   "log",
 	Short: "Logs SSM2 data and writes CSV or NDJSON samples",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		if logFormat != "csv" && logFormat != "ndjson" {
-			return fmt.Errorf("unsupported format %q; expected csv or ndjson", logFormat)
+		sinks, err := newLogSinkSet(cmd, "")
+		if err != nil {
+			return err
 		}
-		if unixSocketPath != "" && logFormat != "ndjson" {
-			return fmt.Errorf("--unix-socket can only be used with --format ndjson")
+		if err := validatePlausibilityMode(plausibilityMode); err != nil {
+			return err
 		}
 
-		logDefs, err := loadLoggerDefinitions(defsPath)
+		// Read up front so a missing file fails before connecting
+		defsKey, defsFiles, err := resolveDefinitionFiles()
 		if err != nil {
 			return err
 		}
-
-		ssm2_conn := &Ssm2Connection{}
-		ssm2_conn.SetLogger(logger)
-
-		if err := ssm2_conn.Open(port); err != nil {
+		session, err := openSession(defsFiles.Protocol)
+		if err != nil {
 			return err
 		}
-		defer ssm2_conn.Close()
+		defer session.Close()
 
-		initResponse, err := ssm2_conn.InitEngine()
+		info, err := session.Init()
 		if err != nil {
 			return err
 		}
+		metrics.initRetries.Add(float64(info.InitRetries))
 
-		allSsmParams := getSsmProtocolParameters(logDefs)
-		supportedParams := getSupportedParameters(allSsmParams, initResponse.GetCapabilityBytes())
+		allSsmParams, supportedParams, err := resolveSupportedParameters(defsKey, session, info)
+		if err != nil {
+			return err
+		}
 
 		logger.WithFields(log.Fields{
-			"SsmId":                  hex.EncodeToString(initResponse.GetSsmId()),
-			"RomId":                  hex.EncodeToString(initResponse.GetRomId()),
+			"Protocol":               info.Protocol,
+			"SsmId":                  hex.EncodeToString(info.SsmId),
+			"RomId":                  info.RomIdString(),
 			"Supported Capabilities": len(supportedParams),
 		}).Info("Initialized ECM")
 
-		selection, err := selectParameters(supportedParams, allParams, paramsCsv, maxAddresses)
+		unitProfile, err := resolveUnitProfile(unitProfileName)
+		if err != nil {
+			return err
+		}
+
+		selection, err := selectParameters(allSsmParams, supportedParams, allParams, paramsCsv, maxAddresses, unitProfile)
 		if err != nil {
 			return err
 		}
+		if len(selection.Unknown) > 0 || len(selection.Unsupported) > 0 {
+			if strictParams {
+				return fmt.Errorf("requested parameters not available: unknown [%s], unsupported by this ECU [%s]", strings.Join(selection.Unknown, ", "), strings.Join(selection.Unsupported, ", "))
+			}
+			logger.WithFields(log.Fields{"unknown": selection.Unknown, "unsupported": selection.Unsupported}).Warn("Some requested parameters matched nothing and were skipped")
+		}
 		if selection.Trimmed {
 			logger.WithFields(log.Fields{"max_addresses": maxAddresses, "selected_params": len(selection.Params), "wanted_addresses": selection.Wanted}).Warn("Requested parameters exceed max address count and were trimmed")
 		}
@@ -97,137 +111,86 @@ var logCmd = &cobra.Command{
 			return fmt.Errorf("no parameters selected; check --params/--all and ECU capability support")
 		}
 
-		addresses, mappings, err := BuildParameterAddressRequest(selection.Params)
-		if err != nil {
-			return err
+		requestedAddressCount := 0
+		for _, selected := range selection.Params {
+			requestedAddressCount += ParameterLength(selected.Param)
 		}
-		if len(addresses) > maxAddresses {
-			return fmt.Errorf("selected params would request %d addresses, which exceeds max of %d", len(addresses), maxAddresses)
+		if requestedAddressCount > maxAddresses {
+			return fmt.Errorf("selected params would request %d addresses, which exceeds max of %d", requestedAddressCount, maxAddresses)
 		}
 
-		// Cooldown between writes
-		time.Sleep(200 * time.Millisecond)
+		computed, err := loadComputedChannels(computedSpecs)
+		if err != nil {
+			return err
+		}
 
 		sigs := make(chan os.Signal, 1)
-		loop := true
+		stop := make(chan struct{})
 		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 		go func() {
-			for sig := range sigs {
-				if sig == syscall.SIGINT || sig == syscall.SIGTERM {
-					loop = false
-				}
-			}
+			<-sigs
+			close(stop)
 		}()
 
-		if _, err := ssm2_conn.ReadAddressesContinous(addresses); err != nil {
+		mappings, err := session.StartLogging(selection.Params)
+		if err != nil {
 			return err
 		}
 
-		if logFormat == "ndjson" {
-			return streamNdjson(ssm2_conn, &loop, initResponse, mappings, len(addresses), unixSocketPath)
-		}
-		return streamCsv(ssm2_conn, &loop, initResponse, mappings, len(addresses))
-	},
-}
-
-func streamCsv(ssm2Conn *Ssm2Connection, loop *bool, initResponse *Ssm2InitResponsePacket, mappings []ParameterMapping, requestedAddressCount int) error {
-	timestamp := time.Now()
-	logfilename := fmt.Sprintf("%s/%s-%d-log.csv", logfile_path, hex.EncodeToString(initResponse.GetRomId()), timestamp.Unix())
-
-	csvfile, err := os.Create(logfilename)
-	if err != nil {
-		return err
-	}
-	defer csvfile.Close()
-
-	writer := csv.NewWriter(csvfile)
-	defer writer.Flush()
-
-	header := []string{"timestamp"}
-	for _, mapping := range mappings {
-		header = append(header, formatHeaderLabel(mapping))
-	}
-	writer.Write(header)
-
-	for *loop {
-		readPacket, err := ssm2Conn.GetNextPacketInStream()
+		decoder, err := newSampleDecoder(mappings, computed, plausibilityMode, plausibilityMargin, disableAfterErrors)
 		if err != nil {
 			return err
 		}
-		payload := readPacket.GetPayloadBytes()
-		if len(payload) != requestedAddressCount {
-			logger.WithFields(log.Fields{"expected_payload": requestedAddressCount, "actual_payload": len(payload)}).Debug("Skipping sample due to unexpected payload length")
-			continue
-		}
-
-		row := []string{fmt.Sprintf("%d", time.Now().Unix())}
-		for _, mapping := range mappings {
-			start := mapping.Start
-			end := start + mapping.Length
-			value := payload[start:end]
-			convertedValue, err := mapping.Param.Convert(mapping.Units, value)
-			if err != nil {
-				return err
-			}
-			row = append(row, fmt.Sprintf("%f", convertedValue))
+		defer decoder.LogSummary()
+
+		if err := sinks.Open(sinkSession{
+			Info:               info,
+			Columns:            decoder.Columns(),
+			Plausibility:       plausibilityMode,
+			Started:            time.Now(),
+			DefinitionsVersion: defsFiles.DefinitionsVersion,
+			DefinitionsHash:    defsFiles.Hash,
+			Mappings:           mappings,
+		}); err != nil {
+			return err
 		}
+		defer sinks.Close()
 
-		writer.Write(row)
-	}
-
-	logger.Info("Received Stop Signal and discontinued logging")
-	return nil
+		return runPipeline(session, stop, decoder, PayloadLength(mappings), sinks)
+	},
 }
 
-func streamNdjson(ssm2Conn *Ssm2Connection, loop *bool, initResponse *Ssm2InitResponsePacket, mappings []ParameterMapping, requestedAddressCount int, socketPath string) error {
-	writer, closeFn, err := ndjsonWriter(socketPath)
-	if err != nil {
-		return err
+// newLogSinkSet checks the output flags and creates the sinks they ask for,
+// with policy as newSinkSet takes it.
+func newLogSinkSet(cmd *cobra.Command, policy string) (*sinkSet, error) {
+	if logFormat != "csv" && logFormat != "ndjson" && logFormat != "romraider-csv" {
+		return nil, fmt.Errorf("unsupported format %q; expected csv, ndjson or romraider-csv", logFormat)
 	}
-	if closeFn != nil {
-		defer closeFn()
+	if unixSocketPath != "" && logFormat != "ndjson" {
+		return nil, fmt.Errorf("--unix-socket can only be used with --format ndjson")
 	}
+	if len(sinkSpecs) > 0 && (cmd.Flags().Changed("format") || unixSocketPath != "") {
+		return nil, fmt.Errorf("--sink replaces --format and --unix-socket; use one or the other")
+	}
+	return newSinkSet(logSinkSpecs(), policy)
+}
 
-	encoder := json.NewEncoder(writer)
-	romID := hex.EncodeToString(initResponse.GetRomId())
-	ssmID := hex.EncodeToString(initResponse.GetSsmId())
-
-	for *loop {
-		readPacket, err := ssm2Conn.GetNextPacketInStream()
-		if err != nil {
-			return err
-		}
-		payload := readPacket.GetPayloadBytes()
-		if len(payload) != requestedAddressCount {
-			logger.WithFields(log.Fields{"expected_payload": requestedAddressCount, "actual_payload": len(payload)}).Debug("Skipping sample due to unexpected payload length")
-			continue
-		}
-
-		data := map[string]float64{}
-		for _, mapping := range mappings {
-			start := mapping.Start
-			end := start + mapping.Length
-			value := payload[start:end]
-			convertedValue, err := mapping.Param.Convert(mapping.Units, value)
-			if err != nil {
-				return err
-			}
-			data[normalizeNdjsonKey(mapping.Name, mapping.Units)] = convertedValue
-		}
-
-		sample := ndjsonSample{
-			Ts:    time.Now().UnixMilli(),
-			RomID: romID,
-			SsmID: ssmID,
-			Data:  data,
-		}
-		if err := encoder.Encode(sample); err != nil {
-			return err
+// logSinkSpecs returns the --sink list, or the single sink described by the
+// older --format/--unix-socket flags when no --sink was given.
+func logSinkSpecs() []string {
+	if len(sinkSpecs) > 0 {
+		return sinkSpecs
+	}
+	if logFormat == "ndjson" {
+		if unixSocketPath != "" {
+			return []string{"ndjson:unix:" + unixSocketPath}
 		}
+		return []string{"ndjson"}
 	}
-
-	logger.Info("Received Stop Signal and discontinued logging")
-	return nil
+	if logFormat == "romraider-csv" {
+		return []string{"romraider-csv:" + logfile_path}
+	}
+	return []string{"csv:" + logfile_path}
 }
 
 func init() {
@@ -235,25 +198,22 @@ func init() {
 
 	logCmd.Flags().StringVar(&logfile_path, "logfile-path", ".", "Path where the logfile will be generated. The actual file will be <logfile-path>/<ecu romid>-<timestamp>-log.csv.")
 	logCmd.Flags().StringVar(&defsPath, "defs", "logger_STD_EN_v336.xml", "Path to RomRaider logger definition XML")
-	logCmd.Flags().StringVar(&logFormat, "format", "csv", "Output format: csv or ndjson")
-	logCmd.Flags().StringVar(&paramsCsv, "params", "", "Comma-separated list of parameter names to log")
+	logCmd.Flags().StringArrayVar(&overlayPaths, "overlay", nil, "YAML or XML file of extra parameters merged with --defs. May be repeated")
+	logCmd.Flags().StringVar(&defsCacheDir, "defs-cache-dir", "", "Directory for the parsed definitions cache (default: ssm2logger/defs under the user cache directory)")
+	logCmd.Flags().BoolVar(&noDefsCache, "no-defs-cache", false, "Always parse --defs instead of using the definitions cache")
+	logCmd.Flags().StringVar(&logFormat, "format", "csv", "Output format: csv, ndjson or romraider-csv (RomRaider's log layout, for tools that expect it)")
+	logCmd.Flags().StringVar(&paramsCsv, "params", "", "Comma-separated parameters to log: names, IDs (P8; RomRaider ecuparams like E12 are not supported), globs (\"*Knock*\"), /regexes/ or @groups from param-groups in the config file. Prefix with - to exclude. Append :<unit> to pick a unit, e.g. \"Coolant Temperature:F\", :<unit>+<unit> for several, or :* for all of them")
 	logCmd.Flags().BoolVar(&allParams, "all", false, "Log all supported parameters (subject to --max-addresses)")
+	logCmd.Flags().BoolVar(&strictParams, "strict-params", false, "Fail instead of warning when a --params entry matches no supported parameter")
 	logCmd.Flags().IntVar(&maxAddresses, "max-addresses", 45, "Maximum number of ECU addresses to request in a single logging packet")
+	logCmd.Flags().StringVar(&unitProfileName, "units", "", "Unit profile used to pick each parameter's conversion: metric, imperial, psi-boost or one defined under unit-profiles in the config file")
+	logCmd.Flags().StringVar(&plausibilityMode, "plausibility", plausibilityOff, "Check values against the definition's gauge range: off, flag (mark implausible values) or null (write them as empty/null)")
+	logCmd.Flags().Float64Var(&plausibilityMargin, "plausibility-margin", 0.1, "Fraction of the gauge span a value may fall outside the gauge range before it counts as implausible")
+	logCmd.Flags().IntVar(&disableAfterErrors, "disable-after-errors", 0, "Stop converting a parameter after this many consecutive conversion errors (0 never disables)")
+	logCmd.Flags().StringArrayVar(&computedSpecs, "computed", nil, "Computed channel as name=expression over other channels' NDJSON keys, e.g. \"boost_psi=(manifold_absolute_pressure_kpa - atmospheric_pressure_kpa) * 0.145\". May be repeated")
+	logCmd.Flags().StringArrayVar(&sinkSpecs, "sink", nil, "Output as kind[:target][;option=value...], may be repeated: csv[:<dir>], ndjson[:<file>|unix:<socket path>], mqtt:<broker>, influx[:<file>|<url>], prometheus[:<addr>], sqlite[:<file>], parquet[:<dir>], romraider-csv[:<dir>], mlg[:<dir>] or raw[:<dir>]. csv and ndjson files take rotate_size, rotate_every, compress and retain_* options. Replaces --format/--unix-socket")
 	logCmd.Flags().StringVar(&unixSocketPath, "unix-socket", "", "Unix domain socket path for NDJSON output (requires --format ndjson)")
 
 	viper.BindPFlag("logfile-path", logCmd.Flags().Lookup("logfile-path"))
 	viper.SetDefault("logfile-path", ".")
 }
-
-func ndjsonWriter(socketPath string) (io.Writer, func() error, error) {
-	if socketPath == "" {
-		return os.Stdout, nil, nil
-	}
-
-	conn, err := net.Dial("unix", socketPath)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to connect to unix socket %q: %w", socketPath, err)
-	}
-
-	return conn, conn.Close, nil
-}
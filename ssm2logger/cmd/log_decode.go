@@ -0,0 +1,301 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	. "github.com/nanoadmin/go-ssm2logger/ssm2lib"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	plausibilityOff  = "off"
+	plausibilityFlag = "flag"
+	plausibilityNull = "null"
+)
+
+// conversionErrorLogInterval limits how often a failing parameter is logged.
+const conversionErrorLogInterval = 10 * time.Second
+
+// outputColumn names one output channel in every format.
+type outputColumn struct {
+	Name  string
+	Units string
+	// Decimals is the most decimals the column's format writes, or -1
+	// without a format.
+	Decimals int
+}
+
+// switchUnits mark parameters that are on/off switches rather than
+// measurements.
+var switchUnits = map[string]bool{"on/off": true, "switch": true, "bool": true, "boolean": true}
+
+// IsSwitch is true for columns whose units make them an on/off switch.
+func (c outputColumn) IsSwitch() bool {
+	return switchUnits[strings.ToLower(c.Units)]
+}
+
+// Label is the CSV header for the column.
+func (c outputColumn) Label() string {
+	return formatHeaderLabel(c.Name, c.Units)
+}
+
+// Key is the NDJSON key for the column, also used to reference it from
+// computed channel expressions.
+func (c outputColumn) Key() string {
+	return normalizeNdjsonKey(c.Name, c.Units)
+}
+
+// valueFormatter is implemented by both definition conversions and computed
+// channels.
+type valueFormatter interface {
+	FormatValue(value float64) string
+	JavaFormatValue(value float64) string
+	RoundValue(value float64) float64
+}
+
+// decodedValue is one output channel for a single sample.
+type decodedValue struct {
+	Column outputColumn
+	Value  float64
+	// Valid is false when the value should be written as an empty cell/null.
+	Valid       bool
+	Implausible bool
+	formatter   valueFormatter
+}
+
+// channelState tracks per-channel problems over a logging session.
+type channelState struct {
+	implausible       int
+	errors            int
+	consecutiveErrors int
+	suppressedErrors  int
+	lastErrorLog      time.Time
+	disabled          bool
+}
+
+// decoderChannel is either a parameter read from the ECU or a computed channel.
+type decoderChannel struct {
+	column   outputColumn
+	mapping  *ParameterMapping
+	computed *ComputedChannel
+	state    channelState
+}
+
+// sampleDecoder converts continuous-mode payloads into output values, applies
+// the plausibility checks against each conversion's gauge range and then
+// evaluates the computed channels.
+// A channel that fails to convert is written as empty/null for that sample
+// instead of ending the session, and is disabled after disableAfter
+// consecutive failures (0 never disables).
+type sampleDecoder struct {
+	channels     []*decoderChannel
+	plausibility string
+	margin       float64
+	disableAfter int
+}
+
+type computedChannelConfig struct {
+	Name   string `mapstructure:"name"`
+	Units  string `mapstructure:"units"`
+	Expr   string `mapstructure:"expr"`
+	Format string `mapstructure:"format"`
+}
+
+func validatePlausibilityMode(plausibility string) error {
+	switch plausibility {
+	case plausibilityOff, plausibilityFlag, plausibilityNull:
+		return nil
+	}
+	return fmt.Errorf("unsupported plausibility mode %q; expected off, flag or null", plausibility)
+}
+
+// loadComputedChannels compiles the channels listed under "computed" in the
+// config file followed by the ones passed as name=expr flags.
+func loadComputedChannels(flagSpecs []string) ([]*ComputedChannel, error) {
+	configs := []computedChannelConfig{}
+	if err := viper.UnmarshalKey("computed", &configs); err != nil {
+		return nil, fmt.Errorf("invalid computed channel config: %s", err)
+	}
+	for _, spec := range flagSpecs {
+		idx := strings.Index(spec, "=")
+		if idx <= 0 {
+			return nil, fmt.Errorf("invalid --computed %q; expected name=expression", spec)
+		}
+		configs = append(configs, computedChannelConfig{Name: strings.TrimSpace(spec[:idx]), Expr: strings.TrimSpace(spec[idx+1:])})
+	}
+
+	channels := []*ComputedChannel{}
+	for _, config := range configs {
+		channel, err := CompileComputedChannel(config.Name, config.Units, config.Expr, config.Format)
+		if err != nil {
+			return nil, err
+		}
+		channels = append(channels, channel)
+	}
+	return channels, nil
+}
+
+func newSampleDecoder(mappings []ParameterMapping, computed []*ComputedChannel, plausibility string, margin float64, disableAfter int) (*sampleDecoder, error) {
+	if err := validatePlausibilityMode(plausibility); err != nil {
+		return nil, err
+	}
+	decoder := &sampleDecoder{
+		plausibility: plausibility,
+		margin:       margin,
+		disableAfter: disableAfter,
+	}
+	keys := map[string]bool{}
+	for idx := range mappings {
+		column := outputColumn{Name: mappings[idx].Name, Units: mappings[idx].Units, Decimals: -1}
+		if mappings[idx].Conversion != nil {
+			column.Decimals = mappings[idx].Conversion.Decimals()
+		}
+		decoder.channels = append(decoder.channels, &decoderChannel{column: column, mapping: &mappings[idx]})
+		keys[column.Key()] = true
+	}
+	// Computed channels may reference any parameter and any computed channel
+	// defined before them.
+	for _, channel := range computed {
+		column := outputColumn{Name: channel.Name, Units: channel.Units, Decimals: channel.Decimals()}
+		for _, variable := range channel.Variables() {
+			if !keys[variable] {
+				return nil, fmt.Errorf("computed channel %s references %q, which is not a selected parameter or earlier computed channel", channel.Name, variable)
+			}
+		}
+		if keys[column.Key()] {
+			return nil, fmt.Errorf("computed channel %s collides with existing channel key %q", channel.Name, column.Key())
+		}
+		decoder.channels = append(decoder.channels, &decoderChannel{column: column, computed: channel})
+		keys[column.Key()] = true
+	}
+	return decoder, nil
+}
+
+// Columns lists the output channels in the order Decode returns them.
+func (d *sampleDecoder) Columns() []outputColumn {
+	columns := []outputColumn{}
+	for _, channel := range d.channels {
+		columns = append(columns, channel.column)
+	}
+	return columns
+}
+
+func (d *sampleDecoder) Decode(payload []byte) []decodedValue {
+	values := make([]decodedValue, len(d.channels))
+	// Inputs for computed channels, keyed like NDJSON. Missing values are
+	// left out so expressions that use them fail instead of using zero.
+	inputs := map[string]interface{}{}
+	for idx, channel := range d.channels {
+		values[idx] = decodedValue{Column: channel.column}
+		if channel.state.disabled {
+			continue
+		}
+
+		var convertedValue float64
+		var err error
+		if channel.mapping != nil {
+			convertedValue, err = channel.mapping.Convert(payload)
+			values[idx].formatter = channel.mapping.Conversion
+		} else {
+			convertedValue, err = channel.computed.Evaluate(inputs)
+			values[idx].formatter = channel.computed
+		}
+		if err != nil {
+			d.recordError(channel, err)
+			continue
+		}
+		channel.state.consecutiveErrors = 0
+
+		values[idx].Value = convertedValue
+		values[idx].Valid = true
+		if channel.mapping != nil && d.plausibility != plausibilityOff && !channel.mapping.Conversion.InGaugeRange(convertedValue, d.margin) {
+			channel.state.implausible++
+			values[idx].Implausible = true
+			if d.plausibility == plausibilityNull {
+				values[idx].Valid = false
+			}
+		}
+		if values[idx].Valid {
+			inputs[channel.column.Key()] = convertedValue
+		}
+	}
+	return values
+}
+
+func (d *sampleDecoder) recordError(channel *decoderChannel, err error) {
+	state := &channel.state
+	state.errors++
+	state.consecutiveErrors++
+	fields := log.Fields{"parameter": channel.column.Label(), "error": err}
+
+	if d.disableAfter > 0 && state.consecutiveErrors >= d.disableAfter {
+		state.disabled = true
+		fields["consecutive_errors"] = state.consecutiveErrors
+		logger.WithFields(fields).Error("Disabling parameter after repeated conversion errors")
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(state.lastErrorLog) < conversionErrorLogInterval {
+		state.suppressedErrors++
+		return
+	}
+	if state.suppressedErrors > 0 {
+		fields["suppressed"] = state.suppressedErrors
+	}
+	logger.WithFields(fields).Warn("Unable to convert parameter, writing an empty value")
+	state.lastErrorLog = now
+	state.suppressedErrors = 0
+}
+
+// FormatValue renders a value for text outputs like CSV.
+func (v decodedValue) FormatValue() string {
+	if !v.Valid {
+		return ""
+	}
+	return v.formatter.FormatValue(v.Value)
+}
+
+// JavaFormatValue is FormatValue as RomRaider would write it.
+func (v decodedValue) JavaFormatValue() string {
+	if !v.Valid {
+		return ""
+	}
+	return v.formatter.JavaFormatValue(v.Value)
+}
+
+// NumericValue rounds a value per its format for numeric outputs like NDJSON,
+// returning nil when it should be written as null.
+func (v decodedValue) NumericValue() *float64 {
+	if !v.Valid {
+		return nil
+	}
+	rounded := v.formatter.RoundValue(v.Value)
+	return &rounded
+}
+
+// LogSummary reports every channel that had implausible values, conversion
+// errors or was disabled during the session.
+func (d *sampleDecoder) LogSummary() {
+	for _, channel := range d.channels {
+		if channel.state.implausible > 0 {
+			conversion := channel.mapping.Conversion.Conversion
+			logger.WithFields(log.Fields{
+				"parameter":   channel.column.Label(),
+				"implausible": channel.state.implausible,
+				"gauge_min":   conversion.GaugeMin,
+				"gauge_max":   conversion.GaugeMax,
+			}).Warn("Values outside the gauge range were seen during this session")
+		}
+		if channel.state.errors > 0 {
+			logger.WithFields(log.Fields{
+				"parameter": channel.column.Label(),
+				"errors":    channel.state.errors,
+				"disabled":  channel.state.disabled,
+			}).Warn("Conversion errors were seen during this session")
+		}
+	}
+}
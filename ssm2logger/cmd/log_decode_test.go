@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/nanoadmin/go-ssm2logger/ssm2lib"
+)
+
+var _ = Describe("Sample decoder", func() {
+	// failingMappings converts its second parameter from the payload's
+	// second byte, so a 1 byte payload makes only that one fail.
+	failingMappings := func() []ParameterMapping {
+		conversion, err := CompileConversion(Ssm2ParameterConversion{Units: "rpm", Expr: "x*4"})
+		Ω(err).ShouldNot(HaveOccurred())
+		return []ParameterMapping{
+			{Name: "Engine Speed", Units: "rpm", Start: 0, Length: 1, Conversion: conversion},
+			{Name: "Boost", Units: "psi", Start: 1, Length: 1, Conversion: conversion},
+		}
+	}
+
+	It("Writes a null for the failing parameter and keeps the others", func() {
+		decoder, err := newSampleDecoder(failingMappings(), nil, plausibilityOff, 0, 0)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		values := decoder.Decode([]byte{10})
+		Ω(values[0].Valid).Should(BeTrue())
+		Ω(*values[0].NumericValue()).Should(Equal(40.0))
+		Ω(values[1].Valid).Should(BeFalse())
+		Ω(values[1].NumericValue()).Should(BeNil())
+		Ω(values[1].FormatValue()).Should(Equal(""))
+		Ω(decoder.channels[1].state.errors).Should(Equal(1))
+
+		values = decoder.Decode([]byte{10, 20})
+		Ω(*values[1].NumericValue()).Should(Equal(80.0))
+		Ω(decoder.channels[1].state.consecutiveErrors).Should(Equal(0))
+		Ω(decoder.channels[1].state.errors).Should(Equal(1))
+	})
+
+	It("Logs a failing parameter at most once per interval", func() {
+		decoder, _ := newSampleDecoder(failingMappings(), nil, plausibilityOff, 0, 0)
+		for i := 0; i < 5; i++ {
+			decoder.Decode([]byte{10})
+		}
+		Ω(logs.AllEntries()).Should(HaveLen(1))
+		Ω(logs.LastEntry().Level).Should(Equal(log.WarnLevel))
+		Ω(logs.LastEntry().Data["parameter"]).Should(Equal("Boost (psi)"))
+		Ω(decoder.channels[1].state.suppressedErrors).Should(Equal(4))
+
+		decoder.channels[1].state.lastErrorLog = decoder.channels[1].state.lastErrorLog.Add(-conversionErrorLogInterval)
+		decoder.Decode([]byte{10})
+		Ω(logs.AllEntries()).Should(HaveLen(2))
+		Ω(logs.LastEntry().Data["suppressed"]).Should(Equal(4))
+		Ω(decoder.channels[1].state.suppressedErrors).Should(Equal(0))
+	})
+
+	It("Disables a parameter after consecutive errors", func() {
+		decoder, _ := newSampleDecoder(failingMappings(), nil, plausibilityOff, 0, 3)
+		decoder.Decode([]byte{10})
+		decoder.Decode([]byte{10})
+		// A success resets the count
+		decoder.Decode([]byte{10, 20})
+		decoder.Decode([]byte{10})
+		decoder.Decode([]byte{10})
+		Ω(decoder.channels[1].state.disabled).Should(BeFalse())
+
+		decoder.Decode([]byte{10})
+		Ω(decoder.channels[1].state.disabled).Should(BeTrue())
+		Ω(logs.LastEntry().Level).Should(Equal(log.ErrorLevel))
+		Ω(logs.LastEntry().Data["consecutive_errors"]).Should(Equal(3))
+
+		// Even a payload it could convert is now skipped
+		values := decoder.Decode([]byte{10, 20})
+		Ω(values[1].Valid).Should(BeFalse())
+		Ω(values[0].Valid).Should(BeTrue())
+		Ω(decoder.channels[1].state.errors).Should(Equal(5))
+	})
+
+	It("Summarizes the errors and disabled parameters", func() {
+		decoder, _ := newSampleDecoder(failingMappings(), nil, plausibilityOff, 0, 2)
+		decoder.Decode([]byte{10})
+		decoder.Decode([]byte{10})
+		logs.Reset()
+
+		decoder.LogSummary()
+		Ω(logs.AllEntries()).Should(HaveLen(1))
+		Ω(logs.LastEntry().Data).Should(Equal(log.Fields{"parameter": "Boost (psi)", "errors": 2, "disabled": true}))
+	})
+})
@@ -5,40 +5,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 
 	. "github.com/nanoadmin/go-ssm2logger/ssm2lib"
+	log "github.com/sirupsen/logrus"
 )
 
-var defaultTelemetryParamNames = []string{
-	"Engine Speed",
-	"Throttle Opening Angle",
-	"Manifold Relative Pressure",
-	"Manifold Absolute Pressure",
-	"Primary Wastegate Duty Cycle",
-	"Mass Airflow",
-	"Ignition Timing",
-	"Fine Learning Knock Correction",
-	"Feedback Knock Correction",
-	"A/F Correction #1",
-	"A/F Learning #1",
-	"Coolant Temperature",
-	"Intake Air Temperature",
-	"Vehicle Speed",
-	"Rear O2 Sensor",
-	"Injector Pulse Width",
-	"Battery Voltage",
-	"Calculated Load",
-}
-
-type selectedParamsResult struct {
-	Params    []Ssm2Parameter
-	Trimmed   bool
-	Wanted    int
-	SelectedN int
-}
-
 func loadLoggerDefinitions(path string) (*Ssm2Logger, error) {
 	xmlfile, err := os.Open(path)
 	if err != nil {
@@ -60,86 +34,53 @@ func loadLoggerDefinitions(path string) (*Ssm2Logger, error) {
 	return logDefs, nil
 }
 
-func getSsmProtocolParameters(logDefs *Ssm2Logger) []Ssm2Parameter {
+// getProtocol returns the --protocol section of the definitions.
+func getProtocol(logDefs *Ssm2Logger) (Ssm2Protocol, error) {
 	for _, proto := range logDefs.Protocols {
-		if proto.Id == "SSM" {
-			return proto.Parameters
+		if strings.EqualFold(proto.Id, protocolId) {
+			return proto, nil
 		}
 	}
-	return []Ssm2Parameter{}
+	return Ssm2Protocol{}, fmt.Errorf("the definitions have no protocol with id %q", protocolId)
 }
 
-func getSupportedParameters(allParams []Ssm2Parameter, capBytes []byte) []Ssm2Parameter {
-	supported := []Ssm2Parameter{}
-	for _, param := range allParams {
-		if param.EcuByteIndex < uint(len(capBytes)) {
-			if (capBytes[param.EcuByteIndex] & (1 << param.EcuBit)) > 0 {
-				supported = append(supported, param)
-			}
-		}
+// getProtocolParameters returns the parameters of the --protocol section, or
+// none if the definitions don't have it.
+func getProtocolParameters(logDefs *Ssm2Logger) []Ssm2Parameter {
+	proto, err := getProtocol(logDefs)
+	if err != nil {
+		return []Ssm2Parameter{}
 	}
-	return supported
+	return proto.Parameters
 }
 
-func splitParamNames(csv string) []string {
-	parts := strings.Split(csv, ",")
-	retval := []string{}
-	for _, part := range parts {
-		trimmed := strings.TrimSpace(part)
-		if trimmed != "" {
-			retval = append(retval, trimmed)
-		}
+// applyOverlays merges the user overlay files, in order, on top of the
+// parameters from the definitions file. They're merged together so that one
+// overlay can't silently override a parameter defined by another. Overlays
+// describe SSM RAM addresses, so they only apply to that protocol.
+func applyOverlays(params []Ssm2Parameter, overlayPaths []string) ([]Ssm2Parameter, error) {
+	if len(overlayPaths) > 0 && !strings.EqualFold(protocolId, ProtocolSsm) {
+		return nil, fmt.Errorf("--overlay is only supported with the %s protocol", ProtocolSsm)
 	}
-	return retval
-}
-
-func selectParameters(supported []Ssm2Parameter, all bool, paramsCsv string, maxAddresses int) (selectedParamsResult, error) {
-	result := selectedParamsResult{}
-	chosen := []Ssm2Parameter{}
-
-	if all {
-		chosen = append(chosen, supported...)
-	} else {
-		requestedNames := splitParamNames(paramsCsv)
-		if len(requestedNames) == 0 {
-			requestedNames = defaultTelemetryParamNames
-		}
-		lookup := map[string]Ssm2Parameter{}
-		for _, param := range supported {
-			lookup[strings.ToLower(param.Name)] = param
-		}
-		for _, name := range requestedNames {
-			if param, ok := lookup[strings.ToLower(name)]; ok {
-				chosen = append(chosen, param)
-			}
-		}
+	if len(overlayPaths) == 0 {
+		return params, nil
 	}
-
-	requestedAddressCount := 0
-	totalWanted := 0
-	trimmed := []Ssm2Parameter{}
-	for _, param := range chosen {
-		length := ParameterLength(param)
-		totalWanted += length
-		if maxAddresses > 0 && requestedAddressCount+length > maxAddresses {
-			result.Trimmed = true
-			continue
+	overlays := []OverlayParameter{}
+	for _, path := range overlayPaths {
+		overlay, err := LoadOverlay(path)
+		if err != nil {
+			return nil, err
 		}
-		requestedAddressCount += length
-		trimmed = append(trimmed, param)
+		overlays = append(overlays, overlay...)
 	}
-
-	result.Params = trimmed
-	result.Wanted = totalWanted
-	result.SelectedN = len(chosen)
-	return result, nil
+	return MergeOverlay(params, overlays)
 }
 
-func formatHeaderLabel(mapping ParameterMapping) string {
-	if mapping.Units == "" {
-		return mapping.Name
+func formatHeaderLabel(name string, units string) string {
+	if units == "" {
+		return name
 	}
-	return fmt.Sprintf("%s (%s)", mapping.Name, mapping.Units)
+	return fmt.Sprintf("%s (%s)", name, units)
 }
 
 var ndjsonCleaner = regexp.MustCompile(`[^a-z0-9]+`)
@@ -161,3 +102,185 @@ func normalizeNdjsonKey(name string, units string) string {
 	}
 	return base
 }
+
+func definitionCache() (*DefinitionCache, error) {
+	if noDefsCache {
+		return nil, nil
+	}
+	if defsCacheDir != "" {
+		return &DefinitionCache{Dir: defsCacheDir}, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	return &DefinitionCache{Dir: filepath.Join(dir, "ssm2logger", "defs")}, nil
+}
+
+// resolveDefinitionFiles returns the cache key of --defs and the overlays,
+// with their hash, version and --protocol element. Those come from the
+// definitions cache while the files keep their size and modification time,
+// so a warm start doesn't read the XML at all; otherwise they're read and
+// cached. Cache problems are only logged.
+func resolveDefinitionFiles() (string, *CachedDefinitionFiles, error) {
+	defsKey, err := DefinitionsKey(append([]string{defsPath}, overlayPaths...)...)
+	if err != nil {
+		return "", nil, err
+	}
+	cache, err := definitionCache()
+	if err != nil {
+		logger.WithError(err).Warn("Unable to locate the definitions cache directory, caching disabled")
+	}
+	if cache != nil {
+		cached, err := cache.LoadFiles(defsKey, protocolId)
+		if err != nil {
+			logger.WithError(err).Warn("Ignoring unreadable definitions cache")
+		} else if cached != nil {
+			return defsKey, cached, nil
+		}
+	}
+
+	files := &CachedDefinitionFiles{}
+	if files.Hash, err = DefinitionsHash(append([]string{defsPath}, overlayPaths...)...); err != nil {
+		return "", nil, err
+	}
+	if files.Protocol, err = readProtocol(defsPath); err != nil {
+		return "", nil, err
+	}
+	if files.DefinitionsVersion, err = readDefinitionsVersion(defsPath); err != nil {
+		return "", nil, err
+	}
+	if cache != nil {
+		if err := cache.SaveFiles(defsKey, protocolId, files); err != nil {
+			logger.WithError(err).Warn("Unable to write the definitions cache")
+		}
+	}
+	return defsKey, files, nil
+}
+
+// resolveSupportedParameters returns every known parameter and the ones this
+// ECU supports. They come from the definitions cache when it has an entry for
+// defsKey and the ECU's ROM ID, which skips parsing the XML; otherwise the
+// XML is parsed and the result cached for next time. Cache problems are only
+// logged, the definitions file is always the fallback.
+func resolveSupportedParameters(defsKey string, session EcuSession, info *EcuInfo) ([]Ssm2Parameter, []Ssm2Parameter, error) {
+	romId := append([]byte(info.Protocol+":"), info.RomId...)
+	cache, err := definitionCache()
+	if err != nil {
+		logger.WithError(err).Warn("Unable to locate the definitions cache directory, caching disabled")
+	}
+	if len(info.RomId) == 0 {
+		// Without an ID there's nothing to tell vehicles apart by
+		cache = nil
+	}
+	if cache != nil {
+		cached, err := cache.Load(defsKey, romId)
+		if err != nil {
+			logger.WithError(err).Warn("Ignoring unreadable definitions cache")
+		} else if cached != nil {
+			logger.WithField("dir", cache.Dir).Debug("Loaded supported parameters from the definitions cache")
+			return cached.All(), cached.Supported, nil
+		}
+	}
+
+	logDefs, err := loadLoggerDefinitions(defsPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	all, err := applyOverlays(getProtocolParameters(logDefs), overlayPaths)
+	if err != nil {
+		return nil, nil, err
+	}
+	supported := session.SupportedParameters(all, info)
+
+	if cache != nil {
+		cached, err := NewCachedDefinitions(all, supported)
+		if err == nil {
+			err = cache.Save(defsKey, romId, cached)
+		}
+		if err != nil {
+			logger.WithError(err).Warn("Unable to write the definitions cache")
+		}
+	}
+	return all, supported, nil
+}
+
+// readProtocol reads the --protocol element of the definitions without
+// parsing its parameters.
+func readProtocol(defsPath string) (Ssm2Protocol, error) {
+	xmlfile, err := os.Open(defsPath)
+	if err != nil {
+		return Ssm2Protocol{}, err
+	}
+	defer xmlfile.Close()
+
+	protocol, err := ReadProtocol(xmlfile, protocolId)
+	if err != nil {
+		return Ssm2Protocol{}, fmt.Errorf("%s: %s", defsPath, err)
+	}
+	return protocol, nil
+}
+
+// readDefinitionsVersion reads the version attribute of the definitions.
+func readDefinitionsVersion(defsPath string) (string, error) {
+	xmlfile, err := os.Open(defsPath)
+	if err != nil {
+		return "", err
+	}
+	defer xmlfile.Close()
+
+	version, err := ReadDefinitionsVersion(xmlfile)
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", defsPath, err)
+	}
+	return version, nil
+}
+
+// applySerialFlags overrides the definition's serial settings with any that
+// were set on the command line.
+func applySerialFlags(settings SerialSettings) (SerialSettings, error) {
+	if serialBaud > 0 {
+		settings.Baud = serialBaud
+	}
+	if serialDataBits > 0 {
+		settings.DataBits = serialDataBits
+	}
+	if serialStopBits > 0 {
+		settings.StopBits = serialStopBits
+	}
+	if serialParity != "" {
+		parity, err := ParseParity(serialParity)
+		if err != nil {
+			return settings, err
+		}
+		settings.Parity = parity
+	}
+	if connectTimeout > 0 {
+		settings.ConnectTimeout = connectTimeout
+	}
+	if sendTimeout > 0 {
+		settings.SendTimeout = sendTimeout
+		if settings.ReadTimeout() > sendTimeout {
+			logger.WithFields(log.Fields{"send_timeout": sendTimeout, "read_timeout": settings.ReadTimeout()}).Warn("Send timeout is shorter than serial reads may wait, they'll wait the read timeout")
+		}
+	}
+	return settings, settings.Validate()
+}
+
+// openSession opens a --protocol session on --port, with the serial settings
+// from the protocol definition and any command line overrides.
+func openSession(protocol Ssm2Protocol) (EcuSession, error) {
+	session, err := NewEcuSession(protocolId, logger)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := applySerialFlags(session.SerialSettings(protocol))
+	if err != nil {
+		return nil, err
+	}
+	logger.WithFields(log.Fields{"port": port, "protocol": protocolId, "serial": settings.String(), "connect_timeout": settings.ConnectTimeout, "send_timeout": settings.SendTimeout, "read_timeout": settings.ReadTimeout()}).Debug("Opening serial port")
+	if err := session.Open(port, settings); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
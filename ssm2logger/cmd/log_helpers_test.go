@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/nanoadmin/go-ssm2logger/ssm2lib"
+)
+
+var _ = Describe("Overlays", func() {
+	var dir string
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "overlay")
+		Ω(err).ShouldNot(HaveOccurred())
+		protocolId = ProtocolSsm
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+	writeOverlay := func(name string, id string, override bool) string {
+		path := filepath.Join(dir, name)
+		contents := fmt.Sprintf(`
+parameters:
+  - id: %s
+    name: Boost Target
+    address: "0xff6a2c"
+    override: %t
+    conversions:
+      - units: psi
+        expr: x
+`, id, override)
+		Ω(ioutil.WriteFile(path, []byte(contents), 0644)).Should(Succeed())
+		return path
+	}
+	official := []Ssm2Parameter{{Id: "P8", Name: "Engine Speed", Address: Ssm2ParameterAddress{Address: "0x00000e", Length: 2}}}
+
+	It("Merges every overlay on top of the definitions", func() {
+		first := writeOverlay("first.yaml", "X1", false)
+		merged, err := applyOverlays(official, []string{first})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(merged).Should(HaveLen(2))
+		Ω(merged[1].Id).Should(Equal("X1"))
+	})
+
+	It("Reports a parameter defined by two overlays even when the second is an override", func() {
+		first := writeOverlay("first.yaml", "X1", false)
+		second := writeOverlay("second.yaml", "X1", true)
+		_, err := applyOverlays(official, []string{first, second})
+		Ω(err).Should(MatchError(ContainSubstring("Boost Target (X1) in " + second + " is also defined in " + first)))
+	})
+})
+
+var _ = Describe("Serial flags", func() {
+	AfterEach(func() {
+		sendTimeout = 0
+	})
+
+	It("Warns when serial reads will wait longer than --send-timeout", func() {
+		sendTimeout = 200 * time.Millisecond
+		settings, err := applySerialFlags(DefaultSerialSettings)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(settings.SendTimeout).Should(Equal(200 * time.Millisecond))
+		Ω(logs.LastEntry().Level).Should(Equal(log.WarnLevel))
+		Ω(logs.LastEntry().Data).Should(Equal(log.Fields{"send_timeout": 200 * time.Millisecond, "read_timeout": time.Second}))
+
+		logs.Reset()
+		sendTimeout = 2 * time.Second
+		_, err = applySerialFlags(DefaultSerialSettings)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(logs.AllEntries()).Should(BeEmpty())
+	})
+})
+
+var _ = Describe("Definitions cache", func() {
+	var dir string
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "defs")
+		Ω(err).ShouldNot(HaveOccurred())
+		defsPath = filepath.Join(dir, "logger.xml")
+		defsCacheDir = filepath.Join(dir, "cache")
+		protocolId = ProtocolSsm
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+		defsPath = ""
+		defsCacheDir = ""
+	})
+
+	It("Doesn't read the definitions again while they're unchanged", func() {
+		modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+		writeDefs := func(baud string) {
+			contents := `<logger version="2024"><protocols><protocol id="SSM" baud="` + baud + `"/></protocols></logger>`
+			Ω(ioutil.WriteFile(defsPath, []byte(contents), 0644)).Should(Succeed())
+			Ω(os.Chtimes(defsPath, modified, modified)).Should(Succeed())
+		}
+		writeDefs("4800")
+		key, files, err := resolveDefinitionFiles()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(files.Protocol.Baud).Should(Equal(4800))
+		Ω(files.DefinitionsVersion).Should(Equal("2024"))
+		hash, _ := DefinitionsHash(defsPath)
+		Ω(files.Hash).Should(Equal(hash))
+
+		// Same size and time, so the cached entry is used without reading it
+		writeDefs("9600")
+		cachedKey, cached, err := resolveDefinitionFiles()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(cachedKey).Should(Equal(key))
+		Ω(cached).Should(Equal(files))
+
+		modified = modified.Add(time.Second)
+		writeDefs("9600")
+		_, files, err = resolveDefinitionFiles()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(files.Protocol.Baud).Should(Equal(9600))
+	})
+})
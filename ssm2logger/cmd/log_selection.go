@@ -0,0 +1,376 @@
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	. "github.com/nanoadmin/go-ssm2logger/ssm2lib"
+	"github.com/spf13/viper"
+)
+
+var defaultTelemetryParamNames = []string{
+	"Engine Speed",
+	"Throttle Opening Angle",
+	"Manifold Relative Pressure",
+	"Manifold Absolute Pressure",
+	"Primary Wastegate Duty Cycle",
+	"Mass Airflow",
+	"Ignition Timing",
+	"Fine Learning Knock Correction",
+	"Feedback Knock Correction",
+	"A/F Correction #1",
+	"A/F Learning #1",
+	"Coolant Temperature",
+	"Intake Air Temperature",
+	"Vehicle Speed",
+	"Rear O2 Sensor",
+	"Injector Pulse Width",
+	"Battery Voltage",
+	"Calculated Load",
+}
+
+// defaultParamGroup is the built-in group used when --params is empty.
+const defaultParamGroup = "default"
+
+type selectedParamsResult struct {
+	Params    []ParameterSelection
+	Trimmed   bool
+	Wanted    int
+	SelectedN int
+	// Unknown lists requested entries that matched nothing in the definitions.
+	Unknown []string
+	// Unsupported lists requested entries that only matched parameters this
+	// ECU doesn't support.
+	Unsupported []string
+}
+
+// splitParamNames splits --params on commas, except those inside a
+// /regex/.
+func splitParamNames(csv string) []string {
+	retval := []string{}
+	start := 0
+	for idx := 0; idx <= len(csv); idx++ {
+		if idx < len(csv) && csv[idx] != ',' {
+			if csv[idx] == '/' && strings.Trim(csv[start:idx], " -") == "" {
+				if end := regexEnd(csv[idx:]); end > 0 {
+					idx += end
+				}
+			}
+			continue
+		}
+		trimmed := strings.TrimSpace(csv[start:idx])
+		if trimmed != "" {
+			retval = append(retval, trimmed)
+		}
+		start = idx + 1
+	}
+	return retval
+}
+
+// regexEnd returns the index of the "/" closing the /regex/ that spec starts
+// with, or -1 when it doesn't start with one. "\/" doesn't close it.
+func regexEnd(spec string) int {
+	if !strings.HasPrefix(spec, "/") {
+		return -1
+	}
+	for idx := 1; idx < len(spec); idx++ {
+		switch spec[idx] {
+		case '\\':
+			idx++
+		case '/':
+			return idx
+		}
+	}
+	return -1
+}
+
+// parseParamSpec splits a --params entry of the form "Name", "Name:unit" or
+// "Name:unit1+unit2". A unit of "*" selects every conversion. Colons inside a
+// /regex/ are part of it.
+func parseParamSpec(spec string) (string, []string) {
+	idx := strings.LastIndex(spec, ":")
+	if end := regexEnd(spec); end > 0 {
+		idx = -1
+		if colon := strings.Index(spec[end:], ":"); colon > 0 && strings.TrimSpace(spec[end+1:end+colon]) == "" {
+			idx = end + colon
+		}
+	}
+	if idx <= 0 {
+		return spec, nil
+	}
+	units := []string{}
+	for _, unit := range strings.Split(spec[idx+1:], "+") {
+		trimmed := strings.TrimSpace(unit)
+		if trimmed != "" {
+			units = append(units, trimmed)
+		}
+	}
+	return strings.TrimSpace(spec[:idx]), units
+}
+
+// resolveUnitProfile finds a unit profile by name, checking profiles defined
+// under "unit-profiles" in the config file before the built-in ones.
+func resolveUnitProfile(name string) (*UnitProfile, error) {
+	if name == "" {
+		return nil, nil
+	}
+	configured := viper.GetStringMapStringSlice("unit-profiles")
+	if units, ok := configured[strings.ToLower(name)]; ok {
+		return &UnitProfile{Name: name, Units: units}, nil
+	}
+	if profile, ok := BuiltinUnitProfiles[strings.ToLower(name)]; ok {
+		return &profile, nil
+	}
+	return nil, fmt.Errorf("unknown unit profile %q", name)
+}
+
+// expandParamGroups replaces "@group" entries (and "-@group" exclusions) with
+// the entries of the group. Groups are defined under "param-groups" in the
+// config file; "@default" is the built-in default telemetry set.
+func expandParamGroups(specs []string, seen map[string]bool) ([]string, error) {
+	expanded := []string{}
+	for _, spec := range specs {
+		prefix := ""
+		if strings.HasPrefix(spec, "-") {
+			prefix = "-"
+		}
+		if !strings.HasPrefix(spec[len(prefix):], "@") {
+			expanded = append(expanded, spec)
+			continue
+		}
+
+		group := strings.ToLower(strings.TrimSpace(spec[len(prefix)+1:]))
+		if seen[group] {
+			return nil, fmt.Errorf("parameter group @%s includes itself", group)
+		}
+		members, ok := viper.GetStringMapStringSlice("param-groups")[group]
+		if !ok && group == defaultParamGroup {
+			members, ok = defaultTelemetryParamNames, true
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown parameter group @%s", group)
+		}
+
+		seen[group] = true
+		inner, err := expandParamGroups(members, seen)
+		delete(seen, group)
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range inner {
+			if prefix == "-" && strings.HasPrefix(member, "-") {
+				// Excluding a group doesn't re-include its own exclusions
+				continue
+			}
+			expanded = append(expanded, prefix+member)
+		}
+	}
+	return expanded, nil
+}
+
+// ecuParamId matches the IDs of RomRaider's ecuparams, whose addresses
+// depend on the ECU and which aren't read from the definitions.
+var ecuParamId = regexp.MustCompile(`(?i)^E\d+$`)
+
+// paramMatcher matches a --params entry against a parameter: "/regex/", a
+// glob using *, ? or [...], or an exact name or RomRaider ID. Everything is
+// case-insensitive.
+type paramMatcher struct {
+	exact   string
+	pattern *regexp.Regexp
+}
+
+func newParamMatcher(spec string) (paramMatcher, error) {
+	if len(spec) > 2 && strings.HasPrefix(spec, "/") && strings.HasSuffix(spec, "/") {
+		re, err := regexp.Compile("(?i)" + spec[1:len(spec)-1])
+		if err != nil {
+			return paramMatcher{}, fmt.Errorf("invalid parameter regex %s: %s", spec, err)
+		}
+		return paramMatcher{pattern: re}, nil
+	}
+	if strings.ContainsAny(spec, "*?[") {
+		re, err := regexp.Compile("(?i)^" + globToRegexp(spec) + "$")
+		if err != nil {
+			return paramMatcher{}, fmt.Errorf("invalid parameter glob %s: %s", spec, err)
+		}
+		return paramMatcher{pattern: re}, nil
+	}
+	return paramMatcher{exact: spec}, nil
+}
+
+// globToRegexp translates a glob into a regular expression. Unlike
+// path.Match, * also matches "/" since names like "A/F Correction #1" use it.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	inClass := false
+	for _, r := range glob {
+		switch {
+		case inClass:
+			if r == ']' {
+				inClass = false
+			}
+			b.WriteRune(r)
+		case r == '*':
+			b.WriteString(".*")
+		case r == '?':
+			b.WriteString(".")
+		case r == '[':
+			inClass = true
+			b.WriteRune(r)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	return b.String()
+}
+
+func (m paramMatcher) IsPattern() bool {
+	return m.pattern != nil
+}
+
+func (m paramMatcher) Matches(param Ssm2Parameter) bool {
+	if m.pattern != nil {
+		return m.pattern.MatchString(param.Name)
+	}
+	return strings.EqualFold(param.Name, m.exact) || strings.EqualFold(param.Id, m.exact)
+}
+
+func (m paramMatcher) Filter(params []Ssm2Parameter) []Ssm2Parameter {
+	matched := []Ssm2Parameter{}
+	for _, param := range params {
+		if m.Matches(param) {
+			matched = append(matched, param)
+		}
+	}
+	return matched
+}
+
+// selectParameters resolves --params (or --all) against the supported
+// parameters. Entries are names, IDs, globs, /regexes/ or @groups, each with
+// an optional :unit suffix, and entries starting with "-" exclude parameters
+// again. Entries that match nothing are reported in Unknown/Unsupported.
+func selectParameters(allDefs []Ssm2Parameter, supported []Ssm2Parameter, all bool, paramsCsv string, maxAddresses int, unitProfile *UnitProfile) (selectedParamsResult, error) {
+	result := selectedParamsResult{}
+	chosen := []ParameterSelection{}
+	chosenIdx := map[string]int{}
+	excluded := map[string]bool{}
+
+	add := func(param Ssm2Parameter, units []string) {
+		if idx, ok := chosenIdx[param.Id]; ok {
+			chosen[idx].Units = uniqueStrings(append(chosen[idx].Units, units...))
+			return
+		}
+		chosenIdx[param.Id] = len(chosen)
+		chosen = append(chosen, ParameterSelection{Param: param, Units: units})
+	}
+
+	specs := splitParamNames(paramsCsv)
+	reportMisses := true
+	if all {
+		for _, param := range supported {
+			add(param, nil)
+		}
+	} else if len(specs) == 0 {
+		// Not every ECU has every default parameter, so don't complain.
+		specs = []string{"@" + defaultParamGroup}
+		reportMisses = false
+	}
+	specs, err := expandParamGroups(specs, map[string]bool{})
+	if err != nil {
+		return result, err
+	}
+
+	for _, spec := range specs {
+		exclude := strings.HasPrefix(spec, "-")
+		name, units := parseParamSpec(strings.TrimSpace(strings.TrimPrefix(spec, "-")))
+		matcher, err := newParamMatcher(name)
+		if err != nil {
+			return result, err
+		}
+
+		matches := matcher.Filter(supported)
+		if len(matches) == 0 && !matcher.IsPattern() && ecuParamId.MatchString(name) && len(matcher.Filter(allDefs)) == 0 {
+			return result, fmt.Errorf("%s is a RomRaider ecuparam, and ecuparams are not supported", name)
+		}
+		if len(matches) == 0 && reportMisses {
+			if len(matcher.Filter(allDefs)) > 0 {
+				result.Unsupported = append(result.Unsupported, spec)
+			} else {
+				result.Unknown = append(result.Unknown, spec)
+			}
+		}
+
+		for _, param := range matches {
+			if exclude {
+				excluded[param.Id] = true
+				continue
+			}
+			resolved := []string{}
+			for _, unit := range units {
+				if unit == "*" {
+					resolved = append(resolved, param.AvailableUnits()...)
+					continue
+				}
+				r, err := param.ResolveUnits(unit)
+				if err != nil {
+					if matcher.IsPattern() {
+						// Patterns can match parameters without this unit;
+						// those fall back to the profile/default unit.
+						continue
+					}
+					return result, err
+				}
+				resolved = append(resolved, r)
+			}
+			add(param, uniqueStrings(resolved))
+		}
+	}
+
+	for idx := range chosen {
+		if len(chosen[idx].Units) > 0 {
+			continue
+		}
+		if unitProfile != nil {
+			chosen[idx].Units = []string{unitProfile.SelectUnits(chosen[idx].Param)}
+		} else {
+			chosen[idx].Units = []string{DefaultUnits(chosen[idx].Param)}
+		}
+	}
+
+	requestedAddressCount := 0
+	totalWanted := 0
+	trimmed := []ParameterSelection{}
+	selectedN := 0
+	for _, selection := range chosen {
+		if excluded[selection.Param.Id] {
+			continue
+		}
+		selectedN++
+		length := ParameterLength(selection.Param)
+		totalWanted += length
+		if maxAddresses > 0 && requestedAddressCount+length > maxAddresses {
+			result.Trimmed = true
+			continue
+		}
+		requestedAddressCount += length
+		trimmed = append(trimmed, selection)
+	}
+
+	result.Params = trimmed
+	result.Wanted = totalWanted
+	result.SelectedN = selectedN
+	return result, nil
+}
+
+func uniqueStrings(values []string) []string {
+	seen := map[string]bool{}
+	retval := []string{}
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			retval = append(retval, value)
+		}
+	}
+	return retval
+}
@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+
+	. "github.com/nanoadmin/go-ssm2logger/ssm2lib"
+)
+
+var _ = Describe("Parameter selection", func() {
+	conversions := func(units ...string) []Ssm2ParameterConversion {
+		retval := []Ssm2ParameterConversion{}
+		for _, unit := range units {
+			retval = append(retval, Ssm2ParameterConversion{Units: unit})
+		}
+		return retval
+	}
+	allDefs := []Ssm2Parameter{
+		{Id: "P8", Name: "Engine Speed", Address: Ssm2ParameterAddress{Length: 2}, Conversions: conversions("rpm")},
+		{Id: "P2", Name: "Coolant Temperature", Conversions: conversions("C", "F")},
+		{Id: "P7", Name: "Manifold Absolute Pressure", Conversions: conversions("psi", "bar", "kPa")},
+		{Id: "P10", Name: "Fine Learning Knock Correction", Conversions: conversions("degrees")},
+		{Id: "P11", Name: "Feedback Knock Correction", Conversions: conversions("degrees")},
+		{Id: "P90", Name: "Transmission Temperature", Conversions: conversions("C", "F")},
+	}
+	supported := allDefs[:5]
+	selected := func(result selectedParamsResult) []string {
+		retval := []string{}
+		for _, selection := range result.Params {
+			retval = append(retval, selection.Param.Id+":"+strings.Join(selection.Units, "+"))
+		}
+		return retval
+	}
+
+	BeforeEach(func() {
+		viper.Set("param-groups", map[string][]string{
+			"knock": {"/Knock.{1,2}Corr/"},
+			"temps": {"*Temperature:F", "@knock"},
+		})
+	})
+	AfterEach(func() {
+		viper.Set("param-groups", nil)
+	})
+
+	table.DescribeTable("Splits --params on commas outside of regexes",
+		func(csv string, expected []string) {
+			Ω(splitParamNames(csv)).Should(Equal(expected))
+		},
+		table.Entry("names", " Engine Speed, P2 ,,", []string{"Engine Speed", "P2"}),
+		table.Entry("a regex with a comma", "/Knock.{1,2}/,P8", []string{"/Knock.{1,2}/", "P8"}),
+		table.Entry("an excluded regex with units", "P8, -/a{1,2}/:psi,P2", []string{"P8", "-/a{1,2}/:psi", "P2"}),
+		table.Entry("an escaped slash", `/a\/b,c/,P8`, []string{`/a\/b,c/`, "P8"}),
+		table.Entry("an unclosed regex", "/a,b", []string{"/a", "b"}),
+		table.Entry("a slash inside a name", "A/F Correction #1,B", []string{"A/F Correction #1", "B"}),
+	)
+
+	table.DescribeTable("Splits units off an entry",
+		func(spec string, name string, units []string) {
+			parsedName, parsedUnits := parseParamSpec(spec)
+			Ω(parsedName).Should(Equal(name))
+			Ω(parsedUnits).Should(Equal(units))
+		},
+		table.Entry("a name", "Engine Speed", "Engine Speed", nil),
+		table.Entry("a name with units", "Coolant Temperature:F+C", "Coolant Temperature", []string{"F", "C"}),
+		table.Entry("a regex with a colon", "/(?:A|B)/", "/(?:A|B)/", nil),
+		table.Entry("a regex with a colon and units", "/(?:A|B)/:psi", "/(?:A|B)/", []string{"psi"}),
+		table.Entry("a regex with spaced units", "/a:b/ : C", "/a:b/", []string{"C"}),
+	)
+
+	table.DescribeTable("Resolves --params",
+		func(paramsCsv string, expected []string, unknown []string, unsupported []string) {
+			result, err := selectParameters(allDefs, supported, false, paramsCsv, 0, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(selected(result)).Should(Equal(expected))
+			Ω(result.Unknown).Should(Equal(unknown))
+			Ω(result.Unsupported).Should(Equal(unsupported))
+		},
+		table.Entry("the default group without reporting misses", "", []string{"P8:rpm", "P7:psi", "P10:degrees", "P11:degrees", "P2:C"}, nil, nil),
+		table.Entry("an ID", "P8", []string{"P8:rpm"}, nil, nil),
+		table.Entry("a name in any case with units", "coolant temperature:F+C", []string{"P2:F+C"}, nil, nil),
+		table.Entry("every unit", "Coolant Temperature:*", []string{"P2:C+F"}, nil, nil),
+		table.Entry("the same parameter twice", "P7:bar,Manifold Absolute Pressure:kPa", []string{"P7:bar+kPa"}, nil, nil),
+		table.Entry("a glob", "*knock*", []string{"P10:degrees", "P11:degrees"}, nil, nil),
+		table.Entry("a regex with a comma", "/Knock.{1,2}Corr/,P8", []string{"P10:degrees", "P11:degrees", "P8:rpm"}, nil, nil),
+		table.Entry("a regex with a colon and units, skipping those without them", "/^(?:Engine|Coolant) /:F", []string{"P8:rpm", "P2:F"}, nil, nil),
+		table.Entry("an exclusion", "*Knock*,-Feedback*", []string{"P10:degrees"}, nil, nil),
+		table.Entry("an excluded regex", "P8,*Knock*,-/^(?:Fine|Feed)/", []string{"P8:rpm"}, nil, nil),
+		table.Entry("a group", "@knock", []string{"P10:degrees", "P11:degrees"}, nil, nil),
+		table.Entry("a nested group", "@temps", []string{"P2:F", "P10:degrees", "P11:degrees"}, nil, nil),
+		table.Entry("an excluded group", "P8,Fine*,-@knock", []string{"P8:rpm"}, nil, nil),
+		table.Entry("unknown and unsupported entries", "P8,Bogus,/^Bogus/,Transmission Temperature,/^Trans/",
+			[]string{"P8:rpm"}, []string{"Bogus", "/^Bogus/"}, []string{"Transmission Temperature", "/^Trans/"}),
+	)
+
+	It("Uses the unit profile for parameters without units", func() {
+		result, err := selectParameters(allDefs, supported, false, "Coolant Temperature,P7:bar", 0, &UnitProfileImperial)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(selected(result)).Should(Equal([]string{"P2:F", "P7:bar"}))
+	})
+
+	It("Rejects a unit an exact name doesn't have", func() {
+		_, err := selectParameters(allDefs, supported, false, "Engine Speed:psi", 0, nil)
+		Ω(err).Should(MatchError(ContainSubstring(`Engine Speed has no conversion with unit "psi"`)))
+	})
+
+	It("Rejects unknown groups, group cycles and invalid regexes", func() {
+		viper.Set("param-groups", map[string][]string{"a": {"@b"}, "b": {"@a"}})
+		_, err := selectParameters(allDefs, supported, false, "@a", 0, nil)
+		Ω(err).Should(MatchError(ContainSubstring("includes itself")))
+		_, err = selectParameters(allDefs, supported, false, "@missing", 0, nil)
+		Ω(err).Should(MatchError("unknown parameter group @missing"))
+		_, err = selectParameters(allDefs, supported, false, "/(/", 0, nil)
+		Ω(err).Should(MatchError(ContainSubstring("invalid parameter regex")))
+	})
+
+	It("Rejects RomRaider ecuparam IDs", func() {
+		_, err := selectParameters(allDefs, supported, false, "Engine Speed,E12", 0, nil)
+		Ω(err).Should(MatchError("E12 is a RomRaider ecuparam, and ecuparams are not supported"))
+		_, err = selectParameters(allDefs, supported, false, "-e1", 0, nil)
+		Ω(err).Should(MatchError("e1 is a RomRaider ecuparam, and ecuparams are not supported"))
+	})
+
+	It("Leaves out what doesn't fit in the address limit", func() {
+		result, err := selectParameters(allDefs, supported, true, "", 4, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(selected(result)).Should(Equal([]string{"P8:rpm", "P2:C", "P7:psi"}))
+		Ω(result.Trimmed).Should(BeTrue())
+		Ω(result.Wanted).Should(Equal(6))
+		Ω(result.SelectedN).Should(Equal(5))
+	})
+})
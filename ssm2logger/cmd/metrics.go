@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	log "github.com/sirupsen/logrus"
+)
+
+// sampleRateWindow is how long samples are counted for the sample rate.
+const sampleRateWindow = 5 * time.Second
+
+// loggerMetrics are the logger's own health counters. They're always kept,
+// whether or not a prometheus sink serves them.
+type loggerMetrics struct {
+	registry         *prometheus.Registry
+	frames           prometheus.Counter
+	checksumFailures prometheus.Counter
+	lengthMismatches prometheus.Counter
+	samples          prometheus.Counter
+	initRetries      prometheus.Counter
+	sinkReconnects   *prometheus.CounterVec
+	sinkErrors       *prometheus.CounterVec
+
+	// recent are the times of the samples decoded within the rate window,
+	// oldest first, and firstSample the time of the session's first.
+	mu          sync.Mutex
+	recent      []time.Time
+	firstSample time.Time
+	now         func() time.Time
+}
+
+var metrics = newLoggerMetrics()
+
+func newLoggerMetrics() *loggerMetrics {
+	m := &loggerMetrics{
+		registry: prometheus.NewRegistry(),
+		now:      time.Now,
+		frames: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ssm2logger_frames_received_total",
+			Help: "Frames received from the ECU, including corrupt ones.",
+		}),
+		checksumFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ssm2logger_checksum_failures_total",
+			Help: "Frames skipped because their checksum didn't match.",
+		}),
+		lengthMismatches: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ssm2logger_payload_length_mismatches_total",
+			Help: "Frames skipped because their payload wasn't the requested length.",
+		}),
+		samples: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ssm2logger_samples_total",
+			Help: "Samples decoded and passed to the sinks.",
+		}),
+		initRetries: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ssm2logger_ecu_init_retries_total",
+			Help: "ECU init requests that went unanswered and were resent.",
+		}),
+		sinkReconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ssm2logger_sink_reconnects_total",
+			Help: "Sink connections that had to be re-established, by target.",
+		}, []string{"target"}),
+		sinkErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ssm2logger_sink_errors_total",
+			Help: "Samples a sink failed to write.",
+		}, []string{"sink"}),
+	}
+	// Worked out when scraped, so it falls to 0 when the ECU stalls
+	sampleRate := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ssm2logger_sample_rate_hz",
+		Help: "Samples decoded per second over the last few seconds.",
+	}, func() float64 { return m.sampleRate(m.now()) })
+	m.registry.MustRegister(
+		m.frames, m.checksumFailures, m.lengthMismatches, m.samples, sampleRate, m.initRetries, m.sinkReconnects, m.sinkErrors,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// watchQueue exports a queue's dropped sample count under the given stage.
+func (m *loggerMetrics) watchQueue(stage string, queue *sampleQueue) {
+	counter := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name:        "ssm2logger_dropped_samples_total",
+		Help:        "Samples dropped because a pipeline stage fell behind.",
+		ConstLabels: prometheus.Labels{"stage": stage},
+	}, func() float64 { return float64(queue.Dropped()) })
+	if err := m.registry.Register(counter); err != nil {
+		logger.WithFields(log.Fields{"stage": stage, "error": err}).Debug("Not exporting dropped samples twice for the same stage")
+	}
+}
+
+// sampleDecoded counts a sample for the sample rate. Only the decoder calls
+// it.
+func (m *loggerMetrics) sampleDecoded(now time.Time) {
+	m.samples.Inc()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.firstSample.IsZero() {
+		m.firstSample = now
+	}
+	m.recent = append(m.prune(now), now)
+}
+
+// sampleRate is the rate of the samples decoded within sampleRateWindow of
+// now. Until the first sample is that old, it's the rate since then.
+func (m *loggerMetrics) sampleRate(now time.Time) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.recent = m.prune(now)
+	span, count := sampleRateWindow, len(m.recent)
+	if now.Sub(m.firstSample) < sampleRateWindow {
+		// The first sample only starts the clock
+		span, count = now.Sub(m.firstSample), count-1
+	}
+	if span <= 0 || count <= 0 {
+		return 0
+	}
+	return float64(count) / span.Seconds()
+}
+
+// prune drops the sample times that have left the rate window. Callers hold
+// mu.
+func (m *loggerMetrics) prune(now time.Time) []time.Time {
+	cutoff := now.Add(-sampleRateWindow)
+	idx := 0
+	for idx < len(m.recent) && !m.recent[idx].After(cutoff) {
+		idx++
+	}
+	return m.recent[idx:]
+}
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Metrics", func() {
+	var (
+		m     *loggerMetrics
+		clock time.Time
+	)
+	scraped := func(name string) float64 {
+		families, err := m.registry.Gather()
+		Ω(err).ShouldNot(HaveOccurred())
+		for _, family := range families {
+			if family.GetName() == name {
+				metric := family.GetMetric()[0]
+				if metric.GetGauge() != nil {
+					return metric.GetGauge().GetValue()
+				}
+				return metric.GetCounter().GetValue()
+			}
+		}
+		Fail("no metric " + name)
+		return 0
+	}
+	// decode decodes samples at hz for the duration, moving the clock on.
+	decode := func(hz int, duration time.Duration) {
+		interval := time.Second / time.Duration(hz)
+		for end := clock.Add(duration); clock.Before(end); clock = clock.Add(interval) {
+			m.sampleDecoded(clock)
+		}
+	}
+
+	BeforeEach(func() {
+		m = newLoggerMetrics()
+		clock = time.Unix(1700000000, 0)
+		m.now = func() time.Time { return clock }
+	})
+
+	It("Has no sample rate before there are samples", func() {
+		Ω(scraped("ssm2logger_sample_rate_hz")).Should(BeZero())
+		m.sampleDecoded(clock)
+		Ω(scraped("ssm2logger_sample_rate_hz")).Should(BeZero())
+	})
+
+	It("Works out the sample rate when scraped", func() {
+		decode(10, 2*time.Second)
+		Ω(scraped("ssm2logger_sample_rate_hz")).Should(BeNumerically("~", 10, 0.6))
+		decode(20, 10*time.Second)
+		Ω(scraped("ssm2logger_sample_rate_hz")).Should(BeNumerically("~", 20, 0.6))
+		Ω(scraped("ssm2logger_samples_total")).Should(BeEquivalentTo(220))
+	})
+
+	It("Lets the sample rate fall when the ECU stalls", func() {
+		decode(10, 10*time.Second)
+		clock = clock.Add(sampleRateWindow / 2)
+		Ω(scraped("ssm2logger_sample_rate_hz")).Should(BeNumerically("~", 5, 0.3))
+		clock = clock.Add(sampleRateWindow)
+		Ω(scraped("ssm2logger_sample_rate_hz")).Should(BeZero())
+		Ω(m.recent).Should(BeEmpty())
+	})
+
+	It("Counts ECU init retries apart from sink reconnects", func() {
+		m.initRetries.Add(2)
+		m.sinkReconnects.WithLabelValues("mqtt").Inc()
+		Ω(scraped("ssm2logger_ecu_init_retries_total")).Should(BeEquivalentTo(2))
+		Ω(scraped("ssm2logger_sink_reconnects_total")).Should(BeEquivalentTo(1))
+	})
+})
@@ -12,6 +12,7 @@ import (
 
 var paramsDefsPath string
 var paramsFormat string
+var paramsOverlayPaths []string
 
 type paramOutput struct {
 	Name         string `json:"name"`
@@ -35,28 +36,34 @@ var paramsCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
+		allParams, err := applyOverlays(getProtocolParameters(logDefs), paramsOverlayPaths)
+		if err != nil {
+			return err
+		}
 
-		ssm2Conn := &Ssm2Connection{}
-		ssm2Conn.SetLogger(logger)
-		if err := ssm2Conn.Open(port); err != nil {
+		protocol, err := getProtocol(logDefs)
+		if err != nil {
+			return err
+		}
+		session, err := openSession(protocol)
+		if err != nil {
 			return err
 		}
-		defer ssm2Conn.Close()
+		defer session.Close()
 
-		initResponse, err := ssm2Conn.InitEngine()
+		info, err := session.Init()
 		if err != nil {
 			return err
 		}
 
-		allParams := getSsmProtocolParameters(logDefs)
-		supported := getSupportedParameters(allParams, initResponse.GetCapabilityBytes())
+		supported := session.SupportedParameters(allParams, info)
 		supportedMap := map[string]bool{}
 		for _, p := range supported {
 			supportedMap[p.Id] = true
 		}
 
 		if paramsFormat == "text" {
-			fmt.Printf("rom_id=%s ssm_id=%s\n", hex.EncodeToString(initResponse.GetRomId()), hex.EncodeToString(initResponse.GetSsmId()))
+			fmt.Printf("rom_id=%s ssm_id=%s\n", info.RomIdString(), hex.EncodeToString(info.SsmId))
 			for _, param := range supported {
 				length := ParameterLength(param)
 				units := ""
@@ -96,5 +103,6 @@ var paramsCmd = &cobra.Command{
 func init() {
 	rootCmd.AddCommand(paramsCmd)
 	paramsCmd.Flags().StringVar(&paramsDefsPath, "defs", "logger_STD_EN_v336.xml", "Path to RomRaider logger definition XML")
+	paramsCmd.Flags().StringArrayVar(&paramsOverlayPaths, "overlay", nil, "YAML or XML file of extra parameters merged with --defs. May be repeated")
 	paramsCmd.Flags().StringVar(&paramsFormat, "format", "text", "Output format: text or ndjson")
 }
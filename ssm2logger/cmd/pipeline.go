@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	. "github.com/nanoadmin/go-ssm2logger/ssm2lib"
+	log "github.com/sirupsen/logrus"
+)
+
+// Queue policies for when a stage falls behind.
+const (
+	// policyBlock waits for room, holding up the stage feeding the queue.
+	policyBlock = "block"
+	// policyDropOldest discards the oldest queued sample to make room.
+	policyDropOldest = "drop-oldest"
+	// policyDropNewest discards the sample being queued.
+	policyDropNewest = "drop-newest"
+)
+
+// acquisitionBuffer is how many payloads may wait for the decoder. The
+// serial reader must never wait, so this queue always drops the oldest.
+const acquisitionBuffer = 256
+
+func validateQueuePolicy(policy string) error {
+	switch policy {
+	case policyBlock, policyDropOldest, policyDropNewest:
+		return nil
+	}
+	return fmt.Errorf("unknown policy %q; expected %s, %s or %s", policy, policyBlock, policyDropOldest, policyDropNewest)
+}
+
+// sampleQueue is a bounded queue between two pipeline stages.
+type sampleQueue struct {
+	ch      chan sample
+	policy  string
+	dropped uint64
+}
+
+func newSampleQueue(size int, policy string) *sampleQueue {
+	return &sampleQueue{ch: make(chan sample, size), policy: policy}
+}
+
+// Put queues a sample according to the queue's policy. Only one goroutine
+// may call Put.
+func (q *sampleQueue) Put(smp sample) {
+	switch q.policy {
+	case policyBlock:
+		q.ch <- smp
+	case policyDropNewest:
+		select {
+		case q.ch <- smp:
+		default:
+			atomic.AddUint64(&q.dropped, 1)
+		}
+	default:
+		for {
+			select {
+			case q.ch <- smp:
+				return
+			default:
+			}
+			select {
+			case <-q.ch:
+				atomic.AddUint64(&q.dropped, 1)
+			default:
+			}
+		}
+	}
+}
+
+func (q *sampleQueue) C() <-chan sample {
+	return q.ch
+}
+
+func (q *sampleQueue) Close() {
+	close(q.ch)
+}
+
+// Dropped is the number of samples discarded so far.
+func (q *sampleQueue) Dropped() uint64 {
+	return atomic.LoadUint64(&q.dropped)
+}
+
+// corruptFrameMarker and skippedPayloadMarker mark the frames that can't be
+// decoded, while logging and when decoding a raw log.
+func corruptFrameMarker(t time.Time) sample {
+	return sample{Time: t, Marker: "Corrupt frame skipped"}
+}
+
+func skippedPayloadMarker(t time.Time, length int) sample {
+	return sample{Time: t, Marker: fmt.Sprintf("Skipped a %d byte payload", length)}
+}
+
+// runPipeline logs until stop is closed or the ECU connection fails. The
+// serial reader, the decoder and every sink each run in their own goroutine,
+// connected by bounded queues, so the reader never waits on decoding or I/O.
+func runPipeline(session EcuSession, stop <-chan struct{}, decoder *sampleDecoder, payloadLength int, sinks *sinkSet) error {
+	payloads := newSampleQueue(acquisitionBuffer, policyDropOldest)
+	metrics.watchQueue("decoder", payloads)
+	readErr := make(chan error, 1)
+	go func() {
+		defer payloads.Close()
+		for {
+			select {
+			case <-stop:
+				readErr <- nil
+				return
+			default:
+			}
+			payload, err := session.NextPayload()
+			received := time.Now()
+			if errors.Is(err, ErrChecksum) {
+				metrics.frames.Inc()
+				metrics.checksumFailures.Inc()
+				sinks.WriteFrame(sample{Time: received, Payload: payload, Corrupt: true})
+				logger.WithFields(log.Fields{"error": err}).Debug("Skipping sample due to a corrupt frame")
+				payloads.Put(corruptFrameMarker(received))
+				continue
+			}
+			if err != nil {
+				readErr <- err
+				return
+			}
+			metrics.frames.Inc()
+			sinks.WriteFrame(sample{Time: received, Payload: payload})
+			if len(payload) != payloadLength {
+				metrics.lengthMismatches.Inc()
+				logger.WithFields(log.Fields{"expected_payload": payloadLength, "actual_payload": len(payload)}).Debug("Skipping sample due to unexpected payload length")
+				payloads.Put(skippedPayloadMarker(received, len(payload)))
+				continue
+			}
+			payloads.Put(sample{Time: received, Payload: payload})
+		}
+	}()
+
+	// Decode on this goroutine until the reader stops and its queue drains
+	for smp := range payloads.C() {
+		if smp.Marker != "" {
+			sinks.Write(smp)
+			continue
+		}
+		smp.Values = decoder.Decode(smp.Payload)
+		metrics.sampleDecoded(time.Now())
+		sinks.Write(smp)
+	}
+
+	if dropped := payloads.Dropped(); dropped > 0 {
+		logger.WithFields(log.Fields{"dropped": dropped}).Warn("Decoder fell behind the ECU and dropped samples")
+	}
+	if err := <-readErr; err != nil {
+		return err
+	}
+	logger.Info("Received Stop Signal and discontinued logging")
+	return nil
+}
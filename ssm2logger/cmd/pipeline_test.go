@@ -0,0 +1,199 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/nanoadmin/go-ssm2logger/ssm2lib"
+)
+
+var _ = Describe("Pipeline", func() {
+	numbered := func(n int) sample {
+		return sample{Payload: []byte{byte(n)}}
+	}
+	queued := func(queue *sampleQueue) []int {
+		retval := []int{}
+		for len(queue.ch) > 0 {
+			retval = append(retval, int((<-queue.C()).Payload[0]))
+		}
+		return retval
+	}
+
+	It("Drops the oldest samples when the consumer stalls", func() {
+		queue := newSampleQueue(3, policyDropOldest)
+		for n := 1; n <= 5; n++ {
+			queue.Put(numbered(n))
+		}
+		Ω(queued(queue)).Should(Equal([]int{3, 4, 5}))
+		Ω(queue.Dropped()).Should(Equal(uint64(2)))
+	})
+
+	It("Drops the newest samples when the consumer stalls", func() {
+		queue := newSampleQueue(3, policyDropNewest)
+		for n := 1; n <= 5; n++ {
+			queue.Put(numbered(n))
+		}
+		Ω(queued(queue)).Should(Equal([]int{1, 2, 3}))
+		Ω(queue.Dropped()).Should(Equal(uint64(2)))
+	})
+
+	It("Blocks until the consumer makes room", func() {
+		queue := newSampleQueue(3, policyBlock)
+		done := make(chan struct{})
+		go func() {
+			for n := 1; n <= 4; n++ {
+				queue.Put(numbered(n))
+			}
+			close(done)
+		}()
+		Consistently(done, 50*time.Millisecond).ShouldNot(BeClosed())
+		Ω(int((<-queue.C()).Payload[0])).Should(Equal(1))
+		Eventually(done).Should(BeClosed())
+		Ω(queued(queue)).Should(Equal([]int{2, 3, 4}))
+		Ω(queue.Dropped()).Should(BeZero())
+	})
+
+	It("Drains every sample to the sinks and returns the reader's error", func() {
+		conversion, _ := CompileConversion(Ssm2ParameterConversion{Expr: "x*2", Format: "0"})
+		decoder, _ := newSampleDecoder([]ParameterMapping{{Name: "Speed", Start: 0, Length: 1, Conversion: conversion}}, nil, plausibilityOff, 0, 0)
+		recorder := &recordingSink{}
+		sinks := &sinkSet{sinks: []*sinkState{{name: "test", sink: recorder, queue: newSampleQueue(1, policyBlock)}}}
+		Ω(sinks.Open(sinkSession{})).Should(Succeed())
+
+		session := &scriptedSession{steps: []scriptedPayload{
+			{payload: []byte{1}},
+			{err: fmt.Errorf("bad frame: %w", ErrChecksum)},
+			{payload: []byte{2, 3}},
+			{payload: []byte{4}},
+			{err: errors.New("connection lost")},
+		}}
+		err := runPipeline(session, make(chan struct{}), decoder, 1, sinks)
+		sinks.Close()
+		Ω(err).Should(MatchError("connection lost"))
+		Ω(recorder.written()).Should(Equal([]string{"2", "Corrupt frame skipped", "Skipped a 2 byte payload", "8"}))
+	})
+
+	It("Records every frame read, corrupt ones included, for frame sinks", func() {
+		conversion, _ := CompileConversion(Ssm2ParameterConversion{Expr: "x*2", Format: "0"})
+		decoder, _ := newSampleDecoder([]ParameterMapping{{Name: "Speed", Start: 0, Length: 1, Conversion: conversion}}, nil, plausibilityOff, 0, 0)
+		recorder := &recordingSink{}
+		frames := &frameRecordingSink{}
+		sinks := &sinkSet{sinks: []*sinkState{
+			{name: "test", sink: recorder, queue: newSampleQueue(1, policyBlock)},
+			{name: "frames", sink: frames, queue: newSampleQueue(1, policyBlock)},
+		}}
+		Ω(sinks.Open(sinkSession{})).Should(Succeed())
+
+		session := &scriptedSession{steps: []scriptedPayload{
+			{payload: []byte{1}},
+			{payload: []byte{9}, err: fmt.Errorf("bad frame: %w", ErrChecksum)},
+			{payload: []byte{2, 3}},
+			{err: errors.New("connection lost")},
+		}}
+		Ω(runPipeline(session, make(chan struct{}), decoder, 1, sinks)).Should(MatchError("connection lost"))
+		sinks.Close()
+		Ω(recorder.written()).Should(Equal([]string{"2", "Corrupt frame skipped", "Skipped a 2 byte payload"}))
+		Ω(frames.samples).Should(HaveLen(3))
+		for idx, expected := range []sample{{Payload: []byte{1}}, {Payload: []byte{9}, Corrupt: true}, {Payload: []byte{2, 3}}} {
+			Ω(frames.samples[idx].Payload).Should(Equal(expected.Payload))
+			Ω(frames.samples[idx].Corrupt).Should(Equal(expected.Corrupt))
+			Ω(frames.samples[idx].Values).Should(BeNil())
+		}
+	})
+
+	It("Stops cleanly when asked to", func() {
+		conversion, _ := CompileConversion(Ssm2ParameterConversion{Expr: "x", Format: "0"})
+		decoder, _ := newSampleDecoder([]ParameterMapping{{Name: "Speed", Start: 0, Length: 1, Conversion: conversion}}, nil, plausibilityOff, 0, 0)
+		recorder := &recordingSink{}
+		sinks := &sinkSet{sinks: []*sinkState{{name: "test", sink: recorder, queue: newSampleQueue(1, policyBlock)}}}
+		Ω(sinks.Open(sinkSession{})).Should(Succeed())
+
+		stop := make(chan struct{})
+		session := &scriptedSession{steps: []scriptedPayload{{payload: []byte{1}}, {payload: []byte{2}}}, stop: stop}
+		Ω(runPipeline(session, stop, decoder, 1, sinks)).Should(Succeed())
+		sinks.Close()
+		Ω(recorder.written()).Should(Equal([]string{"1", "2"}))
+	})
+})
+
+// recordingSink keeps everything written to it.
+type recordingSink struct {
+	mu      sync.Mutex
+	samples []sample
+	opened  bool
+	closed  bool
+}
+
+func (r *recordingSink) Open(session sinkSession) error {
+	r.opened = true
+	return nil
+}
+
+func (r *recordingSink) Write(smp sample) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.samples = append(r.samples, smp)
+	return nil
+}
+
+func (r *recordingSink) Mark(smp sample) error {
+	return r.Write(smp)
+}
+
+func (r *recordingSink) Close() error {
+	r.closed = true
+	return nil
+}
+
+// written lists each sample's first value, or its marker.
+func (r *recordingSink) written() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	retval := []string{}
+	for _, smp := range r.samples {
+		if smp.Marker != "" {
+			retval = append(retval, smp.Marker)
+		} else {
+			retval = append(retval, smp.Values[0].FormatValue())
+		}
+	}
+	return retval
+}
+
+// frameRecordingSink keeps every frame it's sent.
+type frameRecordingSink struct {
+	recordingSink
+}
+
+func (r *frameRecordingSink) recordsFrames() {}
+
+type scriptedPayload struct {
+	payload []byte
+	err     error
+}
+
+// scriptedSession returns its steps from NextPayload, then closes stop if
+// it has one.
+type scriptedSession struct {
+	EcuSession
+	steps []scriptedPayload
+	stop  chan struct{}
+}
+
+func (s *scriptedSession) NextPayload() ([]byte, error) {
+	if len(s.steps) == 0 {
+		return nil, errors.New("read after the last step")
+	}
+	step := s.steps[0]
+	s.steps = s.steps[1:]
+	if len(s.steps) == 0 && s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+	return step.payload, step.err
+}
@@ -0,0 +1,178 @@
+package cmd
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var queryDbPath string
+var queryFormat string
+
+var queryCmd = &cobra.Command{
+	Use:   "query <sql>",
+	Short: "Run SQL against a database written by the sqlite sink",
+	Long: `Runs a SQL statement against a database written by the sqlite sink and
+prints the result as CSV or JSON. Like defs, it doesn't need --port or an ECU.
+The database is opened read-only, so it can be queried while a session is
+writing to it.
+
+The readings view joins every value with its sample, session and parameter,
+for example:
+
+  ssm2logger query --db logs/ssm2logger.db \
+    "SELECT ts, value FROM readings WHERE key = 'engine_speed_rpm' AND session_id = 3"`,
+	Args: cobra.ExactArgs(1),
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		setupLogger()
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if queryFormat != "csv" && queryFormat != "json" {
+			return fmt.Errorf("unsupported format %q; expected csv or json", queryFormat)
+		}
+		// A clearer error than SQLite's for a typo
+		if _, err := os.Stat(queryDbPath); err != nil {
+			return err
+		}
+		db, err := openSqliteReadOnly(queryDbPath)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		rows, err := db.Query(args[0])
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		if queryFormat == "json" {
+			err = writeQueryJson(os.Stdout, rows)
+		} else {
+			err = writeQueryCsv(os.Stdout, rows)
+		}
+		if err != nil {
+			return err
+		}
+		return rows.Err()
+	},
+}
+
+// scanQueryRow reads the current row with whatever types SQLite returns.
+// queryJsonObject writes a row as a JSON object by hand, as a map would sort
+// its keys and lose all but one of the columns that share a name.
+func queryJsonObject(columns []string, values []interface{}) (string, error) {
+	var object strings.Builder
+	object.WriteString("{")
+	for idx, column := range columns {
+		key, err := json.Marshal(column)
+		if err != nil {
+			return "", err
+		}
+		value, err := json.Marshal(values[idx])
+		if err != nil {
+			return "", err
+		}
+		if idx > 0 {
+			object.WriteString(",")
+		}
+		object.Write(key)
+		object.WriteString(":")
+		object.Write(value)
+	}
+	object.WriteString("}")
+	return object.String(), nil
+}
+
+func scanQueryRow(rows *sql.Rows, width int) ([]interface{}, error) {
+	values := make([]interface{}, width)
+	pointers := make([]interface{}, width)
+	for idx := range values {
+		pointers[idx] = &values[idx]
+	}
+	if err := rows.Scan(pointers...); err != nil {
+		return nil, err
+	}
+	for idx, value := range values {
+		if b, ok := value.([]byte); ok {
+			values[idx] = string(b)
+		}
+	}
+	return values, nil
+}
+
+func writeQueryCsv(out io.Writer, rows *sql.Rows) error {
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	writer := csv.NewWriter(out)
+	writer.Write(columns)
+	for rows.Next() {
+		values, err := scanQueryRow(rows, len(columns))
+		if err != nil {
+			return err
+		}
+		record := make([]string, len(values))
+		for idx, value := range values {
+			switch v := value.(type) {
+			case nil:
+			case float64:
+				record[idx] = strconv.FormatFloat(v, 'f', -1, 64)
+			default:
+				record[idx] = fmt.Sprint(v)
+			}
+		}
+		writer.Write(record)
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// writeQueryJson streams the rows as a JSON array of objects keyed by column,
+// in the query's column order.
+func writeQueryJson(out io.Writer, rows *sql.Rows) error {
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(out, "["); err != nil {
+		return err
+	}
+	separator := "\n"
+	for rows.Next() {
+		values, err := scanQueryRow(rows, len(columns))
+		if err != nil {
+			return err
+		}
+		line, err := queryJsonObject(columns, values)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(out, separator+"  "+line); err != nil {
+			return err
+		}
+		separator = ",\n"
+	}
+	if separator == "\n" {
+		_, err = io.WriteString(out, "]\n")
+	} else {
+		_, err = io.WriteString(out, "\n]\n")
+	}
+	return err
+}
+
+func init() {
+	rootCmd.AddCommand(queryCmd)
+
+	queryCmd.Flags().StringVar(&queryDbPath, "db", defaultSqliteFile, "SQLite database written by --sink sqlite")
+	queryCmd.Flags().StringVar(&queryFormat, "format", "csv", "Output format: csv or json")
+}
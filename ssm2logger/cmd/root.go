@@ -18,6 +18,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"time"
 
 	homedir "github.com/mitchellh/go-homedir"
 	log "github.com/sirupsen/logrus"
@@ -28,6 +29,13 @@ import (
 var logger *log.Logger
 var cfgFile string
 var port string
+var protocolId string
+var serialBaud int
+var serialDataBits int
+var serialStopBits int
+var serialParity string
+var connectTimeout time.Duration
+var sendTimeout time.Duration
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
@@ -43,8 +51,7 @@ to quickly create a Cobra application.`,
 	// has an action associated with it:
 	//	Run: func(cmd *cobra.Command, args []string) { },
 	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
-		logger = log.New()
-		logger.SetLevel(log.InfoLevel)
+		setupLogger()
 
 		if port == "" {
 			errorMsg := "You must supply the --port flag."
@@ -54,6 +61,11 @@ to quickly create a Cobra application.`,
 	},
 }
 
+func setupLogger() {
+	logger = log.New()
+	logger.SetLevel(log.InfoLevel)
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
@@ -71,6 +83,13 @@ func init() {
 	// will be global for your application.
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.ssm2logger.yaml)")
 	rootCmd.PersistentFlags().StringVar(&port, "port", "", "The Serial port to connect to. Example: /dev/ttyUSB0")
+	rootCmd.PersistentFlags().StringVar(&protocolId, "protocol", "SSM", "Protocol section of the definitions to use: SSM, or OBD for generic OBD-II PIDs through an ELM327 adapter")
+	rootCmd.PersistentFlags().IntVar(&serialBaud, "baud", 0, "Serial baud rate (default: from the protocol in the definitions, else 4800)")
+	rootCmd.PersistentFlags().IntVar(&serialDataBits, "databits", 0, "Serial data bits (default: from the definitions, else 8)")
+	rootCmd.PersistentFlags().IntVar(&serialStopBits, "stopbits", 0, "Serial stop bits, 1 or 2 (default: from the definitions, else 1)")
+	rootCmd.PersistentFlags().StringVar(&serialParity, "parity", "", "Serial parity: none, odd, even, mark or space (default: from the definitions, else none)")
+	rootCmd.PersistentFlags().DurationVar(&connectTimeout, "connect-timeout", 0, "How long to keep retrying the ECU init request (default: from the definitions, else 2s)")
+	rootCmd.PersistentFlags().DurationVar(&sendTimeout, "send-timeout", 0, "How long to wait for the ECU to answer a request; serial reads always wait at least 1s (default: from the definitions, else 1s)")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -0,0 +1,269 @@
+package cmd
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultMinFree is how much free space a file sink needs to start.
+const defaultMinFree = 100 << 20
+
+// errLowDiskSpace is returned by a file sink's Open when the disk is too
+// full to start logging. Unlike other failures to open a sink, it stops the
+// session from starting.
+var errLowDiskSpace = errors.New("not enough free space to log")
+
+var byteSizeUnits = map[string]int64{"": 1, "k": 1 << 10, "m": 1 << 20, "g": 1 << 30, "t": 1 << 40}
+
+// byteSizePattern is a number, optionally followed by a unit, "i" only after
+// a unit, and "b".
+var byteSizePattern = regexp.MustCompile(`^(\d+)\s*(?:([kmgt])i?)?b?$`)
+
+// parseByteSize parses sizes like 512k, 50MB or 1GiB, in powers of 1024.
+func parseByteSize(value string) (int64, error) {
+	match := byteSizePattern.FindStringSubmatch(strings.ToLower(strings.TrimSpace(value)))
+	if match == nil {
+		return 0, fmt.Errorf("%q is not a size like 512k, 50MB or 1GB", value)
+	}
+	number, err := strconv.ParseInt(match[1], 10, 64)
+	multiplier := byteSizeUnits[match[2]]
+	if err != nil || number > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("%q is too large", value)
+	}
+	return number * multiplier, nil
+}
+
+func (o sinkOptions) Size(key string, def int64) (int64, error) {
+	value, ok := o[key]
+	if !ok {
+		return def, nil
+	}
+	delete(o, key)
+	parsed, err := parseByteSize(value)
+	if err != nil {
+		return 0, fmt.Errorf("option %s: %s", key, err)
+	}
+	return parsed, nil
+}
+
+// countingWriter counts the bytes written through it, for rotate_size.
+type countingWriter struct {
+	w       io.Writer
+	written int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.written += int64(n)
+	return n, err
+}
+
+// logRotation is the rotate_*, compress, retain_* and min_free options of a
+// file sink. The sink decides when a file is finished and calls Finished;
+// compressing it and deleting old files then happen in the background, one
+// file at a time.
+type logRotation struct {
+	size        int64
+	every       time.Duration
+	compress    string
+	retainBytes int64
+	retainAge   time.Duration
+	retainFiles int
+	minFree     int64
+
+	// patterns match the sink's finished files, compressed or not, for
+	// retention.
+	patterns []string
+	mu       sync.Mutex
+	pending  sync.WaitGroup
+}
+
+func newLogRotation(opts sinkOptions) (*logRotation, error) {
+	r := &logRotation{}
+	var err error
+	if r.size, err = opts.Size("rotate_size", 0); err != nil {
+		return nil, err
+	}
+	if r.every, err = opts.Duration("rotate_every", 0); err != nil {
+		return nil, err
+	}
+	r.compress = strings.ToLower(opts.String("compress", ""))
+	if r.compress != "" && r.compress != "gzip" && r.compress != "zstd" {
+		return nil, fmt.Errorf("unknown compression %q; expected gzip or zstd", r.compress)
+	}
+	if r.retainBytes, err = opts.Size("retain_size", 0); err != nil {
+		return nil, err
+	}
+	if r.retainAge, err = opts.Duration("retain_age", 0); err != nil {
+		return nil, err
+	}
+	if r.retainFiles, err = opts.Int("retain_files", 0); err == nil && r.retainFiles < 0 {
+		err = fmt.Errorf("retain_files can't be negative")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.minFree, err = opts.Size("min_free", defaultMinFree); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Due reports whether a file opened at opened with written bytes in it
+// should be rotated.
+func (r *logRotation) Due(written int64, opened time.Time) bool {
+	return (r.size > 0 && written >= r.size) || (r.every > 0 && time.Since(opened) >= r.every)
+}
+
+// Start applies retention to the files left by earlier sessions and then
+// returns errLowDiskSpace when dir is critically low on space.
+func (r *logRotation) Start(dir string) error {
+	r.mu.Lock()
+	r.retain("")
+	r.mu.Unlock()
+	if r.minFree <= 0 {
+		return nil
+	}
+	free, err := freeSpace(dir)
+	if err != nil {
+		logger.WithFields(log.Fields{"dir": dir, "error": err}).Warn("Unable to check free space")
+		return nil
+	}
+	if free < uint64(r.minFree) {
+		return fmt.Errorf("%w: only %d MiB free in %s, less than min_free of %d MiB", errLowDiskSpace, free>>20, dir, r.minFree>>20)
+	}
+	return nil
+}
+
+// Finished compresses a closed file and applies retention in the background.
+// active is the file now being written, which retention leaves alone.
+func (r *logRotation) Finished(path string, active string) {
+	r.pending.Add(1)
+	go func() {
+		defer r.pending.Done()
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.compress != "" {
+			if err := compressFile(path, r.compress); err != nil {
+				logger.WithFields(log.Fields{"file": path, "error": err}).Warn("Unable to compress log file")
+			}
+		}
+		r.retain(active)
+	}()
+}
+
+// Wait blocks until every finished file has been dealt with.
+func (r *logRotation) Wait() {
+	r.pending.Wait()
+}
+
+// retain deletes the oldest finished files until every retain_* limit is
+// met. Callers hold mu.
+func (r *logRotation) retain(active string) {
+	if r.retainBytes <= 0 && r.retainAge <= 0 && r.retainFiles <= 0 {
+		return
+	}
+	files := []os.FileInfo{}
+	paths := map[os.FileInfo]string{}
+	for _, pattern := range r.patterns {
+		matches, _ := filepath.Glob(pattern)
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil || info.IsDir() || match == active || isCompressing(match) {
+				continue
+			}
+			files = append(files, info)
+			paths[info] = match
+		}
+	}
+	// Newest first
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().After(files[j].ModTime()) })
+
+	var total int64
+	for idx, info := range files {
+		total += info.Size()
+		expired := (r.retainFiles > 0 && idx >= r.retainFiles) ||
+			(r.retainAge > 0 && time.Since(info.ModTime()) > r.retainAge) ||
+			(r.retainBytes > 0 && total > r.retainBytes)
+		if !expired {
+			continue
+		}
+		if err := os.Remove(paths[info]); err != nil {
+			logger.WithFields(log.Fields{"file": paths[info], "error": err}).Warn("Unable to delete old log file")
+			continue
+		}
+		total -= info.Size()
+		logger.WithFields(log.Fields{"file": paths[info]}).Info("Deleted old log file")
+	}
+}
+
+// compressingSuffix is added to a file while it's being compressed.
+const compressingSuffix = ".tmp"
+
+func isCompressing(path string) bool {
+	return strings.HasSuffix(path, compressingSuffix)
+}
+
+// compressFile replaces path with path.gz or path.zst. The original is only
+// removed once the compressed copy is complete.
+func compressFile(path string, compression string) (err error) {
+	target := path + ".gz"
+	if compression == "zstd" {
+		target = path + ".zst"
+	}
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(target + compressingSuffix)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			out.Close()
+			os.Remove(target + compressingSuffix)
+		}
+	}()
+
+	var encoder io.WriteCloser
+	if compression == "zstd" {
+		if encoder, err = zstd.NewWriter(out); err != nil {
+			return err
+		}
+	} else {
+		encoder = gzip.NewWriter(out)
+	}
+	if _, err = io.Copy(encoder, in); err != nil {
+		return err
+	}
+	if err = encoder.Close(); err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(target+compressingSuffix, target); err != nil {
+		return err
+	}
+	// Keep the original's time so retention orders files by when they were written
+	if info, statErr := in.Stat(); statErr == nil {
+		os.Chtimes(target, info.ModTime(), info.ModTime())
+	}
+	return os.Remove(path)
+}
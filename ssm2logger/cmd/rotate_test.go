@@ -0,0 +1,231 @@
+package cmd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	. "github.com/nanoadmin/go-ssm2logger/ssm2lib"
+)
+
+var _ = Describe("Rotation", func() {
+	var dir string
+	now := time.Now()
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "rotate")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	// logFile writes size bytes to name in dir, last modified age ago.
+	logFile := func(name string, size int, age time.Duration) string {
+		path := filepath.Join(dir, name)
+		Ω(ioutil.WriteFile(path, bytes.Repeat([]byte("x"), size), 0644)).Should(Succeed())
+		Ω(os.Chtimes(path, now.Add(-age), now.Add(-age))).Should(Succeed())
+		return path
+	}
+	left := func() []string {
+		paths, _ := filepath.Glob(filepath.Join(dir, "*"))
+		names := []string{}
+		for _, path := range paths {
+			names = append(names, filepath.Base(path))
+		}
+		return names
+	}
+	rotation := func(opts sinkOptions) *logRotation {
+		opts["min_free"] = "0"
+		r, err := newLogRotation(opts)
+		Ω(err).ShouldNot(HaveOccurred())
+		r.patterns = []string{filepath.Join(dir, "*-log*.csv"), filepath.Join(dir, "*-log*.csv.*")}
+		return r
+	}
+	// Four finished logs, the newest first
+	finishedLogs := func() {
+		logFile("a-log.csv", 10, time.Minute)
+		logFile("b-log.csv.gz", 10, 2*time.Hour)
+		logFile("c-log.csv", 10, 3*time.Hour)
+		logFile("d-log.csv.zst", 10, 4*time.Hour)
+		logFile("notes.txt", 10, 5*time.Hour)
+	}
+
+	table.DescribeTable("Deletes the oldest logs first",
+		func(opts sinkOptions, kept []string) {
+			finishedLogs()
+			Ω(rotation(opts).Start(dir)).Should(Succeed())
+			Ω(left()).Should(Equal(kept))
+		},
+		table.Entry("By count", sinkOptions{"retain_files": "2"}, []string{"a-log.csv", "b-log.csv.gz", "notes.txt"}),
+		table.Entry("By age", sinkOptions{"retain_age": "150m"}, []string{"a-log.csv", "b-log.csv.gz", "notes.txt"}),
+		table.Entry("By size", sinkOptions{"retain_size": "35"}, []string{"a-log.csv", "b-log.csv.gz", "c-log.csv", "notes.txt"}),
+		table.Entry("By the strictest limit", sinkOptions{"retain_files": "3", "retain_age": "1h", "retain_size": "1k"}, []string{"a-log.csv", "notes.txt"}),
+		table.Entry("Not without a limit", sinkOptions{}, []string{"a-log.csv", "b-log.csv.gz", "c-log.csv", "d-log.csv.zst", "notes.txt"}),
+	)
+
+	It("Leaves the active file and files being compressed alone", func() {
+		active := logFile("a-log.csv", 10, 10*time.Hour)
+		logFile("b-log.csv.gz.tmp", 10, 10*time.Hour)
+		logFile("c-log.csv", 10, time.Minute)
+		logFile("d-log.csv", 10, 2*time.Minute)
+		r := rotation(sinkOptions{"retain_files": "1"})
+		r.retain(active)
+		Ω(left()).Should(Equal([]string{"a-log.csv", "b-log.csv.gz.tmp", "c-log.csv"}))
+	})
+
+	table.DescribeTable("Compresses to a file that decompresses to the original",
+		func(compression string, extension string, decompress func(io.Reader) (io.Reader, error)) {
+			original := bytes.Repeat([]byte("timestamp,Engine Speed (rpm)\n1717243200,812\n"), 1000)
+			path := filepath.Join(dir, "a-log.csv")
+			Ω(ioutil.WriteFile(path, original, 0644)).Should(Succeed())
+			modified := now.Add(-time.Hour).Truncate(time.Second)
+			Ω(os.Chtimes(path, modified, modified)).Should(Succeed())
+
+			Ω(compressFile(path, compression)).Should(Succeed())
+			Ω(left()).Should(Equal([]string{"a-log.csv" + extension}))
+			info, err := os.Stat(path + extension)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(info.ModTime().Equal(modified)).Should(BeTrue())
+			Ω(info.Size()).Should(BeNumerically("<", len(original)/10))
+
+			file, err := os.Open(path + extension)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer file.Close()
+			reader, err := decompress(file)
+			Ω(err).ShouldNot(HaveOccurred())
+			decompressed, err := ioutil.ReadAll(reader)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(decompressed).Should(Equal(original))
+		},
+		table.Entry("gzip", "gzip", ".gz", func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }),
+		table.Entry("zstd", "zstd", ".zst", func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) }),
+	)
+
+	table.DescribeTable("Parses sizes in powers of 1024",
+		func(value string, expected int64) {
+			Ω(parseByteSize(value)).Should(Equal(expected))
+		},
+		table.Entry("Bytes", "512", int64(512)),
+		table.Entry("Bytes with a b", "512b", int64(512)),
+		table.Entry("Zero", "0", int64(0)),
+		table.Entry("Kilobytes", "512k", int64(512<<10)),
+		table.Entry("Megabytes", "50MB", int64(50<<20)),
+		table.Entry("Gibibytes", "1GiB", int64(1<<30)),
+		table.Entry("Ki without b", "2Ki", int64(2<<10)),
+		table.Entry("Terabytes with a space", " 2 TB ", int64(2<<40)),
+	)
+
+	table.DescribeTable("Refuses what isn't a size",
+		func(value string) {
+			_, err := parseByteSize(value)
+			Ω(err).Should(HaveOccurred())
+		},
+		table.Entry("Empty", ""),
+		table.Entry("i without a unit", "1i"),
+		table.Entry("ib without a unit", "1ib"),
+		table.Entry("Unknown unit", "1p"),
+		table.Entry("No number", "MB"),
+		table.Entry("Negative", "-1k"),
+		table.Entry("Fraction", "1.5g"),
+		table.Entry("Two units", "1kmb"),
+		table.Entry("Overflow", "9999999999999t"),
+	)
+
+	It("Refuses to start the session when the disk is too full", func() {
+		other := &recordingSink{}
+		sinks := &sinkSet{sinks: []*sinkState{{name: "test", sink: other, queue: newSampleQueue(1, policyBlock)}}}
+		state, err := newSinkState("csv:"+dir+";min_free=1000000t", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		sinks.sinks = append(sinks.sinks, state)
+
+		err = sinks.Open(sinkSession{Info: &EcuInfo{Protocol: ProtocolSsm}, Started: now})
+		Ω(errors.Is(err, errLowDiskSpace)).Should(BeTrue())
+		Ω(err.Error()).Should(HavePrefix("sink csv:" + dir + ": not enough free space to log: only "))
+		Ω(left()).Should(BeEmpty())
+		// The sink that did open is closed again
+		Eventually(sinks.sinks[0].queue.C()).Should(BeClosed())
+	})
+
+	Context("Of sinks", func() {
+		conversion, _ := CompileConversion(Ssm2ParameterConversion{Expr: "x", Format: "0"})
+		session := sinkSession{
+			Info:    &EcuInfo{Protocol: ProtocolSsm, RomId: []byte{1, 2, 3, 4, 5}},
+			Columns: []outputColumn{{Name: "Speed"}},
+			Started: time.Unix(1717243200, 0),
+		}
+		numbered := func(n int) sample {
+			return sample{Time: session.Started.Add(time.Duration(n) * time.Second), Values: []decodedValue{
+				{Column: session.Columns[0], Value: float64(n), Valid: true, formatter: conversion},
+			}}
+		}
+		write := func(sink Sink, samples int) {
+			Ω(sink.Open(session)).Should(Succeed())
+			for n := 1; n <= samples; n++ {
+				Ω(sink.Write(numbered(n))).Should(Succeed())
+			}
+			Ω(sink.Close()).Should(Succeed())
+		}
+		read := func(name string) string {
+			content, err := ioutil.ReadFile(filepath.Join(dir, name))
+			Ω(err).ShouldNot(HaveOccurred())
+			return string(content)
+		}
+
+		It("Splits CSV by size, with a header in every part", func() {
+			sink, err := newCsvSink(dir, sinkOptions{"rotate_size": "40", "min_free": "0"})
+			Ω(err).ShouldNot(HaveOccurred())
+			// The header and each row are 17 bytes
+			write(sink, 4)
+			Ω(left()).Should(Equal([]string{"0102030405-1717243200-log-2.csv", "0102030405-1717243200-log.csv"}))
+			Ω(read("0102030405-1717243200-log.csv")).Should(Equal("timestamp,Speed\n1717243201,1\n1717243202,2\n"))
+			Ω(read("0102030405-1717243200-log-2.csv")).Should(Equal("timestamp,Speed\n1717243203,3\n1717243204,4\n"))
+		})
+
+		It("Splits CSV by time and compresses the finished parts", func() {
+			sink, err := newCsvSink(dir, sinkOptions{"rotate_every": "1ns", "compress": "gzip", "min_free": "0"})
+			Ω(err).ShouldNot(HaveOccurred())
+			write(sink, 3)
+			// Every sample starts a part, and Close finishes the last one
+			Ω(left()).Should(Equal([]string{
+				"0102030405-1717243200-log-2.csv.gz", "0102030405-1717243200-log-3.csv.gz",
+				"0102030405-1717243200-log-4.csv.gz", "0102030405-1717243200-log.csv.gz",
+			}))
+		})
+
+		It("Splits NDJSON by size, renaming the finished file", func() {
+			sink, err := newNdjsonSink(filepath.Join(dir, "drive.ndjson"), sinkOptions{"rotate_size": "100", "retain_files": "1", "min_free": "0"})
+			Ω(err).ShouldNot(HaveOccurred())
+			write(sink, 3)
+			names := left()
+			Ω(names).Should(HaveLen(2))
+			Ω(names[0]).Should(MatchRegexp(`^drive-\d+\.ndjson$`))
+			Ω(names[1]).Should(Equal("drive.ndjson"))
+			Ω(strings.Count(read(names[0]), "\n")).Should(Equal(2))
+			Ω(read("drive.ndjson")).Should(HavePrefix(`{"ts":1717243203000,`))
+		})
+
+		It("Splits NDJSON by time and keeps the newest finished files", func() {
+			sink, err := newNdjsonSink(filepath.Join(dir, "drive.ndjson"), sinkOptions{"rotate_every": "1ns", "retain_files": "1", "min_free": "0"})
+			Ω(err).ShouldNot(HaveOccurred())
+			write(sink, 3)
+			names := left()
+			Ω(names).Should(HaveLen(2))
+			Ω(read(names[0])).Should(HavePrefix(`{"ts":1717243202000,`))
+			Ω(read("drive.ndjson")).Should(HavePrefix(`{"ts":1717243203000,`))
+		})
+	})
+})
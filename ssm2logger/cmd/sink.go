@@ -0,0 +1,393 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/nanoadmin/go-ssm2logger/ssm2lib"
+	log "github.com/sirupsen/logrus"
+)
+
+// sinkErrorLogInterval limits how often a failing sink is logged.
+const sinkErrorLogInterval = 10 * time.Second
+
+// defaultSinkBuffer is how many samples a sink may fall behind by.
+const defaultSinkBuffer = 256
+
+// sample is one sample moving through the pipeline: the raw payload from
+// the ECU and, once decoded, its values. A sample with a Marker is instead
+// an event in the session, like a corrupt frame, and only reaches sinks
+// that implement markerSink.
+type sample struct {
+	Time    time.Time
+	Payload []byte
+	Values  []decodedValue
+	Marker  string
+	// Corrupt marks a frame that failed its checksum. Only frame sinks get
+	// those, with the payload as it was received.
+	Corrupt bool
+}
+
+// sinkSession describes the logging session to a sink when it's opened.
+type sinkSession struct {
+	Info         *EcuInfo
+	Columns      []outputColumn
+	Plausibility string
+	Started      time.Time
+	// DefinitionsVersion is the version attribute of --defs, and
+	// DefinitionsHash covers it and the overlays.
+	DefinitionsVersion string
+	DefinitionsHash    string
+	// Mappings are where each parameter's bytes sit in the payloads.
+	Mappings []ParameterMapping
+}
+
+// Sink is an output of the logging pipeline. Open is called once before the
+// first sample and Close once at the end. Each sink is fed from its own
+// goroutine and queue, so a slow or failing sink doesn't hold up the others:
+// errors are logged and the session carries on.
+type Sink interface {
+	Open(session sinkSession) error
+	Write(s sample) error
+	Close() error
+}
+
+// markerSink is implemented by sinks that can annotate the log with events.
+type markerSink interface {
+	Mark(s sample) error
+}
+
+// frameSink is implemented by sinks that record every frame read from the
+// ECU, corrupt ones and those of the wrong length included, rather than
+// decoded samples. They're fed by the reader before the decoder's queue,
+// which drops samples when decoding falls behind.
+type frameSink interface {
+	Sink
+	recordsFrames()
+}
+
+// sinkOptions are the ";key=value" options of a --sink spec. Factories take
+// the ones they understand; anything left over is an error.
+type sinkOptions map[string]string
+
+func parseSinkOptions(parts []string) (sinkOptions, error) {
+	opts := sinkOptions{}
+	for _, part := range parts {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("option %q should be key=value", part)
+		}
+		opts[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.TrimSpace(kv[1])
+	}
+	return opts, nil
+}
+
+// String removes and returns an option, or def when it isn't set.
+func (o sinkOptions) String(key string, def string) string {
+	if value, ok := o[key]; ok {
+		delete(o, key)
+		return value
+	}
+	return def
+}
+
+func (o sinkOptions) Int(key string, def int) (int, error) {
+	value, ok := o[key]
+	if !ok {
+		return def, nil
+	}
+	delete(o, key)
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("option %s: %q is not a number", key, value)
+	}
+	return parsed, nil
+}
+
+func (o sinkOptions) Bool(key string, def bool) (bool, error) {
+	value, ok := o[key]
+	if !ok {
+		return def, nil
+	}
+	delete(o, key)
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("option %s: %q is not true or false", key, value)
+	}
+	return parsed, nil
+}
+
+func (o sinkOptions) Duration(key string, def time.Duration) (time.Duration, error) {
+	value, ok := o[key]
+	if !ok {
+		return def, nil
+	}
+	delete(o, key)
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("option %s: %q is not a duration", key, value)
+	}
+	return parsed, nil
+}
+
+// sinkFactory creates a sink from the target part of a --sink spec, which
+// may be empty, and its options.
+type sinkFactory func(target string, opts sinkOptions) (Sink, error)
+
+type sinkKind struct {
+	factory sinkFactory
+	// policy is the queue policy used unless the spec sets one.
+	policy string
+}
+
+// sinkKinds maps the kind part of a --sink spec to its factory. Sinks
+// register themselves from their own file's init.
+var sinkKinds = map[string]sinkKind{}
+
+func registerSink(kind string, policy string, factory sinkFactory) {
+	sinkKinds[kind] = sinkKind{factory: factory, policy: policy}
+}
+
+func sinkKindNames() string {
+	kinds := []string{}
+	for kind := range sinkKinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return strings.Join(kinds, ", ")
+}
+
+// sinkState is one configured sink with its queue and error counters.
+type sinkState struct {
+	// name is the --sink spec without its options, which may hold
+	// credentials, and with any in its URL hidden, for logs and metrics.
+	name             string
+	sink             Sink
+	queue            *sampleQueue
+	open             bool
+	errors           int
+	suppressedErrors int
+	lastErrorLog     time.Time
+}
+
+// newSinkState parses a --sink spec of the form kind[:target][;key=value...].
+// The policy and buffer options apply to every sink. Without a policy option
+// the sink gets policy, or its kind's default when that's empty.
+func newSinkState(spec string, policy string) (*sinkState, error) {
+	parts := strings.Split(spec, ";")
+	kind, target := parts[0], ""
+	if idx := strings.Index(parts[0], ":"); idx >= 0 {
+		kind, target = parts[0][:idx], parts[0][idx+1:]
+	}
+	name := kind
+	if target != "" {
+		name += ":" + redactUrl(target)
+	}
+	registered, ok := sinkKinds[strings.ToLower(kind)]
+	if !ok {
+		return nil, fmt.Errorf("unknown sink %q; expected one of %s", kind, sinkKindNames())
+	}
+	opts, err := parseSinkOptions(parts[1:])
+	if err != nil {
+		return nil, fmt.Errorf("sink %s: %s", name, err)
+	}
+
+	if policy == "" {
+		policy = registered.policy
+	}
+	policy = opts.String("policy", policy)
+	if err := validateQueuePolicy(policy); err != nil {
+		return nil, fmt.Errorf("sink %s: %s", name, err)
+	}
+	buffer, err := opts.Int("buffer", defaultSinkBuffer)
+	if err == nil && buffer < 1 {
+		err = fmt.Errorf("buffer must be at least 1")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sink %s: %s", name, err)
+	}
+
+	sink, err := registered.factory(target, opts)
+	if err != nil {
+		return nil, fmt.Errorf("sink %s: %s", name, err)
+	}
+	if len(opts) > 0 {
+		unknown := []string{}
+		for key := range opts {
+			unknown = append(unknown, key)
+		}
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("sink %s: unknown options %s", name, strings.Join(unknown, ", "))
+	}
+	state := &sinkState{name: name, sink: sink, queue: newSampleQueue(buffer, policy)}
+	metrics.watchQueue(state.name, state.queue)
+	return state, nil
+}
+
+// redactedQueryParams are URL query parameters that hold credentials, like
+// InfluxDB v1's p.
+var redactedQueryParams = []string{"p", "password", "token"}
+
+// redactUrl hides the password and credential query parameters of a URL so
+// it can be logged. Anything that isn't a URL is returned as is.
+func redactUrl(target string) string {
+	parsed, err := url.Parse(target)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return target
+	}
+	query := parsed.Query()
+	redacted := false
+	for _, param := range redactedQueryParams {
+		if query.Get(param) != "" {
+			query.Set(param, "xxxxx")
+			redacted = true
+		}
+	}
+	if redacted {
+		parsed.RawQuery = query.Encode()
+	}
+	return parsed.Redacted()
+}
+
+// sinkSet fans samples out to every sink through their queues.
+type sinkSet struct {
+	sinks []*sinkState
+	wg    sync.WaitGroup
+}
+
+// newSinkSet creates the sinks of specs, with policy for those that don't set
+// one as newSinkState does.
+func newSinkSet(specs []string, policy string) (*sinkSet, error) {
+	set := &sinkSet{}
+	for _, spec := range specs {
+		state, err := newSinkState(spec, policy)
+		if err != nil {
+			return nil, err
+		}
+		set.sinks = append(set.sinks, state)
+	}
+	return set, nil
+}
+
+// errLogExists is returned by a file sink's Open when its file is already
+// there. Like errLowDiskSpace, it stops the session from starting.
+var errLogExists = errors.New("log file already exists")
+
+// createLogFile creates a session's file, refusing to replace one that's
+// already there: decode names its files after the logged session, so it
+// would otherwise truncate the ones written while logging.
+func createLogFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if errors.Is(err, fs.ErrExist) {
+		return nil, fmt.Errorf("%w, not overwriting %s", errLogExists, path)
+	}
+	return file, err
+}
+
+// Open opens every sink and starts its goroutine. Sinks that fail to open
+// are logged and left out of the session; it's only an error when none of
+// them opened, or when one found the disk too full to log to or its file
+// already there, in which case the sinks already opened are closed again.
+func (s *sinkSet) Open(session sinkSession) error {
+	opened := 0
+	for _, state := range s.sinks {
+		if err := state.sink.Open(session); err != nil {
+			if errors.Is(err, errLowDiskSpace) || errors.Is(err, errLogExists) {
+				s.Close()
+				return fmt.Errorf("sink %s: %w", state.name, err)
+			}
+			logger.WithFields(log.Fields{"sink": state.name, "error": err}).Error("Unable to open sink, continuing without it")
+			continue
+		}
+		state.open = true
+		opened++
+
+		s.wg.Add(1)
+		go func(state *sinkState) {
+			defer s.wg.Done()
+			for smp := range state.queue.C() {
+				var err error
+				if smp.Marker != "" {
+					err = state.sink.(markerSink).Mark(smp)
+				} else {
+					err = state.sink.Write(smp)
+				}
+				if err != nil {
+					state.recordError(err)
+				}
+			}
+		}(state)
+	}
+	if opened == 0 {
+		return fmt.Errorf("none of the sinks could be opened")
+	}
+	return nil
+}
+
+// Write queues a decoded sample for every open sink but the frame sinks,
+// following each sink's policy. Markers are only queued for the sinks that
+// take them.
+func (s *sinkSet) Write(smp sample) {
+	for _, state := range s.sinks {
+		if _, ok := state.sink.(frameSink); !state.open || ok {
+			continue
+		}
+		if _, ok := state.sink.(markerSink); smp.Marker != "" && !ok {
+			continue
+		}
+		state.queue.Put(smp)
+	}
+}
+
+// WriteFrame queues a frame read from the ECU for every open frame sink.
+// It's called from the reader, so only one goroutine calls it.
+func (s *sinkSet) WriteFrame(frame sample) {
+	for _, state := range s.sinks {
+		if _, ok := state.sink.(frameSink); state.open && ok {
+			state.queue.Put(frame)
+		}
+	}
+}
+
+func (state *sinkState) recordError(err error) {
+	state.errors++
+	metrics.sinkErrors.WithLabelValues(state.name).Inc()
+	if time.Since(state.lastErrorLog) < sinkErrorLogInterval {
+		state.suppressedErrors++
+		return
+	}
+	logger.WithFields(log.Fields{"sink": state.name, "error": err, "suppressed": state.suppressedErrors}).Warn("Sink failed to write a sample")
+	state.lastErrorLog = time.Now()
+	state.suppressedErrors = 0
+}
+
+// Close lets every sink drain its queue, closes it and logs a summary of the
+// ones that failed or dropped samples.
+func (s *sinkSet) Close() {
+	for _, state := range s.sinks {
+		if state.open {
+			state.queue.Close()
+		}
+	}
+	s.wg.Wait()
+
+	for _, state := range s.sinks {
+		if !state.open {
+			continue
+		}
+		if err := state.sink.Close(); err != nil {
+			logger.WithFields(log.Fields{"sink": state.name, "error": err}).Error("Unable to close sink")
+		}
+		if state.errors > 0 || state.queue.Dropped() > 0 {
+			logger.WithFields(log.Fields{"sink": state.name, "errors": state.errors, "dropped": state.queue.Dropped(), "policy": state.queue.policy}).Warn("Sink problems during session")
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// csvSink writes one CSV file per session into a directory, or several when
+// it's rotated by size or time.
+type csvSink struct {
+	dir          string
+	rotation     *logRotation
+	file         *os.File
+	counter      *countingWriter
+	buffered     *bufio.Writer
+	writer       *csv.Writer
+	header       []string
+	plausibility string
+
+	// name is the session's file name without ".csv"; parts after the first
+	// add "-2", "-3", ...
+	name   string
+	part   int
+	path   string
+	opened time.Time
+}
+
+func newCsvSink(target string, opts sinkOptions) (Sink, error) {
+	if target == "" {
+		target = logfile_path
+	}
+	rotation, err := newLogRotation(opts)
+	if err != nil {
+		return nil, err
+	}
+	rotation.patterns = []string{filepath.Join(target, "*-log*.csv"), filepath.Join(target, "*-log*.csv.*")}
+	return &csvSink{dir: target, rotation: rotation}, nil
+}
+
+func (s *csvSink) Open(session sinkSession) error {
+	if err := s.rotation.Start(s.dir); err != nil {
+		return err
+	}
+	s.name = fmt.Sprintf("%s-%d-log", session.Info.RomIdString(), session.Started.Unix())
+	s.plausibility = session.Plausibility
+
+	s.header = []string{"timestamp"}
+	for _, column := range session.Columns {
+		s.header = append(s.header, column.Label())
+	}
+	if s.plausibility == plausibilityFlag {
+		s.header = append(s.header, "implausible")
+	}
+	return s.openPart()
+}
+
+// openPart starts the session's next file with the header.
+func (s *csvSink) openPart() error {
+	s.part++
+	name := s.name + ".csv"
+	if s.part > 1 {
+		name = fmt.Sprintf("%s-%d.csv", s.name, s.part)
+	}
+	s.path = filepath.Join(s.dir, name)
+	file, err := createLogFile(s.path)
+	if err != nil {
+		return err
+	}
+	s.file = file
+	s.counter = &countingWriter{w: file}
+	// csv.Writer writes through buffered as is, so rotate_size can count
+	// what it hasn't flushed yet
+	s.buffered = bufio.NewWriter(s.counter)
+	s.writer = csv.NewWriter(s.buffered)
+	s.opened = time.Now()
+	return s.writer.Write(s.header)
+}
+
+func (s *csvSink) Write(smp sample) error {
+	if s.rotation.Due(s.counter.written+int64(s.buffered.Buffered()), s.opened) {
+		finished := s.path
+		if err := s.closePart(); err != nil {
+			return err
+		}
+		if err := s.openPart(); err != nil {
+			return err
+		}
+		s.rotation.Finished(finished, s.path)
+	}
+
+	row := []string{fmt.Sprintf("%d", smp.Time.Unix())}
+	implausible := []string{}
+	for _, value := range smp.Values {
+		row = append(row, value.FormatValue())
+		if value.Implausible {
+			implausible = append(implausible, value.Column.Label())
+		}
+	}
+	if s.plausibility == plausibilityFlag {
+		row = append(row, strings.Join(implausible, ";"))
+	}
+	return s.writer.Write(row)
+}
+
+func (s *csvSink) closePart() error {
+	s.writer.Flush()
+	if err := s.writer.Error(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+func (s *csvSink) Close() error {
+	err := s.closePart()
+	s.rotation.Finished(s.path, "")
+	s.rotation.Wait()
+	return err
+}
+
+func init() {
+	registerSink("csv", policyBlock, newCsvSink)
+}
@@ -0,0 +1,236 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultDiscoveryPrefix     = "homeassistant"
+	defaultAvailabilityTopic   = "ssm2logger/{rom_id}/availability"
+	defaultAvailabilityTimeout = 5 * time.Second
+
+	availabilityOnline  = "online"
+	availabilityOffline = "offline"
+)
+
+// haUnits maps units from the definitions to Home Assistant's spelling and
+// the sensor device class they imply.
+var haUnits = map[string]struct{ unit, deviceClass string }{
+	"c":      {"°C", "temperature"},
+	"°c":     {"°C", "temperature"},
+	"f":      {"°F", "temperature"},
+	"°f":     {"°F", "temperature"},
+	"kpa":    {"kPa", "pressure"},
+	"hpa":    {"hPa", "pressure"},
+	"bar":    {"bar", "pressure"},
+	"mbar":   {"mbar", "pressure"},
+	"psi":    {"psi", "pressure"},
+	"inhg":   {"inHg", "pressure"},
+	"mmhg":   {"mmHg", "pressure"},
+	"km/h":   {"km/h", "speed"},
+	"mph":    {"mph", "speed"},
+	"km":     {"km", "distance"},
+	"mi":     {"mi", "distance"},
+	"miles":  {"mi", "distance"},
+	"v":      {"V", "voltage"},
+	"a":      {"A", "current"},
+	"ma":     {"mA", "current"},
+	"ms":     {"ms", "duration"},
+	"s":      {"s", "duration"},
+	"l":      {"L", "volume"},
+	"gal":    {"gal", "volume"},
+	"g/s":    {"g/s", ""},
+	"lb/min": {"lb/min", ""},
+}
+
+type haDevice struct {
+	Identifiers []string `json:"identifiers"`
+	Name        string   `json:"name"`
+	Model       string   `json:"model,omitempty"`
+}
+
+type haSensorConfig struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	StateTopic        string   `json:"state_topic"`
+	ValueTemplate     string   `json:"value_template,omitempty"`
+	UnitOfMeasurement string   `json:"unit_of_measurement,omitempty"`
+	DeviceClass       string   `json:"device_class,omitempty"`
+	StateClass        string   `json:"state_class,omitempty"`
+	PayloadOn         string   `json:"payload_on,omitempty"`
+	PayloadOff        string   `json:"payload_off,omitempty"`
+	AvailabilityTopic string   `json:"availability_topic"`
+	Device            haDevice `json:"device"`
+}
+
+// homeAssistant publishes Home Assistant MQTT discovery config for every
+// logged column, as a binary_sensor for switches and a sensor otherwise, and
+// keeps an availability topic in step with the ECU: online
+// while samples arrive, offline once they stop for longer than the timeout or
+// the session ends, and offline via the MQTT will if the logger dies.
+// Everything is republished whenever the broker reconnects or Home Assistant
+// restarts.
+type homeAssistant struct {
+	prefix            string
+	availabilityTopic string
+	timeout           time.Duration
+	qos               byte
+	configs           []mqttMessage
+
+	mu     sync.Mutex
+	client mqtt.Client
+	online bool
+	timer  *time.Timer
+}
+
+// newHomeAssistant returns nil unless the homeassistant option is set.
+func newHomeAssistant(opts sinkOptions, qos byte) (*homeAssistant, error) {
+	enabled, err := opts.Bool("homeassistant", false)
+	if err != nil {
+		return nil, err
+	}
+	ha := &homeAssistant{
+		prefix:            strings.TrimSuffix(opts.String("discovery_prefix", defaultDiscoveryPrefix), "/"),
+		availabilityTopic: opts.String("availability_topic", defaultAvailabilityTopic),
+		qos:               qos,
+	}
+	if ha.timeout, err = opts.Duration("availability_timeout", defaultAvailabilityTimeout); err != nil {
+		return nil, err
+	}
+	if !enabled {
+		return nil, nil
+	}
+	return ha, nil
+}
+
+// configure builds the discovery messages once the ECU is known. topic is the
+// sink's expanded topic template.
+func (ha *homeAssistant) configure(session sinkSession, topic string, replacer *strings.Replacer) error {
+	romID := session.Info.RomIdString()
+	ha.availabilityTopic = replacer.Replace(ha.availabilityTopic)
+	device := haDevice{
+		Identifiers: []string{"ssm2logger_" + romID},
+		Name:        fmt.Sprintf("%s ECU %s", session.Info.Protocol, romID),
+		Model:       session.Info.Protocol,
+	}
+
+	ha.configs = nil
+	for _, column := range session.Columns {
+		key := column.Key()
+		component := "sensor"
+		config := haSensorConfig{
+			Name:              column.Name,
+			UniqueID:          fmt.Sprintf("ssm2logger_%s_%s", romID, key),
+			StateTopic:        strings.Replace(topic, "{key}", key, -1),
+			AvailabilityTopic: ha.availabilityTopic,
+			Device:            device,
+		}
+		if !strings.Contains(topic, "{key}") {
+			config.ValueTemplate = fmt.Sprintf("{{ value_json.data.%s }}", key)
+		}
+		switch mapped, ok := haUnits[strings.ToLower(column.Units)]; {
+		case column.IsSwitch():
+			// Switch values are published as 1 and 0
+			component = "binary_sensor"
+			config.PayloadOn, config.PayloadOff = "1", "0"
+		case ok:
+			config.UnitOfMeasurement, config.DeviceClass, config.StateClass = mapped.unit, mapped.deviceClass, "measurement"
+		default:
+			config.UnitOfMeasurement, config.StateClass = column.Units, "measurement"
+		}
+
+		payload, err := json.Marshal(config)
+		if err != nil {
+			return err
+		}
+		ha.configs = append(ha.configs, mqttMessage{
+			topic:   fmt.Sprintf("%s/%s/ssm2logger_%s/%s/config", ha.prefix, component, romID, key),
+			payload: payload,
+		})
+	}
+	ha.online = true
+	ha.timer = time.AfterFunc(ha.timeout, func() { ha.setOnline(false) })
+	return nil
+}
+
+// will makes the broker mark the ECU offline if the logger disappears.
+func (ha *homeAssistant) will(opts *mqtt.ClientOptions) {
+	opts.SetWill(ha.availabilityTopic, availabilityOffline, ha.qos, true)
+}
+
+// connected runs from the client's connect handler, so it mustn't block.
+func (ha *homeAssistant) connected(client mqtt.Client) {
+	ha.mu.Lock()
+	ha.client = client
+	ha.mu.Unlock()
+
+	client.Subscribe(ha.prefix+"/status", ha.qos, func(client mqtt.Client, msg mqtt.Message) {
+		if string(msg.Payload()) == availabilityOnline {
+			logger.Debug("Home Assistant restarted, republishing discovery config")
+			ha.announce()
+		}
+	})
+	ha.announce()
+}
+
+// announce publishes the retained discovery config and current availability.
+func (ha *homeAssistant) announce() {
+	ha.mu.Lock()
+	defer ha.mu.Unlock()
+	if ha.client == nil {
+		return
+	}
+	for _, config := range ha.configs {
+		ha.client.Publish(config.topic, ha.qos, true, config.payload)
+	}
+	ha.publishAvailability()
+}
+
+// publishAvailability must be called with mu held.
+func (ha *homeAssistant) publishAvailability() mqtt.Token {
+	state := availabilityOffline
+	if ha.online {
+		state = availabilityOnline
+	}
+	return ha.client.Publish(ha.availabilityTopic, ha.qos, true, state)
+}
+
+func (ha *homeAssistant) setOnline(online bool) {
+	ha.mu.Lock()
+	defer ha.mu.Unlock()
+	if ha.online == online {
+		return
+	}
+	ha.online = online
+	if !online {
+		logger.WithFields(log.Fields{"timeout": ha.timeout}).Info("No samples from the ECU, marking it unavailable")
+	}
+	if ha.client != nil {
+		ha.publishAvailability()
+	}
+}
+
+// seen is called for every sample.
+func (ha *homeAssistant) seen() {
+	ha.timer.Reset(ha.timeout)
+	ha.setOnline(true)
+}
+
+// close marks the ECU offline at the end of the session, waiting up to
+// timeout for the broker to take it.
+func (ha *homeAssistant) close(timeout time.Duration) {
+	ha.timer.Stop()
+	ha.mu.Lock()
+	defer ha.mu.Unlock()
+	ha.online = false
+	if ha.client != nil && ha.client.IsConnectionOpen() {
+		ha.publishAvailability().WaitTimeout(timeout)
+	}
+}
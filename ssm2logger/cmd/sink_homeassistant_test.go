@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/nanoadmin/go-ssm2logger/ssm2lib"
+)
+
+var _ = Describe("Home Assistant", func() {
+	session := sinkSession{
+		Info: &EcuInfo{Protocol: "SSM", RomId: []byte{1, 2, 3, 4, 5}},
+		Columns: []outputColumn{
+			{Name: "Coolant Temperature", Units: "C"},
+			{Name: "Cruise Switch", Units: "on/off"},
+			{Name: "Injector Duty", Units: "%"},
+		},
+	}
+	replacer := strings.NewReplacer("{rom_id}", "0102030405")
+	newHa := func(topic string) *homeAssistant {
+		ha, err := newHomeAssistant(sinkOptions{"homeassistant": "true", "availability_timeout": "50ms"}, 1)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ha.configure(session, topic, replacer)).Should(Succeed())
+		return ha
+	}
+	config := func(message mqttMessage) map[string]interface{} {
+		decoded := map[string]interface{}{}
+		Ω(json.Unmarshal(message.payload, &decoded)).Should(Succeed())
+		return decoded
+	}
+
+	It("Is off unless asked for", func() {
+		Ω(newHomeAssistant(sinkOptions{}, 1)).Should(BeNil())
+	})
+
+	It("Describes measurements as sensors and switches as binary sensors", func() {
+		ha := newHa("car/{key}")
+		defer ha.close(time.Second)
+		Ω(ha.configs).Should(HaveLen(3))
+
+		Ω(ha.configs[0].topic).Should(Equal("homeassistant/sensor/ssm2logger_0102030405/coolant_temperature_c/config"))
+		Ω(config(ha.configs[0])).Should(Equal(map[string]interface{}{
+			"name":                "Coolant Temperature",
+			"unique_id":           "ssm2logger_0102030405_coolant_temperature_c",
+			"state_topic":         "car/coolant_temperature_c",
+			"unit_of_measurement": "°C",
+			"device_class":        "temperature",
+			"state_class":         "measurement",
+			"availability_topic":  "ssm2logger/0102030405/availability",
+			"device": map[string]interface{}{
+				"identifiers": []interface{}{"ssm2logger_0102030405"},
+				"name":        "SSM ECU 0102030405",
+				"model":       "SSM",
+			},
+		}))
+
+		Ω(ha.configs[1].topic).Should(Equal("homeassistant/binary_sensor/ssm2logger_0102030405/cruise_switch_on_off/config"))
+		switchConfig := config(ha.configs[1])
+		Ω(switchConfig).ShouldNot(HaveKey("state_class"))
+		Ω(switchConfig).ShouldNot(HaveKey("unit_of_measurement"))
+		Ω(switchConfig).Should(HaveKeyWithValue("payload_on", "1"))
+		Ω(switchConfig).Should(HaveKeyWithValue("payload_off", "0"))
+
+		Ω(config(ha.configs[2])).Should(HaveKeyWithValue("unit_of_measurement", "%"))
+		Ω(config(ha.configs[2])).Should(HaveKeyWithValue("state_class", "measurement"))
+		Ω(config(ha.configs[2])).ShouldNot(HaveKey("device_class"))
+	})
+
+	It("Picks values out of per-sample JSON", func() {
+		ha := newHa("car/0102030405")
+		defer ha.close(time.Second)
+		Ω(config(ha.configs[0])).Should(HaveKeyWithValue("state_topic", "car/0102030405"))
+		Ω(config(ha.configs[0])).Should(HaveKeyWithValue("value_template", "{{ value_json.data.coolant_temperature_c }}"))
+	})
+
+	It("Follows the ECU's availability", func() {
+		ha := newHa("car/{key}")
+		client := &stubMqttClient{open: true}
+		ha.connected(client)
+		Ω(client.sent()).Should(HaveLen(4))
+		Ω(client.sent()[3]).Should(Equal("ssm2logger/0102030405/availability online"))
+		Ω(client.subscriptions).Should(HaveKey("homeassistant/status"))
+
+		// No samples for the timeout
+		Eventually(client.sent).Should(HaveLen(5))
+		Ω(client.sent()[4]).Should(Equal("ssm2logger/0102030405/availability offline"))
+
+		ha.seen()
+		ha.seen()
+		Ω(client.sent()).Should(HaveLen(6))
+		Ω(client.sent()[5]).Should(Equal("ssm2logger/0102030405/availability online"))
+
+		// Home Assistant restarting gets everything again
+		client.subscriptions["homeassistant/status"](client, &stubMqttMessage{payload: "online"})
+		Ω(client.sent()).Should(HaveLen(10))
+		Ω(client.sent()[6]).Should(HavePrefix("homeassistant/sensor/ssm2logger_0102030405/coolant_temperature_c/config "))
+
+		ha.close(time.Second)
+		Ω(client.sent()).Should(HaveLen(11))
+		Ω(client.sent()[10]).Should(Equal("ssm2logger/0102030405/availability offline"))
+	})
+
+	It("Marks the ECU offline in the will", func() {
+		ha := newHa("car/{key}")
+		defer ha.close(time.Second)
+		opts := mqtt.NewClientOptions()
+		ha.will(opts)
+		Ω(opts.WillTopic).Should(Equal("ssm2logger/0102030405/availability"))
+		Ω(opts.WillPayload).Should(Equal([]byte("offline")))
+		Ω(opts.WillRetained).Should(BeTrue())
+	})
+})
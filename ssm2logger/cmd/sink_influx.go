@@ -0,0 +1,438 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultInfluxMeasurement = "ssm2logger"
+	defaultInfluxBatch       = 500
+	// influxPendingBatches is how many full batches may wait for the sender
+	// before they're spooled instead.
+	influxPendingBatches = 4
+)
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxKeyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// influxSink formats samples as InfluxDB line protocol. It writes them to
+// stdout or a file, or batches them to an HTTP write endpoint. Batches that
+// can't be delivered are spooled to disk and sent, oldest first, once the
+// endpoint answers again.
+//
+// Requests are made by a sender goroutine, which also flushes on a ticker,
+// so a slow or failing endpoint never holds up Write and a quiet session
+// still gets its last samples sent.
+type influxSink struct {
+	measurement string
+	tags        string
+
+	// stdout or file output
+	filePath string
+	writer   io.Writer
+	closer   io.Closer
+
+	// HTTP output
+	url           string
+	token         string
+	username      string
+	password      string
+	batchSize     int
+	flushInterval time.Duration
+	retries       int
+	retryInterval time.Duration
+	spoolDir      string
+	client        *http.Client
+
+	// mu guards the batch being filled and the sender's last error.
+	mu         sync.Mutex
+	batch      bytes.Buffer
+	batchLines int
+	err        error
+
+	// Owned by the sender
+	batches     chan []byte
+	closing     chan struct{}
+	done        chan struct{}
+	nextAttempt time.Time
+}
+
+// newInfluxSink accepts an empty target or "stdout" for stdout, an http(s)
+// URL for a write endpoint, e.g.
+// http://localhost:8086/api/v2/write?org=garage&bucket=car, and anything else
+// as a file path.
+func newInfluxSink(target string, opts sinkOptions) (Sink, error) {
+	s := &influxSink{measurement: opts.String("measurement", defaultInfluxMeasurement)}
+	if s.measurement == "" {
+		return nil, fmt.Errorf("measurement can't be empty")
+	}
+
+	switch {
+	case target == "" || target == "stdout" || target == "-":
+		return s, nil
+	case strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://"):
+	default:
+		s.filePath = target
+		return s, nil
+	}
+
+	s.url = target
+	s.token = opts.String("token", "")
+	s.username = opts.String("username", "")
+	s.password = opts.String("password", "")
+	s.spoolDir = opts.String("spool", "")
+
+	var err error
+	if s.batchSize, err = opts.Int("batch", defaultInfluxBatch); err == nil && s.batchSize < 1 {
+		err = fmt.Errorf("batch must be at least 1")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.flushInterval, err = opts.Duration("flush_interval", time.Second); err != nil {
+		return nil, err
+	}
+	if s.retries, err = opts.Int("retries", 3); err != nil {
+		return nil, err
+	}
+	if s.retryInterval, err = opts.Duration("retry_interval", time.Second); err != nil {
+		return nil, err
+	}
+	timeout, err := opts.Duration("timeout", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	s.client = &http.Client{Timeout: timeout}
+
+	if s.spoolDir == "" {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, fmt.Errorf("no spool option and no user cache directory: %s", err)
+		}
+		s.spoolDir = filepath.Join(dir, "ssm2logger", "influx-spool")
+	}
+	return s, nil
+}
+
+func (s *influxSink) Open(session sinkSession) error {
+	tags := map[string]string{
+		"rom_id":  session.Info.RomIdString(),
+		"ssm_id":  hex.EncodeToString(session.Info.SsmId),
+		"session": strconv.FormatInt(session.Started.Unix(), 10),
+	}
+	s.tags = influxTags(tags)
+
+	switch {
+	case s.url != "":
+		if err := os.MkdirAll(s.spoolDir, 0755); err != nil {
+			return err
+		}
+		s.batches = make(chan []byte, influxPendingBatches)
+		s.closing = make(chan struct{})
+		s.done = make(chan struct{})
+		go s.send()
+	case s.filePath != "":
+		file, err := os.OpenFile(s.filePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		s.writer, s.closer = file, file
+	default:
+		s.writer = os.Stdout
+	}
+	return nil
+}
+
+// influxTags formats tags sorted by key, as InfluxDB recommends, leaving out
+// empty values which line protocol doesn't allow.
+func influxTags(tags map[string]string) string {
+	keys := []string{}
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, key := range keys {
+		if tags[key] == "" {
+			continue
+		}
+		fmt.Fprintf(&b, ",%s=%s", influxKeyEscaper.Replace(key), influxKeyEscaper.Replace(tags[key]))
+	}
+	return b.String()
+}
+
+// line formats a sample, or returns nil when it has no valid values since a
+// line needs at least one field.
+func (s *influxSink) line(smp sample) []byte {
+	var b bytes.Buffer
+	b.WriteString(influxMeasurementEscaper.Replace(s.measurement))
+	b.WriteString(s.tags)
+	fields := 0
+	for _, value := range smp.Values {
+		numeric := value.NumericValue()
+		if numeric == nil || math.IsNaN(*numeric) || math.IsInf(*numeric, 0) {
+			continue
+		}
+		if fields == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(influxKeyEscaper.Replace(value.Column.Key()))
+		b.WriteByte('=')
+		b.WriteString(strconv.FormatFloat(*numeric, 'f', -1, 64))
+		fields++
+	}
+	if fields == 0 {
+		return nil
+	}
+	fmt.Fprintf(&b, " %d\n", smp.Time.UnixNano())
+	return b.Bytes()
+}
+
+// Write adds a line to the batch, handing the batch to the sender when it's
+// full. It returns the error of the last failed send, if any.
+func (s *influxSink) Write(smp sample) error {
+	line := s.line(smp)
+	if s.url == "" {
+		if line == nil {
+			return nil
+		}
+		_, err := s.writer.Write(line)
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batch.Write(line)
+	if line != nil {
+		s.batchLines++
+	}
+	if s.batchLines >= s.batchSize {
+		body := s.takeBatch()
+		select {
+		case s.batches <- body:
+		default:
+			// The sender is stuck on a failing endpoint
+			if err := s.spool(body); err != nil {
+				return err
+			}
+		}
+	}
+	err := s.err
+	s.err = nil
+	return err
+}
+
+// takeBatch returns the lines batched so far, or nil when there are none.
+// Callers hold mu.
+func (s *influxSink) takeBatch() []byte {
+	if s.batchLines == 0 {
+		return nil
+	}
+	body := append([]byte{}, s.batch.Bytes()...)
+	s.batch.Reset()
+	s.batchLines = 0
+	return body
+}
+
+// send delivers full batches as they come and whatever's been batched every
+// flush interval, until the sink is closed.
+func (s *influxSink) send() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case body := <-s.batches:
+			s.deliver(body)
+		case <-ticker.C:
+			s.deliverBatch()
+		case <-s.closing:
+			// Write isn't called once Close is
+			for len(s.batches) > 0 {
+				s.deliver(<-s.batches)
+			}
+			s.deliverBatch()
+			return
+		}
+	}
+}
+
+// deliverBatch sends the lines batched so far, if there are any.
+func (s *influxSink) deliverBatch() {
+	s.mu.Lock()
+	body := s.takeBatch()
+	s.mu.Unlock()
+	if body != nil {
+		s.deliver(body)
+	}
+}
+
+// deliver sends spooled batches and then body, keeping any error for Write
+// to return.
+func (s *influxSink) deliver(body []byte) {
+	if err := s.flush(body); err != nil {
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+	}
+}
+
+// flush sends spooled batches and then body. While the endpoint is failing,
+// batches go straight to the spool until the retry interval has passed.
+func (s *influxSink) flush(body []byte) error {
+	if time.Now().Before(s.nextAttempt) {
+		return s.spool(body)
+	}
+	if err := s.replaySpool(); err != nil {
+		s.nextAttempt = time.Now().Add(s.retryInterval)
+		if spoolErr := s.spool(body); spoolErr != nil {
+			return spoolErr
+		}
+		return err
+	}
+	if err := s.post(body); err != nil {
+		if _, permanent := err.(influxRejectedError); permanent {
+			return err
+		}
+		s.nextAttempt = time.Now().Add(s.retryInterval)
+		if spoolErr := s.spool(body); spoolErr != nil {
+			return spoolErr
+		}
+		return err
+	}
+	return nil
+}
+
+// influxRejectedError is a batch the endpoint refused as malformed or too
+// large, which retrying won't fix.
+type influxRejectedError struct {
+	status int
+	body   string
+}
+
+func (e influxRejectedError) Error() string {
+	return fmt.Sprintf("InfluxDB rejected the batch with %d: %s", e.status, e.body)
+}
+
+// post sends one batch, retrying network errors and server side failures.
+// Closing the sink cuts the retries short so the batch is spooled.
+func (s *influxSink) post(body []byte) error {
+	var err error
+	for attempt := 0; attempt <= s.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(s.retryInterval * time.Duration(attempt)):
+			case <-s.closing:
+				return err
+			}
+		}
+		if err = s.postOnce(body); err == nil {
+			return nil
+		}
+		if _, permanent := err.(influxRejectedError); permanent {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *influxSink) postOnce(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	switch {
+	case s.token != "":
+		req.Header.Set("Authorization", "Token "+s.token)
+	case s.username != "":
+		req.SetBasicAuth(s.username, s.password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusRequestEntityTooLarge {
+		return influxRejectedError{status: resp.StatusCode, body: strings.TrimSpace(string(message))}
+	}
+	return fmt.Errorf("InfluxDB write failed with %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+}
+
+func (s *influxSink) spool(body []byte) error {
+	path := filepath.Join(s.spoolDir, fmt.Sprintf("%020d.lp", time.Now().UnixNano()))
+	if err := ioutil.WriteFile(path+".tmp", body, 0644); err != nil {
+		return fmt.Errorf("unable to spool batch: %s", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// replaySpool sends spooled batches oldest first, stopping at the first one
+// that fails. Rejected batches are moved aside rather than retried forever.
+func (s *influxSink) replaySpool() error {
+	paths, err := filepath.Glob(filepath.Join(s.spoolDir, "*.lp"))
+	if err != nil || len(paths) == 0 {
+		return err
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := s.postOnce(body); err != nil {
+			if _, permanent := err.(influxRejectedError); !permanent {
+				return err
+			}
+			logger.WithFields(log.Fields{"file": path, "error": err}).Error("Spooled InfluxDB batch was rejected, keeping it as .rejected")
+			os.Rename(path, path+".rejected")
+			continue
+		}
+		os.Remove(path)
+	}
+	logger.WithFields(log.Fields{"batches": len(paths)}).Info("Sent spooled InfluxDB batches")
+	return nil
+}
+
+func (s *influxSink) Close() error {
+	if s.url != "" {
+		close(s.closing)
+		<-s.done
+		return s.err
+	}
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+	return nil
+}
+
+func init() {
+	registerSink("influx", policyDropOldest, newInfluxSink)
+}
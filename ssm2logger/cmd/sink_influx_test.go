@@ -0,0 +1,215 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	. "github.com/nanoadmin/go-ssm2logger/ssm2lib"
+)
+
+var _ = Describe("InfluxDB", func() {
+	var (
+		server   *httptest.Server
+		endpoint *stubInfluxEndpoint
+		spoolDir string
+	)
+	session := sinkSession{Info: &EcuInfo{Protocol: ProtocolSsm, RomId: []byte{1, 2, 3, 4, 5}}, Started: time.Unix(1700000000, 0)}
+	conversion, _ := CompileConversion(Ssm2ParameterConversion{Expr: "x", Format: "0"})
+	numbered := func(n int) sample {
+		return sample{Time: time.Unix(0, int64(n)), Values: []decodedValue{
+			{Column: outputColumn{Name: "Speed"}, Value: float64(n), Valid: true, formatter: conversion},
+		}}
+	}
+	line := func(n int) string {
+		return fmt.Sprintf("ssm2logger,rom_id=0102030405,session=1700000000 speed=%d %d\n", n, n)
+	}
+	spooled := func() []string {
+		paths, _ := filepath.Glob(filepath.Join(spoolDir, "*"))
+		for idx := range paths {
+			paths[idx] = filepath.Base(paths[idx])
+		}
+		return paths
+	}
+
+	BeforeEach(func() {
+		endpoint = &stubInfluxEndpoint{status: http.StatusNoContent}
+		server = httptest.NewServer(endpoint)
+		var err error
+		spoolDir, err = ioutil.TempDir("", "influx-spool")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(spoolDir)
+	})
+
+	newSink := func(options sinkOptions) *influxSink {
+		options["spool"] = spoolDir
+		sink, err := newInfluxSink(server.URL+"/api/v2/write?bucket=car", options)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(sink.Open(session)).Should(Succeed())
+		return sink.(*influxSink)
+	}
+
+	It("Escapes measurements, tags and fields", func() {
+		sink, err := newInfluxSink("", sinkOptions{"measurement": "my car,1"})
+		Ω(err).ShouldNot(HaveOccurred())
+		s := sink.(*influxSink)
+		s.tags = influxTags(map[string]string{"rom id": "a,b=c", "empty": ""})
+		smp := sample{Time: time.Unix(0, 42), Values: []decodedValue{
+			{Column: outputColumn{Name: "A=F"}, Value: 14.7, Valid: true, formatter: conversion},
+			{Column: outputColumn{Name: "Boost"}, formatter: conversion},
+		}}
+		Ω(string(s.line(smp))).Should(Equal(`my\ car\,1,rom\ id=a\,b\=c a_f=15 42` + "\n"))
+
+		// A line needs a field
+		smp.Values = smp.Values[1:]
+		Ω(s.line(smp)).Should(BeNil())
+	})
+
+	It("Sends a full batch straight away", func() {
+		s := newSink(sinkOptions{"batch": "2", "flush_interval": "1h"})
+		Ω(s.Write(numbered(1))).Should(Succeed())
+		Ω(s.Write(numbered(2))).Should(Succeed())
+		Eventually(endpoint.received).Should(Equal([]string{line(1) + line(2)}))
+		Ω(s.Close()).Should(Succeed())
+		Ω(endpoint.received()).Should(HaveLen(1))
+	})
+
+	It("Sends a partial batch on the flush interval without another sample", func() {
+		s := newSink(sinkOptions{"flush_interval": "20ms"})
+		defer s.Close()
+		Ω(s.Write(numbered(1))).Should(Succeed())
+		Eventually(endpoint.received).Should(Equal([]string{line(1)}))
+	})
+
+	It("Sends what's left on close", func() {
+		s := newSink(sinkOptions{"flush_interval": "1h"})
+		Ω(s.Write(numbered(1))).Should(Succeed())
+		Ω(s.Close()).Should(Succeed())
+		Ω(endpoint.received()).Should(Equal([]string{line(1)}))
+	})
+
+	It("Sends credentials", func() {
+		s := newSink(sinkOptions{"token": "secret"})
+		Ω(s.Write(numbered(1))).Should(Succeed())
+		Ω(s.Close()).Should(Succeed())
+		Ω(endpoint.authorization).Should(Equal("Token secret"))
+	})
+
+	table.DescribeTable("Doesn't retry or spool a rejected batch",
+		func(status int) {
+			endpoint.status = status
+			s := newSink(sinkOptions{"batch": "1", "retries": "3", "retry_interval": "1ms"})
+			Ω(s.Write(numbered(1))).Should(Succeed())
+			Eventually(endpoint.received).Should(HaveLen(1))
+			Ω(s.Close()).Should(BeAssignableToTypeOf(influxRejectedError{}))
+			Ω(endpoint.received()).Should(HaveLen(1))
+			Ω(spooled()).Should(BeEmpty())
+		},
+		table.Entry("Malformed", http.StatusBadRequest),
+		table.Entry("Too large", http.StatusRequestEntityTooLarge),
+	)
+
+	It("Retries server errors and then spools the batch", func() {
+		endpoint.status = http.StatusServiceUnavailable
+		s := newSink(sinkOptions{"batch": "1", "retries": "2", "retry_interval": "1ms"})
+		Ω(s.Write(numbered(1))).Should(Succeed())
+		// The error comes back from a later write
+		Eventually(func() error { return s.Write(sample{}) }).Should(MatchError(ContainSubstring("failed with 503")))
+		Ω(endpoint.received()).Should(Equal([]string{line(1), line(1), line(1)}))
+		Ω(spooled()).Should(HaveLen(1))
+		Ω(s.Close()).Should(Succeed())
+		body, _ := ioutil.ReadFile(filepath.Join(spoolDir, spooled()[0]))
+		Ω(string(body)).Should(Equal(line(1)))
+	})
+
+	It("Doesn't wait out the retries on close", func() {
+		endpoint.status = http.StatusServiceUnavailable
+		s := newSink(sinkOptions{"retries": "3", "retry_interval": "1h"})
+		Ω(s.Write(numbered(1))).Should(Succeed())
+		closed := make(chan error)
+		go func() { closed <- s.Close() }()
+		Eventually(closed).Should(Receive(HaveOccurred()))
+		Ω(spooled()).Should(HaveLen(1))
+	})
+
+	It("Keeps writing while the endpoint is slow", func() {
+		endpoint.delay = 200 * time.Millisecond
+		s := newSink(sinkOptions{"batch": "1"})
+		started := time.Now()
+		for n := 1; n <= influxPendingBatches+3; n++ {
+			Ω(s.Write(numbered(n))).Should(Succeed())
+		}
+		Ω(time.Since(started)).Should(BeNumerically("<", endpoint.delay))
+		// What the sender can't keep up with is spooled
+		Ω(spooled()).ShouldNot(BeEmpty())
+		Ω(s.Close()).Should(Succeed())
+	})
+
+	It("Replays the spool oldest first before the next batch", func() {
+		Ω(ioutil.WriteFile(filepath.Join(spoolDir, "00000000000000000002.lp"), []byte(line(2)), 0644)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(spoolDir, "00000000000000000001.lp"), []byte(line(1)), 0644)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(spoolDir, "00000000000000000003.lp"), []byte("malformed\n"), 0644)).Should(Succeed())
+		endpoint.rejected = "malformed\n"
+
+		s := newSink(sinkOptions{"batch": "1"})
+		Ω(s.Write(numbered(4))).Should(Succeed())
+		Ω(s.Close()).Should(Succeed())
+		Ω(endpoint.received()).Should(Equal([]string{line(1), line(2), "malformed\n", line(4)}))
+		Ω(spooled()).Should(Equal([]string{"00000000000000000003.lp.rejected"}))
+	})
+
+	It("Spools without trying while the endpoint is down", func() {
+		endpoint.status = http.StatusServiceUnavailable
+		s := newSink(sinkOptions{"batch": "1", "retries": "0", "retry_interval": "1h"})
+		Ω(s.Write(numbered(1))).Should(Succeed())
+		Eventually(func() error { return s.Write(sample{}) }).Should(HaveOccurred())
+		Ω(s.Write(numbered(2))).Should(Succeed())
+		Eventually(spooled).Should(HaveLen(2))
+		Ω(s.Close()).Should(Succeed())
+		Ω(endpoint.received()).Should(HaveLen(1))
+	})
+})
+
+// stubInfluxEndpoint answers writes with status, except for bodies matching
+// rejected which get a 400, and records what it's sent.
+type stubInfluxEndpoint struct {
+	status        int
+	rejected      string
+	delay         time.Duration
+	mu            sync.Mutex
+	bodies        []string
+	authorization string
+}
+
+func (e *stubInfluxEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	time.Sleep(e.delay)
+	e.mu.Lock()
+	e.bodies = append(e.bodies, string(body))
+	e.authorization = r.Header.Get("Authorization")
+	e.mu.Unlock()
+	if string(body) == e.rejected {
+		http.Error(w, "unable to parse", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(e.status)
+}
+
+func (e *stubInfluxEndpoint) received() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string{}, e.bodies...)
+}
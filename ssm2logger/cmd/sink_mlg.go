@@ -0,0 +1,229 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// MLG field types and display styles from EFI Analytics' MLVLG format.
+const (
+	mlgTypeU32 = 4
+	mlgTypeS32 = 5
+	mlgTypeF32 = 7
+
+	mlgStyleFloat = 0
+)
+
+const (
+	mlgBlockData   = 0
+	mlgBlockMarker = 1
+
+	mlgNameLength     = 34
+	mlgUnitsLength    = 10
+	mlgCategoryLength = 34
+	mlgMarkerLength   = 50
+)
+
+// mlgInvalidNote goes in every log's info text, since a 0 in the log can't
+// be told apart from a real 0.
+const mlgInvalidNote = "Values that couldn't be read or converted are written as 0."
+
+// mlgField is one logger field definition. Readers show raw * Scale; the
+// transform is always 0.
+type mlgField struct {
+	Type     uint8
+	Name     string
+	Units    string
+	Scale    float32
+	Digits   int8
+	Category string
+}
+
+// mlgSink writes one MegaLogViewer binary log per session. Parameters with
+// a format are stored as integers scaled to the format's decimals, the rest
+// as floats. Invalid values have no representation in MLG and are written
+// as 0, which the info text says. Init retries, corrupt frames and skipped
+// payloads are written as markers; a lost ECU connection ends the session
+// rather than reconnecting, so there are no reconnect markers.
+type mlgSink struct {
+	dir     string
+	version int
+
+	file    *os.File
+	out     *bufio.Writer
+	fields  []mlgField
+	started time.Time
+	counter uint8
+}
+
+func newMlgSink(target string, opts sinkOptions) (Sink, error) {
+	if target == "" {
+		target = logfile_path
+	}
+	version, err := opts.Int("version", 2)
+	if err == nil && version != 1 && version != 2 {
+		err = fmt.Errorf("version must be 1 or 2")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &mlgSink{dir: target, version: version}, nil
+}
+
+func (s *mlgSink) Open(session sinkSession) error {
+	s.started = session.Started
+	s.fields = []mlgField{{Type: mlgTypeU32, Name: "Time", Units: "s", Scale: 0.001, Digits: 3}}
+	for _, column := range session.Columns {
+		field := mlgField{Type: mlgTypeF32, Name: column.Name, Units: column.Units, Scale: 1, Digits: 3, Category: session.Info.Protocol}
+		if column.Decimals >= 0 {
+			field.Type = mlgTypeS32
+			field.Scale = float32(math.Pow10(-column.Decimals))
+			field.Digits = int8(column.Decimals)
+		}
+		s.fields = append(s.fields, field)
+	}
+
+	header, err := s.header(session)
+	if err != nil {
+		return err
+	}
+	logfilename := filepath.Join(s.dir, fmt.Sprintf("%s-%d-log.mlg", session.Info.RomIdString(), session.Started.Unix()))
+	file, err := createLogFile(logfilename)
+	if err != nil {
+		return err
+	}
+	s.file = file
+	s.out = bufio.NewWriter(file)
+	if _, err := s.out.Write(header); err != nil {
+		file.Close()
+		return err
+	}
+	if session.Info.InitRetries > 0 {
+		return s.Mark(sample{Time: session.Started, Marker: fmt.Sprintf("ECU answered after %d init retries", session.Info.InitRetries)})
+	}
+	return nil
+}
+
+// header builds the file header, field definitions and info text.
+func (s *mlgSink) header(session sinkSession) ([]byte, error) {
+	fieldLength := 55
+	headerLength := 22
+	if s.version == 2 {
+		fieldLength += mlgCategoryLength
+		headerLength += 2
+	}
+	recordLength := 4 * len(s.fields)
+	info := fmt.Sprintf("ssm2logger %s session\nROM ID: %s\nSSM ID: %s\nDefinitions: %s %s\n%s\n\x00",
+		session.Info.Protocol, session.Info.RomIdString(), hex.EncodeToString(session.Info.SsmId), session.DefinitionsVersion, session.DefinitionsHash, mlgInvalidNote)
+	infoStart := headerLength + fieldLength*len(s.fields)
+	dataStart := infoStart + len(info)
+	if (s.version == 1 && infoStart > math.MaxInt16) || recordLength > math.MaxInt16 {
+		return nil, fmt.Errorf("too many parameters for an MLG v%d log", s.version)
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("MLVLG\x00")
+	binary.Write(buf, binary.BigEndian, int16(s.version))
+	binary.Write(buf, binary.BigEndian, int32(session.Started.Unix()))
+	if s.version == 1 {
+		binary.Write(buf, binary.BigEndian, int16(infoStart))
+	} else {
+		binary.Write(buf, binary.BigEndian, int32(infoStart))
+	}
+	binary.Write(buf, binary.BigEndian, int32(dataStart))
+	binary.Write(buf, binary.BigEndian, int16(recordLength))
+	binary.Write(buf, binary.BigEndian, int16(len(s.fields)))
+	for _, field := range s.fields {
+		buf.WriteByte(field.Type)
+		buf.Write(mlgString(field.Name, mlgNameLength))
+		buf.Write(mlgString(field.Units, mlgUnitsLength))
+		buf.WriteByte(mlgStyleFloat)
+		binary.Write(buf, binary.BigEndian, field.Scale)
+		binary.Write(buf, binary.BigEndian, float32(0))
+		buf.WriteByte(byte(field.Digits))
+		if s.version == 2 {
+			buf.Write(mlgString(field.Category, mlgCategoryLength))
+		}
+	}
+	buf.WriteString(info)
+	return buf.Bytes(), nil
+}
+
+// mlgString pads or cuts s to a fixed length, always leaving a terminating
+// zero.
+func mlgString(s string, length int) []byte {
+	b := make([]byte, length)
+	copy(b[:length-1], s)
+	return b
+}
+
+// blockHeader starts a data or marker block. Its timestamp is in 10µs units
+// and wraps; readers take the time from the Time field.
+func (s *mlgSink) blockHeader(blockType byte, t time.Time) []byte {
+	block := []byte{blockType, s.counter, 0, 0}
+	binary.BigEndian.PutUint16(block[2:], uint16(t.Sub(s.started).Microseconds()/10))
+	s.counter++
+	return block
+}
+
+func (s *mlgSink) Write(smp sample) error {
+	record := make([]byte, 4*len(s.fields))
+	binary.BigEndian.PutUint32(record, uint32(smp.Time.Sub(s.started).Milliseconds()))
+	for idx, value := range smp.Values {
+		if idx+1 >= len(s.fields) {
+			break
+		}
+		numeric := value.NumericValue()
+		if numeric == nil {
+			continue
+		}
+		field := s.fields[idx+1]
+		raw := record[4*(idx+1):]
+		if field.Type == mlgTypeF32 {
+			binary.BigEndian.PutUint32(raw, math.Float32bits(float32(*numeric)))
+			continue
+		}
+		scaled := math.Round(*numeric / float64(field.Scale))
+		scaled = math.Max(math.MinInt32, math.Min(math.MaxInt32, scaled))
+		binary.BigEndian.PutUint32(raw, uint32(int32(scaled)))
+	}
+
+	var crc byte
+	for _, b := range record {
+		crc += b
+	}
+	if _, err := s.out.Write(s.blockHeader(mlgBlockData, smp.Time)); err != nil {
+		return err
+	}
+	if _, err := s.out.Write(record); err != nil {
+		return err
+	}
+	return s.out.WriteByte(crc)
+}
+
+func (s *mlgSink) Mark(smp sample) error {
+	if _, err := s.out.Write(s.blockHeader(mlgBlockMarker, smp.Time)); err != nil {
+		return err
+	}
+	_, err := s.out.Write(mlgString(smp.Marker, mlgMarkerLength))
+	return err
+}
+
+func (s *mlgSink) Close() error {
+	if err := s.out.Flush(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+func init() {
+	registerSink("mlg", policyBlock, newMlgSink)
+}
@@ -0,0 +1,190 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	. "github.com/nanoadmin/go-ssm2logger/ssm2lib"
+)
+
+var _ = Describe("MegaLogViewer", func() {
+	var dir string
+	rounded, _ := CompileConversion(Ssm2ParameterConversion{Expr: "x", Format: "0"})
+	hundredths, _ := CompileConversion(Ssm2ParameterConversion{Expr: "x", Format: "0.00"})
+	unformatted, _ := CompileConversion(Ssm2ParameterConversion{Expr: "x"})
+	session := sinkSession{
+		Info: &EcuInfo{Protocol: ProtocolSsm, RomId: []byte{1, 2, 3, 4, 5}, SsmId: []byte{0xa2, 0x10}, InitRetries: 2},
+		Columns: []outputColumn{
+			{Name: "Engine Speed", Units: "rpm", Decimals: 0},
+			{Name: "A/F Sensor #1", Units: "AFR", Decimals: 2},
+			{Name: "Raw", Decimals: -1},
+		},
+		Started:            time.Unix(1700000000, 0),
+		DefinitionsVersion: "v1",
+		DefinitionsHash:    "abc",
+	}
+	values := func(speed, afr, raw float64, afrValid bool) []decodedValue {
+		return []decodedValue{
+			{Column: session.Columns[0], Value: speed, Valid: true, formatter: rounded},
+			{Column: session.Columns[1], Value: afr, Valid: afrValid, formatter: hundredths},
+			{Column: session.Columns[2], Value: raw, Valid: true, formatter: unformatted},
+		}
+	}
+	// cstring reads a fixed length, zero terminated string.
+	cstring := func(r *bytes.Reader, length int) string {
+		b := make([]byte, length)
+		r.Read(b)
+		Ω(b[length-1]).Should(BeZero())
+		return strings.TrimRight(string(b), "\x00")
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "mlg")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	table.DescribeTable("Writes a log MegaLogViewer can read",
+		func(version int, headerLength int, fieldLength int) {
+			sink, err := newMlgSink(dir, sinkOptions{"version": strconv.Itoa(version)})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(sink.Open(session)).Should(Succeed())
+			Ω(sink.Write(sample{Time: session.Started.Add(1500 * time.Millisecond), Values: values(812.4, 14.706, 1.25, true)})).Should(Succeed())
+			Ω(sink.Write(sample{Time: session.Started.Add(1600 * time.Millisecond), Values: values(-3, 0, 0, false)})).Should(Succeed())
+			Ω(sink.(markerSink).Mark(sample{Time: session.Started.Add(1700 * time.Millisecond), Marker: "Corrupt frame"})).Should(Succeed())
+			Ω(sink.Close()).Should(Succeed())
+
+			data, err := ioutil.ReadFile(filepath.Join(dir, "0102030405-1700000000-log.mlg"))
+			Ω(err).ShouldNot(HaveOccurred())
+			r := bytes.NewReader(data)
+			var header struct {
+				Magic     [6]byte
+				Version   int16
+				Timestamp int32
+			}
+			Ω(binary.Read(r, binary.BigEndian, &header)).Should(Succeed())
+			Ω(string(header.Magic[:])).Should(Equal("MLVLG\x00"))
+			Ω(header.Version).Should(BeEquivalentTo(version))
+			Ω(header.Timestamp).Should(BeEquivalentTo(1700000000))
+			var infoStart int32
+			if version == 1 {
+				var short int16
+				Ω(binary.Read(r, binary.BigEndian, &short)).Should(Succeed())
+				infoStart = int32(short)
+			} else {
+				Ω(binary.Read(r, binary.BigEndian, &infoStart)).Should(Succeed())
+			}
+			var layout struct {
+				DataStart    int32
+				RecordLength int16
+				Fields       int16
+			}
+			Ω(binary.Read(r, binary.BigEndian, &layout)).Should(Succeed())
+			Ω(int(r.Size()) - r.Len()).Should(Equal(headerLength))
+			Ω(layout.Fields).Should(BeEquivalentTo(4))
+			Ω(layout.RecordLength).Should(BeEquivalentTo(16))
+			Ω(infoStart).Should(BeEquivalentTo(headerLength + 4*fieldLength))
+
+			type field struct {
+				Type     uint8
+				Name     string
+				Units    string
+				Scale    float32
+				Digits   int8
+				Category string
+			}
+			fields := []field{}
+			for idx := 0; idx < int(layout.Fields); idx++ {
+				start := r.Len()
+				f := field{}
+				f.Type, _ = r.ReadByte()
+				f.Name = cstring(r, 34)
+				f.Units = cstring(r, 10)
+				style, _ := r.ReadByte()
+				Ω(style).Should(BeZero())
+				var transform float32
+				binary.Read(r, binary.BigEndian, &f.Scale)
+				binary.Read(r, binary.BigEndian, &transform)
+				Ω(transform).Should(BeZero())
+				binary.Read(r, binary.BigEndian, &f.Digits)
+				if version == 2 {
+					f.Category = cstring(r, 34)
+				}
+				Ω(start - r.Len()).Should(Equal(fieldLength))
+				fields = append(fields, f)
+			}
+			category := ""
+			if version == 2 {
+				category = "SSM"
+			}
+			Ω(fields).Should(Equal([]field{
+				{Type: 4, Name: "Time", Units: "s", Scale: 0.001, Digits: 3},
+				{Type: 5, Name: "Engine Speed", Units: "rpm", Scale: 1, Digits: 0, Category: category},
+				{Type: 5, Name: "A/F Sensor #1", Units: "AFR", Scale: 0.01, Digits: 2, Category: category},
+				{Type: 7, Name: "Raw", Scale: 1, Digits: 3, Category: category},
+			}))
+
+			info := data[infoStart:layout.DataStart]
+			Ω(string(info)).Should(Equal("ssm2logger SSM session\nROM ID: 0102030405\nSSM ID: a210\nDefinitions: v1 abc\n" + mlgInvalidNote + "\n\x00"))
+
+			r = bytes.NewReader(data[layout.DataStart:])
+			block := func(blockType byte, counter byte, timestamp uint16) {
+				var blockHeader struct {
+					Type      byte
+					Counter   byte
+					Timestamp uint16
+				}
+				Ω(binary.Read(r, binary.BigEndian, &blockHeader)).Should(Succeed())
+				Ω(blockHeader.Type).Should(Equal(blockType))
+				Ω(blockHeader.Counter).Should(Equal(counter))
+				Ω(blockHeader.Timestamp).Should(Equal(timestamp))
+			}
+			record := func(expected ...interface{}) {
+				raw := make([]byte, layout.RecordLength)
+				r.Read(raw)
+				var sum byte
+				for _, b := range raw {
+					sum += b
+				}
+				crc, _ := r.ReadByte()
+				Ω(crc).Should(Equal(sum))
+				Ω(binary.BigEndian.Uint32(raw)).Should(Equal(expected[0]))
+				Ω(int32(binary.BigEndian.Uint32(raw[4:]))).Should(Equal(expected[1]))
+				Ω(int32(binary.BigEndian.Uint32(raw[8:]))).Should(Equal(expected[2]))
+				Ω(math.Float32frombits(binary.BigEndian.Uint32(raw[12:]))).Should(Equal(expected[3]))
+			}
+			marker := func(message string) {
+				Ω(cstring(r, 50)).Should(Equal(message))
+			}
+
+			// Init retries are marked at the start
+			block(1, 0, 0)
+			marker("ECU answered after 2 init retries")
+			block(0, 1, 150000%65536)
+			record(uint32(1500), int32(812), int32(1471), float32(1.25))
+			// The invalid A/F value is 0
+			block(0, 2, 160000%65536)
+			record(uint32(1600), int32(-3), int32(0), float32(0))
+			block(1, 3, 170000%65536)
+			marker("Corrupt frame")
+			Ω(r.Len()).Should(BeZero())
+		},
+		table.Entry("v1", 1, 22, 55),
+		table.Entry("v2", 2, 24, 89),
+	)
+})
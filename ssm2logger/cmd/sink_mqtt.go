@@ -0,0 +1,313 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMqttTopic         = "ssm2logger/{rom_id}"
+	defaultMqttClientID      = "ssm2logger-{rom_id}"
+	defaultMqttOfflineBuffer = 10000
+
+	// mqttRetryInterval and mqttMaxReconnectInterval bound how long a broker
+	// that's back stays unnoticed; the client defaults are minutes.
+	mqttRetryInterval        = 2 * time.Second
+	mqttMaxReconnectInterval = 30 * time.Second
+)
+
+// newMqttClient creates the sinks' clients, and is swapped out by tests.
+var newMqttClient = mqtt.NewClient
+
+type mqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+// mqttSink publishes samples to an MQTT broker, either as one NDJSON style
+// message per sample or, when the topic template contains {key}, as one
+// message per parameter. Messages that can't be published while the broker
+// is unreachable are kept in a bounded offline buffer and replayed, in
+// order, once the connection is back.
+type mqttSink struct {
+	broker         string
+	brokerName     string // broker without its password, for logs
+	topic          string
+	clientID       string
+	qos            byte
+	retain         bool
+	username       string
+	password       string
+	tlsConfig      *tls.Config
+	connectTimeout time.Duration
+	publishTimeout time.Duration
+	offlineLimit   int
+	ha             *homeAssistant
+
+	client         mqtt.Client
+	replacer       *strings.Replacer
+	offline        []mqttMessage
+	offlineDropped int
+	connects       int32
+	romID          string
+	ssmID          string
+	plausibility   string
+}
+
+// newMqttSink takes the broker URL (tcp://, ssl://, ws:// or wss://) as its
+// target.
+func newMqttSink(target string, opts sinkOptions) (Sink, error) {
+	if target == "" {
+		return nil, fmt.Errorf("missing broker URL, e.g. mqtt:tcp://localhost:1883")
+	}
+	if !strings.Contains(target, "://") {
+		target = "tcp://" + target
+	}
+	s := &mqttSink{
+		broker:     target,
+		brokerName: redactUrl(target),
+		topic:      opts.String("topic", defaultMqttTopic),
+		clientID:   opts.String("client_id", defaultMqttClientID),
+		username:   opts.String("username", ""),
+		password:   opts.String("password", ""),
+	}
+
+	qos, err := opts.Int("qos", 1)
+	if err == nil && (qos < 0 || qos > 2) {
+		err = fmt.Errorf("qos must be 0, 1 or 2")
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.qos = byte(qos)
+	if s.retain, err = opts.Bool("retain", false); err != nil {
+		return nil, err
+	}
+	if s.connectTimeout, err = opts.Duration("connect_timeout", 5*time.Second); err != nil {
+		return nil, err
+	}
+	if s.publishTimeout, err = opts.Duration("publish_timeout", 5*time.Second); err != nil {
+		return nil, err
+	}
+	if s.offlineLimit, err = opts.Int("offline_buffer", defaultMqttOfflineBuffer); err != nil {
+		return nil, err
+	}
+	if s.tlsConfig, err = mqttTlsConfig(opts); err != nil {
+		return nil, err
+	}
+	if s.ha, err = newHomeAssistant(opts, s.qos); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// mqttTlsConfig builds the TLS settings from the ca, cert, key and insecure
+// options, or returns nil when none are set.
+func mqttTlsConfig(opts sinkOptions) (*tls.Config, error) {
+	ca := opts.String("ca", "")
+	cert := opts.String("cert", "")
+	key := opts.String("key", "")
+	insecure, err := opts.Bool("insecure", false)
+	if err != nil {
+		return nil, err
+	}
+	if ca == "" && cert == "" && key == "" && !insecure {
+		return nil, nil
+	}
+
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", ca)
+		}
+	}
+	if (cert == "") != (key == "") {
+		return nil, fmt.Errorf("cert and key must be set together")
+	}
+	if cert != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	return config, nil
+}
+
+// clientOptions are the broker, credentials, TLS and reconnect settings of
+// the sink's client.
+func (s *mqttSink) clientOptions() *mqtt.ClientOptions {
+	opts := mqtt.NewClientOptions().
+		AddBroker(s.broker).
+		SetClientID(s.replacer.Replace(s.clientID)).
+		SetUsername(s.username).
+		SetPassword(s.password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(mqttRetryInterval).
+		SetMaxReconnectInterval(mqttMaxReconnectInterval).
+		SetConnectTimeout(s.connectTimeout).
+		SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			logger.WithFields(log.Fields{"broker": s.brokerName, "error": err}).Warn("Lost MQTT connection, buffering until it's back")
+		}).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			logger.WithFields(log.Fields{"broker": s.brokerName}).Info("Connected to MQTT broker")
+			if atomic.AddInt32(&s.connects, 1) > 1 {
+				metrics.sinkReconnects.WithLabelValues("mqtt").Inc()
+			}
+			if s.ha != nil {
+				s.ha.connected(client)
+			}
+		})
+	if s.tlsConfig != nil {
+		opts.SetTLSConfig(s.tlsConfig)
+	}
+	if s.ha != nil {
+		s.ha.will(opts)
+	}
+	return opts
+}
+
+func (s *mqttSink) Open(session sinkSession) error {
+	s.romID = session.Info.RomIdString()
+	s.ssmID = hex.EncodeToString(session.Info.SsmId)
+	s.plausibility = session.Plausibility
+	s.replacer = strings.NewReplacer("{rom_id}", s.romID, "{ssm_id}", s.ssmID, "{protocol}", strings.ToLower(session.Info.Protocol))
+	if s.ha != nil {
+		if err := s.ha.configure(session, s.replacer.Replace(s.topic), s.replacer); err != nil {
+			return err
+		}
+	}
+
+	s.client = newMqttClient(s.clientOptions())
+	// With connect retry on, the token only completes once connected, so a
+	// broker that's down at startup just means samples get buffered.
+	token := s.client.Connect()
+	if token.WaitTimeout(s.connectTimeout) && token.Error() != nil {
+		// The client keeps retrying in the background until it's told to stop
+		s.client.Disconnect(0)
+		return token.Error()
+	}
+	if !s.client.IsConnectionOpen() {
+		logger.WithFields(log.Fields{"broker": s.brokerName}).Warn("MQTT broker not reachable yet, buffering until it is")
+	}
+	return nil
+}
+
+// messages turns a sample into the messages to publish.
+func (s *mqttSink) messages(smp sample) ([]mqttMessage, error) {
+	topic := s.replacer.Replace(s.topic)
+	if !strings.Contains(topic, "{key}") {
+		payload, err := json.Marshal(newNdjsonSample(smp, s.romID, s.ssmID, s.plausibility))
+		if err != nil {
+			return nil, err
+		}
+		return []mqttMessage{{topic: topic, payload: payload}}, nil
+	}
+
+	messages := []mqttMessage{}
+	for _, value := range smp.Values {
+		numeric := value.NumericValue()
+		if numeric == nil {
+			continue
+		}
+		messages = append(messages, mqttMessage{
+			topic:   strings.Replace(topic, "{key}", value.Column.Key(), -1),
+			payload: []byte(strconv.FormatFloat(*numeric, 'f', -1, 64)),
+		})
+	}
+	return messages, nil
+}
+
+func (s *mqttSink) Write(smp sample) error {
+	if s.ha != nil {
+		s.ha.seen()
+	}
+	messages, err := s.messages(smp)
+	if err != nil {
+		return err
+	}
+	if !s.client.IsConnectionOpen() {
+		s.buffer(messages)
+		return nil
+	}
+
+	if len(s.offline) > 0 {
+		replay := s.offline
+		s.offline = nil
+		if failed := s.publish(replay); len(failed) > 0 {
+			s.buffer(failed)
+			s.buffer(messages)
+			return fmt.Errorf("replaying %d buffered messages: %d failed", len(replay), len(failed))
+		}
+		logger.WithFields(log.Fields{"broker": s.brokerName, "messages": len(replay), "dropped": s.offlineDropped}).Info("Replayed buffered MQTT messages")
+		s.offlineDropped = 0
+	}
+
+	if failed := s.publish(messages); len(failed) > 0 {
+		s.buffer(failed)
+		return fmt.Errorf("%d of %d messages failed to publish", len(failed), len(messages))
+	}
+	return nil
+}
+
+// publish sends the messages and returns the ones that weren't acknowledged
+// within the publish timeout.
+func (s *mqttSink) publish(messages []mqttMessage) []mqttMessage {
+	tokens := make([]mqtt.Token, len(messages))
+	for idx, message := range messages {
+		tokens[idx] = s.client.Publish(message.topic, s.qos, s.retain, message.payload)
+	}
+	failed := []mqttMessage{}
+	for idx, token := range tokens {
+		if !token.WaitTimeout(s.publishTimeout) || token.Error() != nil {
+			failed = append(failed, messages[idx])
+		}
+	}
+	return failed
+}
+
+// buffer keeps messages for replay, dropping the oldest beyond the limit.
+func (s *mqttSink) buffer(messages []mqttMessage) {
+	s.offline = append(s.offline, messages...)
+	if over := len(s.offline) - s.offlineLimit; over > 0 {
+		s.offline = s.offline[over:]
+		s.offlineDropped += over
+	}
+}
+
+func (s *mqttSink) Close() error {
+	if s.client.IsConnectionOpen() && len(s.offline) > 0 {
+		if failed := s.publish(s.offline); len(failed) == 0 {
+			s.offline = nil
+		}
+	}
+	if len(s.offline) > 0 || s.offlineDropped > 0 {
+		logger.WithFields(log.Fields{"broker": s.brokerName, "unsent": len(s.offline), "dropped": s.offlineDropped}).Warn("MQTT messages were never delivered")
+	}
+	if s.ha != nil {
+		s.ha.close(s.publishTimeout)
+	}
+	s.client.Disconnect(250)
+	return nil
+}
+
+func init() {
+	registerSink("mqtt", policyDropOldest, newMqttSink)
+}
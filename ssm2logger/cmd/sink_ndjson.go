@@ -0,0 +1,213 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ndjsonReconnectInterval is how often a dropped socket is redialled.
+const ndjsonReconnectInterval = 2 * time.Second
+
+type ndjsonSample struct {
+	Ts          int64               `json:"ts"`
+	RomID       string              `json:"rom_id"`
+	SsmID       string              `json:"ssm_id"`
+	Data        map[string]*float64 `json:"data"`
+	Implausible []string            `json:"implausible,omitempty"`
+}
+
+func newNdjsonSample(smp sample, romID string, ssmID string, plausibility string) ndjsonSample {
+	data := map[string]*float64{}
+	implausible := []string{}
+	for _, value := range smp.Values {
+		key := value.Column.Key()
+		data[key] = value.NumericValue()
+		if value.Implausible && plausibility == plausibilityFlag {
+			implausible = append(implausible, key)
+		}
+	}
+	return ndjsonSample{
+		Ts:          smp.Time.UnixMilli(),
+		RomID:       romID,
+		SsmID:       ssmID,
+		Data:        data,
+		Implausible: implausible,
+	}
+}
+
+// ndjsonSink writes one JSON object per sample to stdout, a file or a unix
+// domain socket. A socket that goes away is redialled, dropping samples
+// until the consumer is back. A file is appended to until it's rotated: it's
+// then renamed to <name>-<unix time it was started><ext>, and a new one is
+// started in its place.
+type ndjsonSink struct {
+	socketPath    string
+	filePath      string
+	rotation      *logRotation
+	rotateSession bool
+	counter       *countingWriter
+	opened        time.Time
+	writer        io.Writer
+	closer        io.Closer
+	lastDial      time.Time
+	romID         string
+	ssmID         string
+	plausibility  string
+}
+
+// newNdjsonSink accepts an empty target or "stdout" for stdout,
+// "unix:<path>" for a unix domain socket and anything else as a file path.
+func newNdjsonSink(target string, opts sinkOptions) (Sink, error) {
+	switch {
+	case target == "" || target == "stdout" || target == "-":
+		return &ndjsonSink{}, nil
+	case strings.HasPrefix(target, "unix:"):
+		path := strings.TrimPrefix(target, "unix:")
+		if path == "" {
+			return nil, fmt.Errorf("missing unix socket path")
+		}
+		return &ndjsonSink{socketPath: path}, nil
+	}
+	rotation, err := newLogRotation(opts)
+	if err != nil {
+		return nil, err
+	}
+	rotateSession, err := opts.Bool("rotate_session", false)
+	if err != nil {
+		return nil, err
+	}
+	ext := filepath.Ext(target)
+	stem := strings.TrimSuffix(target, ext)
+	rotation.patterns = []string{stem + "-*" + ext, stem + "-*" + ext + ".*"}
+	return &ndjsonSink{filePath: target, rotation: rotation, rotateSession: rotateSession}, nil
+}
+
+func (s *ndjsonSink) Open(session sinkSession) error {
+	s.romID = session.Info.RomIdString()
+	s.ssmID = hex.EncodeToString(session.Info.SsmId)
+	s.plausibility = session.Plausibility
+
+	switch {
+	case s.socketPath != "":
+		return s.dial()
+	case s.filePath != "":
+		if err := s.rotation.Start(filepath.Dir(s.filePath)); err != nil {
+			return err
+		}
+		if info, err := os.Stat(s.filePath); err == nil && info.Size() > 0 && s.rotateSession {
+			// The previous session's file
+			if err := s.rotate(info.ModTime()); err != nil {
+				return err
+			}
+		}
+		return s.openFile()
+	default:
+		s.writer = os.Stdout
+	}
+	return nil
+}
+
+// openFile opens the file for appending. Rotation by size counts what's
+// already in it.
+func (s *ndjsonSink) openFile() error {
+	file, err := os.OpenFile(s.filePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.counter = &countingWriter{w: file, written: info.Size()}
+	s.writer, s.closer = s.counter, file
+	s.opened = time.Now()
+	return nil
+}
+
+// rotate renames the closed file after the time it was started and hands it
+// to the rotation for compression and retention.
+func (s *ndjsonSink) rotate(started time.Time) error {
+	ext := filepath.Ext(s.filePath)
+	stem := strings.TrimSuffix(s.filePath, ext)
+	rotated := fmt.Sprintf("%s-%d%s", stem, started.Unix(), ext)
+	for n := 2; ; n++ {
+		if _, err := os.Stat(rotated); os.IsNotExist(err) {
+			break
+		}
+		rotated = fmt.Sprintf("%s-%d-%d%s", stem, started.Unix(), n, ext)
+	}
+	if err := os.Rename(s.filePath, rotated); err != nil {
+		return err
+	}
+	s.rotation.Finished(rotated, s.filePath)
+	return nil
+}
+
+func (s *ndjsonSink) dial() error {
+	s.lastDial = time.Now()
+	conn, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to connect to unix socket %q: %w", s.socketPath, err)
+	}
+	s.writer, s.closer = conn, conn
+	return nil
+}
+
+func (s *ndjsonSink) Write(smp sample) error {
+	if s.writer == nil {
+		if time.Since(s.lastDial) < ndjsonReconnectInterval {
+			return fmt.Errorf("unix socket %q is disconnected", s.socketPath)
+		}
+		if err := s.dial(); err != nil {
+			return err
+		}
+		metrics.sinkReconnects.WithLabelValues("ndjson").Inc()
+	}
+
+	if s.rotation != nil && s.rotation.Due(s.counter.written, s.opened) {
+		s.closer.Close()
+		if err := s.rotate(s.opened); err != nil {
+			return err
+		}
+		if err := s.openFile(); err != nil {
+			return err
+		}
+	}
+
+	line, err := json.Marshal(newNdjsonSample(smp, s.romID, s.ssmID, s.plausibility))
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.writer.Write(append(line, '\n')); err != nil {
+		if s.socketPath != "" {
+			s.closer.Close()
+			s.writer, s.closer = nil, nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *ndjsonSink) Close() error {
+	var err error
+	if s.closer != nil {
+		err = s.closer.Close()
+	}
+	if s.rotation != nil {
+		s.rotation.Wait()
+	}
+	return err
+}
+
+func init() {
+	registerSink("ndjson", policyDropOldest, newNdjsonSink)
+}
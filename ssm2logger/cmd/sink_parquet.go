@@ -0,0 +1,256 @@
+package cmd
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/apache/thrift/lib/go/thrift"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+const (
+	defaultParquetRowGroup      = 1000
+	defaultParquetFlushInterval = time.Minute
+)
+
+var parquetCompression = map[string]parquet.CompressionCodec{
+	"none":   parquet.CompressionCodec_UNCOMPRESSED,
+	"snappy": parquet.CompressionCodec_SNAPPY,
+	"gzip":   parquet.CompressionCodec_GZIP,
+	"zstd":   parquet.CompressionCodec_ZSTD,
+}
+
+// parquetFile is the source.ParquetFile the writer needs, over an os.File.
+type parquetFile struct {
+	*os.File
+}
+
+func (f parquetFile) Open(name string) (source.ParquetFile, error) {
+	file, err := os.Open(name)
+	return parquetFile{file}, err
+}
+
+func (f parquetFile) Create(name string) (source.ParquetFile, error) {
+	file, err := os.Create(name)
+	return parquetFile{file}, err
+}
+
+// parquetSink writes one Parquet file per session with a typed column per
+// parameter. Every row group is followed by a provisional footer that the
+// next row group overwrites, so the file is readable up to the last complete
+// row group if logging stops without Close.
+type parquetSink struct {
+	dir           string
+	rowGroup      int
+	flushInterval time.Duration
+	compression   parquet.CompressionCodec
+
+	file         parquetFile
+	writer       *writer.CSVWriter
+	switches     []bool
+	plausibility string
+	rows         int
+	lastFlush    time.Time
+}
+
+func newParquetSink(target string, opts sinkOptions) (Sink, error) {
+	if target == "" {
+		target = logfile_path
+	}
+	s := &parquetSink{dir: target}
+
+	var err error
+	if s.rowGroup, err = opts.Int("row_group", defaultParquetRowGroup); err == nil && s.rowGroup < 1 {
+		err = fmt.Errorf("row_group must be at least 1")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.flushInterval, err = opts.Duration("flush_interval", defaultParquetFlushInterval); err != nil {
+		return nil, err
+	}
+	compression := opts.String("compression", "snappy")
+	codec, ok := parquetCompression[strings.ToLower(compression)]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression %q; expected none, snappy, gzip or zstd", compression)
+	}
+	s.compression = codec
+	return s, nil
+}
+
+func (s *parquetSink) Open(session sinkSession) error {
+	s.plausibility = session.Plausibility
+	schema := []string{"name=timestamp, type=INT64, convertedtype=TIMESTAMP_MILLIS, repetitiontype=REQUIRED"}
+	units := map[string]string{}
+	for _, column := range session.Columns {
+		// Switches are written as booleans
+		isSwitch := column.IsSwitch()
+		s.switches = append(s.switches, isSwitch)
+		kind := "DOUBLE"
+		if isSwitch {
+			kind = "BOOLEAN"
+		}
+		schema = append(schema, fmt.Sprintf("name=%s, type=%s, repetitiontype=OPTIONAL", column.Key(), kind))
+		units[column.Key()] = column.Units
+	}
+	if s.plausibility == plausibilityFlag {
+		schema = append(schema, "name=implausible, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=REQUIRED")
+	}
+
+	path := filepath.Join(s.dir, fmt.Sprintf("%s-%d-log.parquet", session.Info.RomIdString(), session.Started.Unix()))
+	file, err := createLogFile(path)
+	if err != nil {
+		return err
+	}
+	s.file = parquetFile{file}
+	if s.writer, err = writer.NewCSVWriter(schema, s.file, 1); err != nil {
+		file.Close()
+		return err
+	}
+	// Row groups are cut by flush, never by size
+	s.writer.RowGroupSize = 1 << 40
+	s.writer.CompressionType = s.compression
+
+	unitsJson, err := json.Marshal(units)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	metadata := map[string]string{
+		"rom_id":              session.Info.RomIdString(),
+		"ssm_id":              hex.EncodeToString(session.Info.SsmId),
+		"protocol":            session.Info.Protocol,
+		"session_started":     session.Started.UTC().Format(time.RFC3339),
+		"definitions_version": session.DefinitionsVersion,
+		"definitions_hash":    session.DefinitionsHash,
+		"units":               string(unitsJson),
+	}
+	keys := []string{}
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := metadata[key]
+		s.writer.Footer.KeyValueMetadata = append(s.writer.Footer.KeyValueMetadata, &parquet.KeyValue{Key: key, Value: &value})
+	}
+	s.lastFlush = time.Now()
+	return nil
+}
+
+func (s *parquetSink) Write(smp sample) error {
+	row := []interface{}{smp.Time.UnixMilli()}
+	implausible := []string{}
+	for idx, value := range smp.Values {
+		if idx >= len(s.switches) {
+			break
+		}
+		numeric := value.NumericValue()
+		switch {
+		case numeric == nil:
+			row = append(row, nil)
+		case s.switches[idx]:
+			row = append(row, *numeric != 0)
+		default:
+			row = append(row, *numeric)
+		}
+		if value.Implausible {
+			implausible = append(implausible, value.Column.Key())
+		}
+	}
+	for len(row) < len(s.switches)+1 {
+		row = append(row, nil)
+	}
+	if s.plausibility == plausibilityFlag {
+		row = append(row, strings.Join(implausible, ";"))
+	}
+
+	if err := s.writer.Write(row); err != nil {
+		return err
+	}
+	s.rows++
+	if s.rows >= s.rowGroup || time.Since(s.lastFlush) >= s.flushInterval {
+		return s.flush()
+	}
+	return nil
+}
+
+// flush writes the buffered rows as a row group followed by a provisional
+// footer, syncs the file, and moves back so the next row group overwrites
+// that footer.
+func (s *parquetSink) flush() error {
+	s.lastFlush = time.Now()
+	if s.rows == 0 {
+		return nil
+	}
+	s.rows = 0
+	if err := s.writer.Flush(true); err != nil {
+		return err
+	}
+
+	// The writer renames the schema in place when it stops, so rename a copy
+	serializer := thrift.NewTSerializer()
+	serializer.Protocol = thrift.NewTCompactProtocolFactory().GetProtocol(serializer.Transport)
+	footerBytes, err := serializer.Write(context.TODO(), s.writer.Footer)
+	if err != nil {
+		return err
+	}
+	footer := parquet.NewFileMetaData()
+	deserializer := thrift.NewTDeserializer()
+	deserializer.Protocol = thrift.NewTCompactProtocolFactory().GetProtocol(deserializer.Transport)
+	if err := deserializer.Read(context.TODO(), footer, footerBytes); err != nil {
+		return err
+	}
+	original := s.writer.Footer
+	s.writer.Footer = footer
+	s.writer.RenameSchema()
+	s.writer.Footer = original
+	if footerBytes, err = serializer.Write(context.TODO(), footer); err != nil {
+		return err
+	}
+
+	tail := make([]byte, 8)
+	binary.LittleEndian.PutUint32(tail, uint32(len(footerBytes)))
+	copy(tail[4:], "PAR1")
+	if _, err := s.file.Write(append(footerBytes, tail...)); err != nil {
+		return err
+	}
+	if err := s.file.Truncate(s.writer.Offset + int64(len(footerBytes)+len(tail))); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	_, err = s.file.Seek(s.writer.Offset, io.SeekStart)
+	return err
+}
+
+func (s *parquetSink) Close() error {
+	err := s.writer.WriteStop()
+	if err == nil {
+		// The final footer may be shorter than the provisional one it replaced
+		var end int64
+		if end, err = s.file.Seek(0, io.SeekCurrent); err == nil {
+			err = s.file.Truncate(end)
+		}
+	}
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func init() {
+	registerSink("parquet", policyBlock, newParquetSink)
+}
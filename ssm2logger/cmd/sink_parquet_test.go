@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+
+	. "github.com/nanoadmin/go-ssm2logger/ssm2lib"
+)
+
+var _ = Describe("Parquet", func() {
+	var dir string
+	conversion, _ := CompileConversion(Ssm2ParameterConversion{Expr: "x", Format: "0.0"})
+	session := sinkSession{
+		Info:         &EcuInfo{Protocol: ProtocolSsm, RomId: []byte{1, 2, 3, 4, 5}},
+		Columns:      []outputColumn{{Name: "Speed", Units: "km/h"}, {Name: "Cruise", Units: "on/off"}},
+		Plausibility: plausibilityFlag,
+		Started:      time.Unix(1700000000, 0),
+	}
+	numbered := func(n int) sample {
+		return sample{Time: time.UnixMilli(int64(n)), Values: []decodedValue{
+			{Column: session.Columns[0], Value: float64(n) + 0.5, Valid: n != 3, Implausible: n == 2, formatter: conversion},
+			{Column: session.Columns[1], Value: float64(n % 2), Valid: true, formatter: conversion},
+		}}
+	}
+	// read reads every row the file's footer knows about, as JSON.
+	read := func() []string {
+		file, err := readOnlyParquetFile{}.Open(filepath.Join(dir, "0102030405-1700000000-log.parquet"))
+		Ω(err).ShouldNot(HaveOccurred())
+		defer file.Close()
+		pr, err := reader.NewParquetReader(file, nil, 1)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer pr.ReadStop()
+		rows, err := pr.ReadByNumber(int(pr.GetNumRows()))
+		Ω(err).ShouldNot(HaveOccurred())
+		out := []string{}
+		for _, row := range rows {
+			line, _ := json.Marshal(row)
+			out = append(out, string(line))
+		}
+		return out
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "parquet")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("Can be read up to the last row group without Close", func() {
+		sink, err := newParquetSink(dir, sinkOptions{"row_group": "2", "flush_interval": "1h"})
+		Ω(err).ShouldNot(HaveOccurred())
+		s := sink.(*parquetSink)
+		Ω(s.Open(session)).Should(Succeed())
+		for n := 1; n <= 5; n++ {
+			Ω(s.Write(numbered(n))).Should(Succeed())
+		}
+		// The fifth row is still buffered
+		Ω(read()).Should(Equal([]string{
+			`{"Timestamp":1,"Speed_km_h":1.5,"Cruise_on_off":true,"Implausible":""}`,
+			`{"Timestamp":2,"Speed_km_h":2.5,"Cruise_on_off":false,"Implausible":"speed_km_h"}`,
+			`{"Timestamp":3,"Speed_km_h":null,"Cruise_on_off":true,"Implausible":""}`,
+			`{"Timestamp":4,"Speed_km_h":4.5,"Cruise_on_off":false,"Implausible":""}`,
+		}))
+
+		Ω(s.Close()).Should(Succeed())
+		rows := read()
+		Ω(rows).Should(HaveLen(5))
+		Ω(rows[4]).Should(Equal(`{"Timestamp":5,"Speed_km_h":5.5,"Cruise_on_off":true,"Implausible":""}`))
+	})
+
+	It("Flushes a row group on the flush interval", func() {
+		sink, err := newParquetSink(dir, sinkOptions{"flush_interval": "1ns"})
+		Ω(err).ShouldNot(HaveOccurred())
+		s := sink.(*parquetSink)
+		Ω(s.Open(session)).Should(Succeed())
+		Ω(s.Write(numbered(1))).Should(Succeed())
+		Ω(read()).Should(HaveLen(1))
+		Ω(s.Close()).Should(Succeed())
+	})
+
+	It("Describes the session in the footer", func() {
+		sink, err := newParquetSink(dir, sinkOptions{})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(sink.Open(session)).Should(Succeed())
+		Ω(sink.Close()).Should(Succeed())
+
+		file, err := readOnlyParquetFile{}.Open(filepath.Join(dir, "0102030405-1700000000-log.parquet"))
+		Ω(err).ShouldNot(HaveOccurred())
+		defer file.Close()
+		pr, err := reader.NewParquetReader(file, nil, 1)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer pr.ReadStop()
+		metadata := map[string]string{}
+		for _, kv := range pr.Footer.KeyValueMetadata {
+			metadata[kv.Key] = *kv.Value
+		}
+		Ω(metadata).Should(HaveKeyWithValue("rom_id", "0102030405"))
+		Ω(metadata).Should(HaveKeyWithValue("session_started", "2023-11-14T22:13:20Z"))
+		Ω(metadata).Should(HaveKeyWithValue("units", `{"cruise_on_off":"on/off","speed_km_h":"km/h"}`))
+	})
+})
+
+// readOnlyParquetFile reopens its own file when the reader opens another
+// handle on it for each column.
+type readOnlyParquetFile struct {
+	parquetFile
+	path string
+}
+
+func (f readOnlyParquetFile) Open(name string) (source.ParquetFile, error) {
+	if name == "" {
+		name = f.path
+	}
+	file, err := os.Open(name)
+	return readOnlyParquetFile{parquetFile{file}, name}, err
+}
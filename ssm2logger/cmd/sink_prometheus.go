@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultMetricsAddr = ":2112"
+
+// prometheusSink serves /metrics with the latest value of every logged
+// parameter alongside the logger's own counters.
+type prometheusSink struct {
+	addr   string
+	path   string
+	server *http.Server
+	romID  string
+
+	values     *prometheus.GaugeVec
+	lastSample prometheus.Gauge
+}
+
+// newPrometheusSink takes the listen address as its target.
+func newPrometheusSink(target string, opts sinkOptions) (Sink, error) {
+	if target == "" {
+		target = defaultMetricsAddr
+	}
+	s := &prometheusSink{
+		addr: target,
+		path: opts.String("path", "/metrics"),
+		values: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ssm2logger_parameter_value",
+			Help: "Latest value of a logged parameter. Parameters without a valid value are left out.",
+		}, []string{"param", "rom_id", "unit"}),
+		lastSample: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "ssm2logger_last_sample_timestamp_seconds",
+			Help: "Unix time of the latest sample.",
+		}),
+	}
+	return s, nil
+}
+
+func (s *prometheusSink) Open(session sinkSession) error {
+	s.romID = session.Info.RomIdString()
+	info := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ssm2logger_ecu_info",
+		Help: "The ECU being logged.",
+		ConstLabels: prometheus.Labels{
+			"protocol": session.Info.Protocol,
+			"rom_id":   s.romID,
+			"ssm_id":   hex.EncodeToString(session.Info.SsmId),
+		},
+	})
+	info.Set(1)
+	for _, collector := range []prometheus.Collector{s.values, s.lastSample, info} {
+		if err := metrics.registry.Register(collector); err != nil {
+			return fmt.Errorf("only one prometheus sink is supported: %s", err)
+		}
+	}
+
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(s.path, promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{}))
+	s.server = &http.Server{Handler: mux}
+	go func() {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.WithFields(log.Fields{"addr": s.addr, "error": err}).Error("Metrics listener stopped")
+		}
+	}()
+	logger.WithFields(log.Fields{"addr": listener.Addr().String(), "path": s.path}).Info("Serving metrics")
+	return nil
+}
+
+func (s *prometheusSink) Write(smp sample) error {
+	for _, value := range smp.Values {
+		numeric := value.NumericValue()
+		if numeric == nil {
+			s.values.DeleteLabelValues(value.Column.Key(), s.romID, value.Column.Units)
+			continue
+		}
+		s.values.WithLabelValues(value.Column.Key(), s.romID, value.Column.Units).Set(*numeric)
+	}
+	s.lastSample.Set(float64(smp.Time.UnixNano()) / 1e9)
+	return nil
+}
+
+func (s *prometheusSink) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
+
+func init() {
+	registerSink("prometheus", policyDropOldest, newPrometheusSink)
+}
@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/nanoadmin/go-ssm2logger/ssm2lib"
+)
+
+// rawSink records every frame exactly as the ECU sent it, corrupt ones
+// included, so the session can be decoded again with `decode` after the
+// definitions change.
+type rawSink struct {
+	dir           string
+	flushInterval time.Duration
+
+	file      *os.File
+	writer    *RawLogWriter
+	lastFlush time.Time
+}
+
+func newRawSink(target string, opts sinkOptions) (Sink, error) {
+	if target == "" {
+		target = logfile_path
+	}
+	flushInterval, err := opts.Duration("flush_interval", time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &rawSink{dir: target, flushInterval: flushInterval}, nil
+}
+
+func (s *rawSink) Open(session sinkSession) error {
+	logfilename := filepath.Join(s.dir, fmt.Sprintf("%s-%d-log.ssm2raw", session.Info.RomIdString(), session.Started.Unix()))
+	file, err := createLogFile(logfilename)
+	if err != nil {
+		return err
+	}
+	s.writer, err = NewRawLogWriter(file, RawLogHeader{
+		Started:            session.Started,
+		Info:               *session.Info,
+		DefinitionsVersion: session.DefinitionsVersion,
+		DefinitionsHash:    session.DefinitionsHash,
+		Mappings:           NewRawLogMappings(session.Mappings),
+	})
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file = file
+	s.lastFlush = time.Now()
+	return nil
+}
+
+func (s *rawSink) recordsFrames() {}
+
+func (s *rawSink) Write(smp sample) error {
+	if err := s.writer.WriteFrame(RawFrame{Time: smp.Time, Payload: smp.Payload, Corrupt: smp.Corrupt}); err != nil {
+		return err
+	}
+	if time.Since(s.lastFlush) >= s.flushInterval {
+		s.lastFlush = time.Now()
+		return s.writer.Flush()
+	}
+	return nil
+}
+
+func (s *rawSink) Close() error {
+	if err := s.writer.Flush(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+func init() {
+	registerSink("raw", policyBlock, newRawSink)
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	. "github.com/nanoadmin/go-ssm2logger/ssm2lib"
+)
+
+// romraiderSink writes one CSV file per session in RomRaider's log layout.
+// It has no implausible column; with --plausibility null the values are
+// left empty as in csv.
+type romraiderSink struct {
+	dir    string
+	file   *os.File
+	writer *RomRaiderLogWriter
+}
+
+func newRomraiderSink(target string, opts sinkOptions) (Sink, error) {
+	if target == "" {
+		target = logfile_path
+	}
+	return &romraiderSink{dir: target}, nil
+}
+
+func (s *romraiderSink) Open(session sinkSession) error {
+	logfilename := filepath.Join(s.dir, fmt.Sprintf("%s-%d-romraider.csv", session.Info.RomIdString(), session.Started.Unix()))
+	file, err := createLogFile(logfilename)
+	if err != nil {
+		return err
+	}
+	s.file = file
+	s.writer = NewRomRaiderLogWriter(file, session.Started)
+
+	columns := []RomRaiderColumn{}
+	for _, column := range session.Columns {
+		columns = append(columns, RomRaiderColumn{Name: column.Name, Units: column.Units})
+	}
+	return s.writer.WriteHeader(columns)
+}
+
+func (s *romraiderSink) Write(smp sample) error {
+	values := []string{}
+	for _, value := range smp.Values {
+		values = append(values, value.JavaFormatValue())
+	}
+	return s.writer.WriteRow(smp.Time, values)
+}
+
+func (s *romraiderSink) Close() error {
+	if err := s.writer.Flush(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+func init() {
+	registerSink("romraider-csv", policyBlock, newRomraiderSink)
+}
@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/nanoadmin/go-ssm2logger/ssm2lib"
+)
+
+var _ = Describe("RomRaider CSV", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "romraider")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	// There's no genuine RomRaider log in the repo to compare with, so
+	// the expected cells are worked out by hand from DecimalFormat's
+	// rules rather than from the code under test.
+	It("Writes decoded samples as RomRaider's logger would", func() {
+		compile := func(conversion Ssm2ParameterConversion) *CompiledConversion {
+			compiled, err := CompileConversion(conversion)
+			Ω(err).ShouldNot(HaveOccurred())
+			return compiled
+		}
+		mappings := []ParameterMapping{
+			{Name: "Engine Speed", Units: "rpm", Start: 0, Length: 2, Conversion: compile(Ssm2ParameterConversion{Units: "rpm", Expr: "x/4", Format: "0", StorageType: "uint16"})},
+			{Name: "Coolant Temperature", Units: "C", Start: 2, Length: 1, Conversion: compile(Ssm2ParameterConversion{Units: "C", Expr: "x-40", Format: "0"})},
+			{Name: "Engine Load (Relative)", Units: "%", Start: 3, Length: 1, Conversion: compile(Ssm2ParameterConversion{Units: "%", Expr: "x*100/255", Format: "0.00"})},
+			{Name: "Boost", Units: "psi", Start: 4, Length: 1, Conversion: compile(Ssm2ParameterConversion{Units: "psi", Expr: "x/4-0.25", Format: "#.##"})},
+		}
+		decoder, err := newSampleDecoder(mappings, nil, plausibilityOff, 0, 0)
+		Ω(err).ShouldNot(HaveOccurred())
+		columns := []outputColumn{}
+		for _, mapping := range mappings {
+			columns = append(columns, outputColumn{Name: mapping.Name, Units: mapping.Units})
+		}
+
+		started := time.Unix(1700000000, 0)
+		sink, err := newRomraiderSink(dir, sinkOptions{})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(sink.Open(sinkSession{Info: &EcuInfo{Protocol: ProtocolSsm, RomId: []byte{1, 2, 3, 4, 5}}, Columns: columns, Started: started})).Should(Succeed())
+		// 3274/4 = 818.5 and 3278/4 = 819.5 round to even
+		Ω(sink.Write(sample{Time: started, Values: decoder.Decode([]byte{0x0c, 0xca, 0x7c, 54, 3})})).Should(Succeed())
+		Ω(sink.Write(sample{Time: started.Add(121600 * time.Microsecond), Values: decoder.Decode([]byte{0x0c, 0xce, 0x7d, 255, 0})})).Should(Succeed())
+		// Boost fails to convert without its byte
+		Ω(sink.Write(sample{Time: started.Add(250 * time.Millisecond), Values: decoder.Decode([]byte{0x0c, 0xd0, 0x7d, 0})})).Should(Succeed())
+		Ω(sink.Close()).Should(Succeed())
+
+		written, err := ioutil.ReadFile(filepath.Join(dir, "0102030405-1700000000-romraider.csv"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(written)).Should(Equal(
+			"Time,Engine Speed (rpm),Coolant Temperature (C),Engine Load (Relative) (%),Boost (psi)\r\n" +
+				"0,818,84,21.18,.5\r\n" +
+				"121,820,85,100.00,-.25\r\n" +
+				"250,820,85,0.00,\r\n"))
+
+		// The other sinks keep rounding halves away from zero
+		Ω(decoder.Decode([]byte{0x0c, 0xca, 0x7c, 54, 3})[0].FormatValue()).Should(Equal("819"))
+	})
+
+	It("Writes RomRaider's own logs back unchanged", func() {
+		logs, err := filepath.Glob(filepath.Join("testdata", "romraider", "*.csv"))
+		Ω(err).ShouldNot(HaveOccurred())
+		if len(logs) == 0 {
+			Skip("no RomRaider logs in testdata/romraider, see the README there")
+		}
+		for _, path := range logs {
+			original, err := ioutil.ReadFile(path)
+			Ω(err).ShouldNot(HaveOccurred())
+			formats, err := ioutil.ReadFile(strings.TrimSuffix(path, ".csv") + ".formats")
+			Ω(err).ShouldNot(HaveOccurred(), path)
+			Ω(rewriteRomraiderLog(dir, string(original), strings.Fields(string(formats)))).Should(Equal(string(original)), path)
+		}
+	})
+})
+
+// rewriteRomraiderLog writes the values of a RomRaider log through the
+// romraider-csv sink, formatting each column with its conversion's format,
+// and returns what the sink wrote.
+func rewriteRomraiderLog(dir string, original string, formats []string) string {
+	lines := strings.Split(strings.TrimSuffix(original, "\r\n"), "\r\n")
+	headers := strings.Split(lines[0], ",")[1:]
+	Ω(formats).Should(HaveLen(len(headers)))
+
+	columns := []outputColumn{}
+	conversions := []*CompiledConversion{}
+	for idx, header := range headers {
+		split := strings.LastIndex(header, " (")
+		Ω(split).ShouldNot(BeNumerically("<", 0), header)
+		column := outputColumn{Name: header[:split], Units: strings.TrimSuffix(header[split+2:], ")")}
+		columns = append(columns, column)
+		conversion, err := CompileConversion(Ssm2ParameterConversion{Units: column.Units, Expr: "x", Format: formats[idx]})
+		Ω(err).ShouldNot(HaveOccurred())
+		conversions = append(conversions, conversion)
+	}
+
+	started := time.Unix(1700000000, 0)
+	sink, err := newRomraiderSink(dir, sinkOptions{})
+	Ω(err).ShouldNot(HaveOccurred())
+	Ω(sink.Open(sinkSession{Info: &EcuInfo{Protocol: ProtocolSsm, RomId: []byte{1, 2, 3, 4, 5}}, Columns: columns, Started: started})).Should(Succeed())
+	for _, line := range lines[1:] {
+		cells := strings.Split(line, ",")
+		Ω(cells).Should(HaveLen(len(headers)+1), line)
+		ms, err := strconv.ParseInt(cells[0], 10, 64)
+		Ω(err).ShouldNot(HaveOccurred())
+		values := []decodedValue{}
+		for idx, cell := range cells[1:] {
+			value := decodedValue{Column: columns[idx], formatter: conversions[idx]}
+			if cell != "" {
+				// ParseFloat takes the ".5" that "#.##" formats write
+				value.Value, err = strconv.ParseFloat(cell, 64)
+				Ω(err).ShouldNot(HaveOccurred(), cell)
+				value.Valid = true
+			}
+			values = append(values, value)
+		}
+		Ω(sink.Write(sample{Time: started.Add(time.Duration(ms) * time.Millisecond), Values: values})).Should(Succeed())
+	}
+	Ω(sink.Close()).Should(Succeed())
+
+	written, err := ioutil.ReadFile(filepath.Join(dir, "0102030405-1700000000-romraider.csv"))
+	Ω(err).ShouldNot(HaveOccurred())
+	return string(written)
+}
@@ -0,0 +1,306 @@
+package cmd
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const defaultSqliteFile = "ssm2logger.db"
+
+// sqliteSchema is applied in order; PRAGMA user_version records how many of
+// the statements a database already has.
+var sqliteSchema = []string{
+	`CREATE TABLE sessions (
+		id         INTEGER PRIMARY KEY,
+		started_at INTEGER NOT NULL,
+		ended_at   INTEGER,
+		protocol   TEXT NOT NULL,
+		rom_id     TEXT NOT NULL,
+		ssm_id     TEXT NOT NULL
+	)`,
+	`CREATE INDEX sessions_rom_id ON sessions (rom_id, started_at)`,
+	`CREATE TABLE parameters (
+		id   INTEGER PRIMARY KEY,
+		key  TEXT NOT NULL UNIQUE,
+		name TEXT NOT NULL,
+		unit TEXT NOT NULL
+	)`,
+	`CREATE TABLE session_parameters (
+		session_id   INTEGER NOT NULL REFERENCES sessions (id),
+		parameter_id INTEGER NOT NULL REFERENCES parameters (id),
+		position     INTEGER NOT NULL,
+		PRIMARY KEY (session_id, parameter_id)
+	) WITHOUT ROWID`,
+	`CREATE TABLE samples (
+		id         INTEGER PRIMARY KEY,
+		session_id INTEGER NOT NULL REFERENCES sessions (id),
+		ts         INTEGER NOT NULL
+	)`,
+	`CREATE INDEX samples_session_ts ON samples (session_id, ts)`,
+	`CREATE INDEX samples_ts ON samples (ts)`,
+	`CREATE TABLE sample_values (
+		sample_id    INTEGER NOT NULL REFERENCES samples (id),
+		parameter_id INTEGER NOT NULL REFERENCES parameters (id),
+		value        REAL,
+		implausible  INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (sample_id, parameter_id)
+	) WITHOUT ROWID`,
+	`CREATE INDEX sample_values_parameter ON sample_values (parameter_id, sample_id)`,
+	`CREATE VIEW readings AS
+		SELECT s.session_id, s.ts, se.rom_id, p.key, p.name, p.unit, v.value, v.implausible
+		FROM sample_values v
+		JOIN samples s ON s.id = v.sample_id
+		JOIN sessions se ON se.id = s.session_id
+		JOIN parameters p ON p.id = v.parameter_id`,
+}
+
+// openSqlite opens a database, creating or upgrading its schema. WAL mode
+// lets `query` read while a session is writing. The pragmas are per
+// connection, so there's only ever one.
+func openSqlite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	for _, pragma := range []string{"PRAGMA journal_mode = WAL", "PRAGMA synchronous = NORMAL", "PRAGMA busy_timeout = 5000", "PRAGMA foreign_keys = ON"} {
+		if _, err := db.Exec(pragma); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("%s: %s", pragma, err)
+		}
+	}
+
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if version > len(sqliteSchema) {
+		db.Close()
+		return nil, fmt.Errorf("%s was written by a newer ssm2logger (schema %d, expected at most %d)", path, version, len(sqliteSchema))
+	}
+	if version < len(sqliteSchema) {
+		if err := upgradeSqlite(db, version); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("upgrading the schema of %s: %s", path, err)
+		}
+	}
+	return db, nil
+}
+
+// openSqliteReadOnly opens an existing database for reading without touching
+// it: no journal mode change and no schema upgrade, so a database from an
+// older ssm2logger is refused rather than upgraded behind the user's back.
+func openSqliteReadOnly(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", "file:"+(&url.URL{Path: path}).EscapedPath()+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("PRAGMA busy_timeout = 5000"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		db.Close()
+		return nil, err
+	}
+	switch {
+	case version > len(sqliteSchema):
+		db.Close()
+		return nil, fmt.Errorf("%s was written by a newer ssm2logger (schema %d, expected %d)", path, version, len(sqliteSchema))
+	case version < len(sqliteSchema):
+		db.Close()
+		return nil, fmt.Errorf("%s has an outdated schema (%d, expected %d); logging to it with the sqlite sink upgrades it", path, version, len(sqliteSchema))
+	}
+	return db, nil
+}
+
+func upgradeSqlite(db *sql.DB, version int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, statement := range sqliteSchema[version:] {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", len(sqliteSchema))); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// sqliteSink stores sessions in a SQLite database, one row per sample in
+// samples and one per value in sample_values. Writes are grouped into a
+// transaction per commit interval to keep SD card writes down.
+type sqliteSink struct {
+	path           string
+	commitInterval time.Duration
+
+	db           *sql.DB
+	sessionID    int64
+	parameterIDs []int64
+	plausibility string
+	tx           *sql.Tx
+	insertSample *sql.Stmt
+	insertValue  *sql.Stmt
+	lastCommit   time.Time
+}
+
+// newSqliteSink takes the database path as its target, by default
+// ssm2logger.db in --logfile-path.
+func newSqliteSink(target string, opts sinkOptions) (Sink, error) {
+	if target == "" {
+		target = filepath.Join(logfile_path, defaultSqliteFile)
+	}
+	commitInterval, err := opts.Duration("commit_interval", time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteSink{path: target, commitInterval: commitInterval}, nil
+}
+
+func (s *sqliteSink) Open(session sinkSession) error {
+	db, err := openSqlite(s.path)
+	if err != nil {
+		return err
+	}
+	s.db = db
+	s.plausibility = session.Plausibility
+	if err := s.startSession(session); err != nil {
+		db.Close()
+		return err
+	}
+	s.lastCommit = time.Now()
+	return nil
+}
+
+// startSession records the session and the parameters logged in it.
+func (s *sqliteSink) startSession(session sinkSession) error {
+	db := s.db
+	result, err := db.Exec("INSERT INTO sessions (started_at, protocol, rom_id, ssm_id) VALUES (?, ?, ?, ?)",
+		session.Started.UnixMilli(), session.Info.Protocol, session.Info.RomIdString(), hex.EncodeToString(session.Info.SsmId))
+	if err != nil {
+		return err
+	}
+	if s.sessionID, err = result.LastInsertId(); err != nil {
+		return err
+	}
+
+	for position, column := range session.Columns {
+		key := column.Key()
+		if _, err := db.Exec("INSERT INTO parameters (key, name, unit) VALUES (?, ?, ?) ON CONFLICT (key) DO NOTHING", key, column.Name, column.Units); err != nil {
+			return err
+		}
+		var id int64
+		if err := db.QueryRow("SELECT id FROM parameters WHERE key = ?", key).Scan(&id); err != nil {
+			return err
+		}
+		if _, err := db.Exec("INSERT INTO session_parameters (session_id, parameter_id, position) VALUES (?, ?, ?)", s.sessionID, id, position); err != nil {
+			return err
+		}
+		s.parameterIDs = append(s.parameterIDs, id)
+	}
+	return nil
+}
+
+func (s *sqliteSink) begin() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if s.insertSample, err = tx.Prepare("INSERT INTO samples (session_id, ts) VALUES (?, ?)"); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if s.insertValue, err = tx.Prepare("INSERT INTO sample_values (sample_id, parameter_id, value, implausible) VALUES (?, ?, ?, ?)"); err != nil {
+		tx.Rollback()
+		return err
+	}
+	s.tx = tx
+	return nil
+}
+
+func (s *sqliteSink) commit() error {
+	s.lastCommit = time.Now()
+	if s.tx == nil {
+		return nil
+	}
+	tx := s.tx
+	s.tx = nil
+	return tx.Commit()
+}
+
+// Write inserts a sample and its values under a savepoint, so a sample that
+// fails partway isn't left half written in the transaction.
+func (s *sqliteSink) Write(smp sample) error {
+	if s.tx == nil {
+		if err := s.begin(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.tx.Exec("SAVEPOINT sample"); err != nil {
+		return err
+	}
+	if err := s.insert(smp); err != nil {
+		s.tx.Exec("ROLLBACK TO sample")
+		s.tx.Exec("RELEASE sample")
+		return err
+	}
+	if _, err := s.tx.Exec("RELEASE sample"); err != nil {
+		return err
+	}
+
+	if time.Since(s.lastCommit) >= s.commitInterval {
+		return s.commit()
+	}
+	return nil
+}
+
+func (s *sqliteSink) insert(smp sample) error {
+	result, err := s.insertSample.Exec(s.sessionID, smp.Time.UnixMilli())
+	if err != nil {
+		return err
+	}
+	sampleID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	for idx, value := range smp.Values {
+		if idx >= len(s.parameterIDs) {
+			break
+		}
+		implausible := value.Implausible && s.plausibility == plausibilityFlag
+		if _, err := s.insertValue.Exec(sampleID, s.parameterIDs[idx], value.NumericValue(), implausible); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqliteSink) Close() error {
+	err := s.commit()
+	if _, endErr := s.db.Exec("UPDATE sessions SET ended_at = ? WHERE id = ?", time.Now().UnixMilli(), s.sessionID); err == nil {
+		err = endErr
+	}
+	if closeErr := s.db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func init() {
+	registerSink("sqlite", policyBlock, newSqliteSink)
+}
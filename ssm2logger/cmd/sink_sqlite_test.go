@@ -0,0 +1,172 @@
+package cmd
+
+import (
+	"bytes"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/nanoadmin/go-ssm2logger/ssm2lib"
+)
+
+var _ = Describe("SQLite", func() {
+	var dir, path string
+	conversion, _ := CompileConversion(Ssm2ParameterConversion{Expr: "x", Format: "0.0"})
+	session := sinkSession{
+		Info:         &EcuInfo{Protocol: ProtocolSsm, RomId: []byte{1, 2, 3, 4, 5}, SsmId: []byte{0xa2}},
+		Columns:      []outputColumn{{Name: "Engine Speed", Units: "rpm"}, {Name: "Boost", Units: "psi"}},
+		Plausibility: plausibilityFlag,
+		Started:      time.UnixMilli(1700000000000),
+	}
+	values := func(ms int64, speed float64, boost *float64) sample {
+		smp := sample{Time: time.UnixMilli(ms), Values: []decodedValue{
+			{Column: session.Columns[0], Value: speed, Valid: true, formatter: conversion},
+			{Column: session.Columns[1], formatter: conversion},
+		}}
+		if boost != nil {
+			smp.Values[1].Value, smp.Values[1].Valid, smp.Values[1].Implausible = *boost, true, *boost > 40
+		}
+		return smp
+	}
+	boost := func(value float64) *float64 { return &value }
+	query := func(db *sql.DB, statement string) string {
+		rows, err := db.Query(statement)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer rows.Close()
+		var out bytes.Buffer
+		Ω(writeQueryCsv(&out, rows)).Should(Succeed())
+		return out.String()
+	}
+	writeSession := func(samples ...sample) *sqliteSink {
+		sink, err := newSqliteSink(path, sinkOptions{"commit_interval": "1h"})
+		Ω(err).ShouldNot(HaveOccurred())
+		s := sink.(*sqliteSink)
+		Ω(s.Open(session)).Should(Succeed())
+		for _, smp := range samples {
+			Ω(s.Write(smp)).Should(Succeed())
+		}
+		return s
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "sqlite")
+		Ω(err).ShouldNot(HaveOccurred())
+		path = filepath.Join(dir, "ssm2logger.db")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("Stores sessions, parameters and values", func() {
+		s := writeSession(values(1700000000100, 812.34, boost(-3.21)), values(1700000000200, 815, nil))
+		Ω(s.Write(values(1700000000300, 820, boost(45)))).Should(Succeed())
+		Ω(s.Close()).Should(Succeed())
+
+		db, err := openSqliteReadOnly(path)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer db.Close()
+		Ω(query(db, "SELECT id, started_at, ended_at IS NOT NULL AS ended, protocol, rom_id, ssm_id FROM sessions")).Should(Equal(
+			"id,started_at,ended,protocol,rom_id,ssm_id\n1,1700000000000,1,SSM,0102030405,a2\n"))
+		Ω(query(db, "SELECT key, name, unit FROM parameters ORDER BY id")).Should(Equal(
+			"key,name,unit\nengine_speed_rpm,Engine Speed,rpm\nboost_psi,Boost,psi\n"))
+		Ω(query(db, "SELECT ts, key, value, implausible FROM readings ORDER BY ts, key")).Should(Equal(
+			"ts,key,value,implausible\n" +
+				"1700000000100,boost_psi,-3.2,0\n1700000000100,engine_speed_rpm,812.3,0\n" +
+				"1700000000200,boost_psi,,0\n1700000000200,engine_speed_rpm,815,0\n" +
+				"1700000000300,boost_psi,45,1\n1700000000300,engine_speed_rpm,820,0\n"))
+	})
+
+	It("Reuses parameters across sessions", func() {
+		Ω(writeSession(values(1, 1, nil)).Close()).Should(Succeed())
+		Ω(writeSession(values(2, 2, nil)).Close()).Should(Succeed())
+		db, err := openSqliteReadOnly(path)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer db.Close()
+		Ω(query(db, "SELECT COUNT(*) AS parameters FROM parameters")).Should(Equal("parameters\n2\n"))
+		Ω(query(db, "SELECT session_id, value FROM readings WHERE key = 'engine_speed_rpm' ORDER BY ts")).Should(Equal("session_id,value\n1,1\n2,2\n"))
+	})
+
+	It("Leaves out a sample that fails partway", func() {
+		s := writeSession(values(1, 1, nil))
+		// A second value for the same parameter breaks the primary key
+		s.parameterIDs[1] = s.parameterIDs[0]
+		Ω(s.Write(values(2, 2, nil))).Should(HaveOccurred())
+		s.parameterIDs = s.parameterIDs[:1]
+		Ω(s.Write(values(3, 3, nil))).Should(Succeed())
+		Ω(s.Close()).Should(Succeed())
+
+		db, err := openSqliteReadOnly(path)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer db.Close()
+		Ω(query(db, "SELECT ts FROM samples ORDER BY ts")).Should(Equal("ts\n1\n3\n"))
+		Ω(query(db, "SELECT COUNT(*) AS n FROM sample_values")).Should(Equal("n\n3\n"))
+	})
+
+	It("Queries without writing", func() {
+		Ω(writeSession(values(1, 1, nil)).Close()).Should(Succeed())
+		db, err := openSqliteReadOnly(path)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer db.Close()
+		_, err = db.Exec("DELETE FROM samples")
+		Ω(err).Should(MatchError(ContainSubstring("readonly")))
+		Ω(query(db, "PRAGMA journal_mode")).Should(Equal("journal_mode\nwal\n"))
+	})
+
+	It("Refuses to query a database it would have to create or upgrade", func() {
+		_, err := openSqliteReadOnly(path)
+		Ω(err).Should(HaveOccurred())
+		Ω(path).ShouldNot(BeAnExistingFile())
+
+		db, err := sql.Open("sqlite", path)
+		Ω(err).ShouldNot(HaveOccurred())
+		// As an older ssm2logger would have left it
+		for _, statement := range append(sqliteSchema[:3:3], "PRAGMA user_version = 3") {
+			_, err = db.Exec(statement)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+		db.Close()
+		_, err = openSqliteReadOnly(path)
+		Ω(err).Should(MatchError(ContainSubstring("outdated schema (3, expected")))
+
+		// The sink upgrades it
+		Ω(writeSession().Close()).Should(Succeed())
+		db, err = openSqliteReadOnly(path)
+		Ω(err).ShouldNot(HaveOccurred())
+		db.Close()
+	})
+
+	It("Prints query results as JSON", func() {
+		Ω(writeSession(values(1, 1, boost(2))).Close()).Should(Succeed())
+		db, err := openSqliteReadOnly(path)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer db.Close()
+		rows, err := db.Query("SELECT key, value FROM readings ORDER BY key")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer rows.Close()
+		var out bytes.Buffer
+		Ω(writeQueryJson(&out, rows)).Should(Succeed())
+		Ω(out.String()).Should(Equal("[\n  {\"key\":\"boost_psi\",\"value\":2},\n  {\"key\":\"engine_speed_rpm\",\"value\":1}\n]\n"))
+
+		// Columns keep the query's order, including ones sharing a name
+		rows, err = db.Query("SELECT value, key, value * 2 AS value FROM readings ORDER BY key")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer rows.Close()
+		out.Reset()
+		Ω(writeQueryJson(&out, rows)).Should(Succeed())
+		Ω(out.String()).Should(Equal("[\n  {\"value\":2,\"key\":\"boost_psi\",\"value\":4},\n  {\"value\":1,\"key\":\"engine_speed_rpm\",\"value\":2}\n]\n"))
+
+		rows, err = db.Query("SELECT * FROM samples WHERE 0")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer rows.Close()
+		out.Reset()
+		Ω(writeQueryJson(&out, rows)).Should(Succeed())
+		Ω(out.String()).Should(Equal("[]\n"))
+	})
+})